@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/JonPulfer/gofiggy/pkg/handlers"
+	"github.com/JonPulfer/gofiggy/pkg/utils"
+)
+
+const commandUsage = `usage:
+  gofiggy                                   run the controller
+  gofiggy history <namespace>/<name>        list the revisions kept for a configMap
+  gofiggy rollback <namespace>/<name> <n>   restore revision n and pause refreshing`
+
+// runCommand runs the history and rollback commands against the cluster in
+// the current kubeconfig.
+func runCommand(args []string, out io.Writer) error {
+	if len(args) < 2 {
+		return errors.New(commandUsage)
+	}
+	namespace, name := "default", args[1]
+	if parts := strings.SplitN(args[1], "/", 2); len(parts) == 2 {
+		namespace, name = parts[0], parts[1]
+	}
+
+	switch {
+	case args[0] == "history" && len(args) == 2:
+		return printHistory(utils.GetClientOutOfCluster(), namespace, name, out)
+	case args[0] == "rollback" && len(args) == 3:
+		revision, err := strconv.Atoi(args[2])
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid revision %s", args[2]))
+		}
+		if err := handlers.RequestRollback(utils.GetClientOutOfCluster(),
+			namespace, name, revision); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "requested rollback of %s/%s to revision %d\n",
+			namespace, name, revision)
+		return nil
+	}
+	return errors.New(commandUsage)
+}
+
+func printHistory(kubeClient kubernetes.Interface, namespace string,
+	name string, out io.Writer) error {
+
+	revisions, err := handlers.ReadHistory(kubeClient, namespace, name)
+	if err != nil {
+		return err
+	}
+	if len(revisions) == 0 {
+		fmt.Fprintf(out, "no history kept for %s/%s\n", namespace, name)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "REVISION\tWRITTEN\tHASH\tSOURCES")
+	for _, revision := range revisions {
+		var sources []string
+		for entry, site := range revision.Sources {
+			sources = append(sources, entry+"="+site)
+		}
+		sort.Strings(sources)
+		number := strconv.Itoa(revision.Revision)
+		if revision.RollbackOf > 0 {
+			number += fmt.Sprintf(" (rollback of %d)", revision.RollbackOf)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", number, revision.WrittenAt,
+			revision.Hash, strings.Join(sources, ","))
+	}
+	return w.Flush()
+}
+
+func exitOnCommandError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -1,11 +1,38 @@
 package main
 
 import (
+	"os"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/JonPulfer/gofiggy/pkg/config"
 	"github.com/JonPulfer/gofiggy/pkg/controller"
 	"github.com/JonPulfer/gofiggy/pkg/handlers"
+	"github.com/JonPulfer/gofiggy/pkg/metrics"
 )
 
 func main() {
-	var eventHandler = handlers.NewWebsiteFetchHandler()
-	controller.Start("default", eventHandler)
+	if len(os.Args) > 1 {
+		exitOnCommandError(runCommand(os.Args[1:], os.Stdout))
+	}
+
+	cfg, err := config.LoadFromEnv()
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to load config")
+	}
+
+	pollInterval, err := cfg.PollEvery()
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to load config")
+	}
+
+	if address := cfg.MetricsListenAddress(); len(address) > 0 {
+		go func() {
+			log.Error().Err(metrics.Serve(address)).Msg("metrics server stopped")
+		}()
+	}
+
+	var eventHandler = handlers.NewWebsiteFetchHandler(cfg)
+	go eventHandler.Poll(pollInterval)
+	controller.Start(cfg.WatchNamespace(), eventHandler)
 }
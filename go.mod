@@ -3,8 +3,9 @@ module github.com/JonPulfer/gofiggy
 go 1.14
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/emicklei/go-restful v2.12.0+incompatible // indirect
-	github.com/ghodss/yaml v1.0.0 // indirect
+	github.com/ghodss/yaml v1.0.0
 	github.com/go-openapi/spec v0.19.7 // indirect
 	github.com/gogo/protobuf v1.3.1 // indirect
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b // indirect
@@ -21,6 +22,7 @@ require (
 	github.com/pkg/errors v0.8.1
 	github.com/rs/zerolog v1.18.0
 	github.com/spf13/pflag v1.0.5 // indirect
+	golang.org/x/net v0.0.0-20190827160401-ba9fcec4b297
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d // indirect
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0 // indirect
 	gopkg.in/inf.v0 v0.9.1 // indirect
@@ -0,0 +1,266 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+
+	"github.com/JonPulfer/gofiggy/pkg/egress"
+)
+
+// EnvConfigPath names the environment variable holding the path of the
+// controller config file.
+const EnvConfigPath = "GOFIGGY_CONFIG"
+
+// Config for the controller. Everything is optional, without a config file we
+// watch the default namespace as we always have.
+type Config struct {
+	// Namespace to watch, an empty string watches every namespace.
+	Namespace *string `json:"namespace,omitempty"`
+	// TLSProfiles are the named transport settings entries can choose with
+	// the `tls` option.
+	TLSProfiles map[string]TLSProfile `json:"tlsProfiles,omitempty"`
+	// Egress limits the hosts and networks entries can be fetched from.
+	Egress egress.Config `json:"egress,omitempty"`
+	// References limits what `configmap://` and `secret://` entries can read.
+	References ReferencePolicy `json:"references,omitempty"`
+	// PollInterval is how often sources that can be polled, such as git
+	// repositories, are checked for new revisions. Defaults to 5m, 0 turns
+	// polling off.
+	PollInterval string `json:"pollInterval,omitempty"`
+	// Git configures the git repository source.
+	Git GitConfig `json:"git,omitempty"`
+	// S3 configures the S3 compatible object storage source.
+	S3 S3Config `json:"s3,omitempty"`
+	// OCI configures the OCI registry source.
+	OCI OCIConfig `json:"oci,omitempty"`
+	// Vault configures the Vault KV source.
+	Vault VaultConfig `json:"vault,omitempty"`
+	// Rollouts configures the restarts of workloads using fetched content.
+	Rollouts RolloutConfig `json:"rollouts,omitempty"`
+	// MetricsAddress is where metrics are served at /metrics, :9090 unless
+	// given. An empty string turns them off.
+	MetricsAddress *string `json:"metricsAddress,omitempty"`
+}
+
+// defaultPollInterval is used when the config does not give a PollInterval.
+const defaultPollInterval = 5 * time.Minute
+
+// PollEvery returns the PollInterval as a duration.
+func (c Config) PollEvery() (time.Duration, error) {
+	if len(c.PollInterval) == 0 {
+		return defaultPollInterval, nil
+	}
+	interval, err := time.ParseDuration(c.PollInterval)
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid pollInterval")
+	}
+	return interval, nil
+}
+
+// RolloutConfig configures the rolling restarts of the Deployments,
+// StatefulSets and DaemonSets using content that has changed.
+type RolloutConfig struct {
+	// Disabled stops workloads being restarted.
+	Disabled bool `json:"disabled,omitempty"`
+	// MinInterval between the rollouts of a single workload, defaults to 1m.
+	// Changes within it are rolled out together once it has passed.
+	MinInterval string `json:"minInterval,omitempty"`
+}
+
+// defaultRolloutInterval is used when the config does not give a
+// MinInterval.
+const defaultRolloutInterval = time.Minute
+
+// Interval returns the MinInterval as a duration.
+func (r RolloutConfig) Interval() (time.Duration, error) {
+	if len(r.MinInterval) == 0 {
+		return defaultRolloutInterval, nil
+	}
+	interval, err := time.ParseDuration(r.MinInterval)
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid rollouts minInterval")
+	}
+	return interval, nil
+}
+
+// defaultMetricsAddress is used when the config does not give a
+// MetricsAddress.
+const defaultMetricsAddress = ":9090"
+
+// MetricsListenAddress returns the address to serve metrics on, which is
+// empty when they are turned off.
+func (c Config) MetricsListenAddress() string {
+	if c.MetricsAddress == nil {
+		return defaultMetricsAddress
+	}
+	return *c.MetricsAddress
+}
+
+// GitConfig configures the git repository source.
+type GitConfig struct {
+	// CacheDir holds the local mirrors of the repositories, defaults to a
+	// directory under the system temp directory.
+	CacheDir string `json:"cacheDir,omitempty"`
+	// AllowFile allows `git+file://` repositories on the controller's own
+	// filesystem to be read.
+	AllowFile bool `json:"allowFile,omitempty"`
+}
+
+// GitCacheDir returns the directory the git mirrors are kept in.
+func (g GitConfig) GitCacheDir() string {
+	if len(g.CacheDir) == 0 {
+		return filepath.Join(os.TempDir(), "gofiggy-git")
+	}
+	return g.CacheDir
+}
+
+// S3Config gives the defaults for `s3://` entries, which can override both
+// with the `endpoint` and `region` query parameters.
+type S3Config struct {
+	// Endpoint of an S3 compatible service such as MinIO, e.g.
+	// http://minio.storage:9000. AWS is used when it is not set.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Region to sign requests for, defaults to us-east-1.
+	Region string `json:"region,omitempty"`
+}
+
+// OCIConfig configures the OCI registry source.
+type OCIConfig struct {
+	// PlainHTTP lists the registries, as host:port, reached over http rather
+	// than https, like the local registry the build scripts push to.
+	PlainHTTP []string `json:"plainHTTP,omitempty"`
+}
+
+// VaultConfig gives the defaults for `vault://` entries.
+type VaultConfig struct {
+	// Address of the Vault server, e.g. https://vault.vault:8200.
+	Address string `json:"address,omitempty"`
+	// OtherAddresses are the only other Vault servers entries can pick with
+	// the `address` query parameter.
+	OtherAddresses []string `json:"otherAddresses,omitempty"`
+}
+
+// WatchNamespace returns the namespace the controller should watch.
+func (c Config) WatchNamespace() string {
+	if c.Namespace == nil {
+		return "default"
+	}
+	return *c.Namespace
+}
+
+// TLSProfile describes how to connect to sites that need more than the
+// system trust store, such as those using a private CA or requiring a client
+// certificate.
+type TLSProfile struct {
+	// CA is a PEM bundle trusted in addition to the system roots.
+	CA Material `json:"ca,omitempty"`
+	// ClientCert and ClientKey are the PEM certificate and key presented to
+	// servers that require mutual TLS.
+	ClientCert Material `json:"clientCert,omitempty"`
+	ClientKey  Material `json:"clientKey,omitempty"`
+	// ServerName overrides the name sent for SNI and checked against the
+	// server certificate.
+	ServerName string `json:"serverName,omitempty"`
+	// MinVersion is the lowest TLS version accepted, e.g. "1.2".
+	MinVersion string `json:"minVersion,omitempty"`
+	// Pins are the base64 SHA-256 hashes of public keys, optionally prefixed
+	// with `sha256/`. When given one of the certificates presented by the
+	// server has to match.
+	Pins []string `json:"pins,omitempty"`
+	// Proxy is the URL of the HTTP(S) proxy to use, NoProxy lists the hosts
+	// and domains to reach directly in the same form as NO_PROXY.
+	Proxy   string `json:"proxy,omitempty"`
+	NoProxy string `json:"noProxy,omitempty"`
+}
+
+// Material is PEM content given inline, read from a file or read from a key
+// in a ConfigMap or Secret.
+type Material struct {
+	Inline    string        `json:"inline,omitempty"`
+	File      string        `json:"file,omitempty"`
+	ConfigMap *KeyReference `json:"configMap,omitempty"`
+	Secret    *KeyReference `json:"secret,omitempty"`
+}
+
+// IsSet reports whether any source has been given.
+func (m Material) IsSet() bool {
+	return len(m.Inline) > 0 || len(m.File) > 0 || m.ConfigMap != nil ||
+		m.Secret != nil
+}
+
+// KeyReference names a key in a ConfigMap or Secret.
+type KeyReference struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Key       string `json:"key"`
+}
+
+// ReferencePolicy decides which objects entries can copy keys from. By
+// default a config map can only read other config maps in its own namespace.
+type ReferencePolicy struct {
+	// Secrets allows keys to be copied out of Secrets. It is off by default
+	// as anyone able to read the config map can then read the key.
+	Secrets bool `json:"secrets,omitempty"`
+	// Namespaces lists, for each namespace, the other namespaces its config
+	// maps can read from. `*` allows any namespace.
+	Namespaces map[string][]string `json:"namespaces,omitempty"`
+}
+
+// Allows reports whether a config map in namespace can read an object of
+// kind in target.
+func (p ReferencePolicy) Allows(kind string, namespace string, target string) error {
+	if kind == "secret" && !p.Secrets {
+		return errors.New("reading secrets is not allowed by the references policy")
+	}
+	if namespace == target {
+		return nil
+	}
+
+	for _, allowed := range p.Namespaces[namespace] {
+		if allowed == "*" || allowed == target {
+			return nil
+		}
+	}
+	return errors.New(
+		fmt.Sprintf("reading from namespace %s is not allowed for namespace %s",
+			target, namespace))
+}
+
+// Load reads the config file at path. An empty path gives the defaults.
+func Load(path string) (Config, error) {
+	var cfg Config
+	if len(path) == 0 {
+		return cfg, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, errors.Wrap(err, "unable to read config")
+	}
+
+	if err := yaml.Unmarshal(content, &cfg); err != nil {
+		return cfg, errors.Wrapf(err, "unable to parse config %s", path)
+	}
+
+	if err := cfg.Egress.Validate(); err != nil {
+		return cfg, errors.Wrapf(err, "invalid config %s", path)
+	}
+	if _, err := cfg.PollEvery(); err != nil {
+		return cfg, errors.Wrapf(err, "invalid config %s", path)
+	}
+	if _, err := cfg.Rollouts.Interval(); err != nil {
+		return cfg, errors.Wrapf(err, "invalid config %s", path)
+	}
+	return cfg, nil
+}
+
+// LoadFromEnv reads the config file named by EnvConfigPath.
+func LoadFromEnv() (Config, error) {
+	return Load(os.Getenv(EnvConfigPath))
+}
@@ -9,12 +9,9 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
-	api_v1 "k8s.io/api/core/v1"
-	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
@@ -39,6 +36,7 @@ type Controller struct {
 	queue        workqueue.RateLimitingInterface
 	informer     cache.SharedIndexInformer
 	eventHandler events.EventHandler
+	resourceType string
 	serverStartTime time.Time
 }
 
@@ -51,25 +49,36 @@ func Start(nameSpace string, eventHandler events.EventHandler) {
 		kubeClient = utils.GetClient()
 	}
 
-	informer := cache.NewSharedIndexInformer(
-		&cache.ListWatch{
-			ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
-				return kubeClient.CoreV1().ConfigMaps(nameSpace).List(options)
-			},
-			WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
-				return kubeClient.CoreV1().ConfigMaps(nameSpace).Watch(options)
-			},
-		},
-		&api_v1.ConfigMap{},
-		0, //Skip resync
-		cache.Indexers{},
-	)
+	// The informers are shared so that the event handler can read what they
+	// hold instead of listing objects from the API server.
+	factory := informers.NewFilteredSharedInformerFactory(kubeClient, 0, nameSpace, nil)
+	informer := factory.Core().V1().ConfigMaps().Informer()
+
+	// Secrets are watched so that configmaps using them for credentials can
+	// be refetched when they change.
+	secretInformer := factory.Core().V1().Secrets().Informer()
 
 	c := newResourceController(kubeClient, eventHandler, informer, "configmap")
+	sc := newResourceController(kubeClient, eventHandler, secretInformer, "secret")
+
+	if informed, ok := eventHandler.(events.InformedEventHandler); ok {
+		if err := informed.Inform(factory, c); err != nil {
+			c.logger.Fatal().Err(err).Msg("unable to inform the event handler")
+		}
+	}
 	stopCh := make(chan struct{})
 	defer close(stopCh)
 
+	// Every informer, including those the event handler reads from, has to
+	// have synced before any event is handled.
+	factory.Start(stopCh)
+	for informerType, synced := range factory.WaitForCacheSync(stopCh) {
+		if !synced {
+			c.logger.Fatal().Msgf("unable to sync the informer for %v", informerType)
+		}
+	}
 	go c.Run(stopCh)
+	go sc.Run(stopCh)
 
 	sigterm := make(chan os.Signal, 1)
 	signal.Notify(sigterm, syscall.SIGTERM)
@@ -115,18 +124,24 @@ func newResourceController(client kubernetes.Interface, eventHandler events.Even
 		informer:     informer,
 		queue:        queue,
 		eventHandler: eventHandler,
+		resourceType: resourceType,
 		serverStartTime: time.Now(),
 	}
 }
 
+// Enqueue has the object with key, like default/app, handled as though it
+// had been updated. It is handled in turn with the events being watched so
+// that the same object is never handled twice at once.
+func (c *Controller) Enqueue(key string) {
+	c.queue.Add(Event{key: key, eventType: "queued", resourceType: c.resourceType})
+}
+
 func (c *Controller) Run(stopCh <-chan struct{}) {
 	defer utilruntime.HandleCrash()
 	defer c.queue.ShutDown()
 
 	c.logger.Info().Msg("Starting controller")
 
-	go c.informer.Run(stopCh)
-
 	if !cache.WaitForCacheSync(stopCh, c.HasSynced) {
 		utilruntime.HandleError(fmt.Errorf("Timed out waiting for caches to sync"))
 		return
@@ -199,6 +214,15 @@ func (c *Controller) processItem(newEvent Event) error {
 		c.eventHandler.ObjectUpdated(obj, kbEvent)
 		c.logger.Log().Msgf("object update handled: %#v", kbEvent)
 		return nil
+	case "queued":
+		kbEvent := events.Event{
+			Kind:   newEvent.resourceType,
+			Name:   newEvent.key,
+			Reason: events.Queued,
+		}
+		c.eventHandler.ObjectUpdated(obj, kbEvent)
+		c.logger.Log().Msgf("object queued handled: %#v", kbEvent)
+		return nil
 	case "delete":
 		kbEvent := events.Event{
 			Kind:      newEvent.resourceType,
@@ -0,0 +1,375 @@
+package egress
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Rules list the hosts and networks fetches may, or may not, be made to. Each
+// rule is either a CIDR like `10.1.0.0/16`, a single address, a host name or
+// a domain written as `*.example.com` or `.example.com` to match everything
+// under it.
+type Rules struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Config is the egress policy as written in the controller config. The rules
+// for a namespace are checked before the global ones so they can open up, or
+// close off, more than the rest of the cluster gets.
+type Config struct {
+	Rules
+	Namespaces map[string]Rules `json:"namespaces,omitempty"`
+}
+
+// Validate checks every rule can be understood.
+func (c Config) Validate() error {
+	check := func(scope string, rules Rules) error {
+		for _, rule := range append(append([]string{}, rules.Allow...), rules.Deny...) {
+			if _, err := parseRule(rule); err != nil {
+				return errors.Wrap(err, scope)
+			}
+		}
+		return nil
+	}
+
+	if err := check("egress", c.Rules); err != nil {
+		return err
+	}
+	for namespace, rules := range c.Namespaces {
+		if err := check("egress namespace "+namespace, rules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockedByDefault are the ranges that are never fetched from unless a rule
+// allows them. They cover the cluster network, the API server, the node and
+// cloud metadata endpoints.
+var blockedByDefault = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, network)
+	}
+	return nets
+}
+
+// DeniedError is returned when the policy stops a fetch. Reason explains which
+// rule was applied.
+type DeniedError struct {
+	Host    string
+	Address string
+	Reason  string
+}
+
+func (e *DeniedError) Error() string {
+	target := e.Host
+	if len(e.Address) > 0 && e.Address != e.Host {
+		target = fmt.Sprintf("%s (%s)", e.Host, e.Address)
+	}
+	return fmt.Sprintf("egress to %s denied: %s", target, e.Reason)
+}
+
+// AsDenied finds a DeniedError wrapped inside err, such as by the http client.
+func AsDenied(err error) (*DeniedError, bool) {
+	for err != nil {
+		if denied, ok := err.(*DeniedError); ok {
+			return denied, true
+		}
+		switch wrapped := err.(type) {
+		case interface{ Unwrap() error }:
+			err = wrapped.Unwrap()
+		case interface{ Cause() error }:
+			err = wrapped.Cause()
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// rule is a single parsed allow or deny entry.
+type rule struct {
+	text    string
+	network *net.IPNet
+	host    string
+	domain  bool
+}
+
+func parseRule(text string) (rule, error) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if len(text) == 0 {
+		return rule{}, errors.New("empty rule")
+	}
+
+	if strings.Contains(text, "/") {
+		_, network, err := net.ParseCIDR(text)
+		if err != nil {
+			return rule{}, errors.New(fmt.Sprintf("invalid CIDR %s", text))
+		}
+		return rule{text: text, network: network}, nil
+	}
+
+	if ip := net.ParseIP(text); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return rule{text: text,
+			network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+	}
+
+	switch {
+	case strings.HasPrefix(text, "*."):
+		return rule{text: text, host: text[1:], domain: true}, nil
+	case strings.HasPrefix(text, "."):
+		return rule{text: text, host: text, domain: true}, nil
+	}
+	return rule{text: text, host: text}, nil
+}
+
+// matchesHost reports whether a host name rule covers host.
+func (r rule) matchesHost(host string) bool {
+	if len(r.host) == 0 {
+		return false
+	}
+	if r.domain {
+		return strings.HasSuffix(host, r.host)
+	}
+	return host == r.host
+}
+
+// matchesIP reports whether an address rule covers ip.
+func (r rule) matchesIP(ip net.IP) bool {
+	return r.network != nil && ip != nil && r.network.Contains(ip)
+}
+
+type ruleSet struct {
+	allow []rule
+	deny  []rule
+}
+
+func newRuleSet(rules Rules) ruleSet {
+	var set ruleSet
+	for _, text := range rules.Allow {
+		if parsed, err := parseRule(text); err == nil {
+			set.allow = append(set.allow, parsed)
+		}
+	}
+	for _, text := range rules.Deny {
+		if parsed, err := parseRule(text); err == nil {
+			set.deny = append(set.deny, parsed)
+		}
+	}
+	return set
+}
+
+// Policy decides whether a fetch may be made.
+type Policy struct {
+	global     ruleSet
+	namespaces map[string]ruleSet
+}
+
+// NewPolicy builds the Policy for the config, rules that cannot be parsed are
+// skipped so call Validate first to report them.
+func NewPolicy(c Config) *Policy {
+	policy := &Policy{
+		global:     newRuleSet(c.Rules),
+		namespaces: make(map[string]ruleSet),
+	}
+	for namespace, rules := range c.Namespaces {
+		policy.namespaces[namespace] = newRuleSet(rules)
+	}
+	return policy
+}
+
+// Check decides whether a fetch for namespace may connect to host at ip. The
+// ip is nil when only the host name is known, in which case only the host
+// name rules are applied. The rules are applied in order: -
+//
+//	namespace deny, namespace allow, global deny, global allow
+//
+// the first to match wins. A host name rule only lets the host past the
+// allow list, its address is still denied if it is in a private, loopback or
+// link-local range, as the name could resolve anywhere. Only an address or
+// CIDR rule matching it allows one of those. When no rule matches, the
+// address is denied if it is in one of those ranges, or when there are allow
+// rules that did not match it. A host name alone is denied when there are
+// allow rules that don't match it, as the address an allow rule could match
+// isn't known.
+func (p *Policy) Check(namespace string, host string, ip net.IP) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	address := ""
+	if ip != nil {
+		address = ip.String()
+	}
+	denied := func(reason string) error {
+		return &DeniedError{Host: host, Address: address, Reason: reason}
+	}
+
+	sets := []ruleSet{p.global}
+	if set, ok := p.namespaces[namespace]; ok {
+		sets = []ruleSet{set, p.global}
+	}
+
+	hasAllow := false
+	for _, set := range sets {
+		for _, r := range set.deny {
+			if r.matchesHost(host) || r.matchesIP(ip) {
+				return denied(fmt.Sprintf("matches deny rule %s", r.text))
+			}
+		}
+		for _, r := range set.allow {
+			if r.matchesIP(ip) {
+				return nil
+			}
+			if r.matchesHost(host) {
+				if network := blockedRange(ip, sets); network != nil {
+					return denied(fmt.Sprintf(
+						"%s is in the private range %s, which rule %s does not allow",
+						address, network.String(), r.text))
+				}
+				return nil
+			}
+		}
+		hasAllow = hasAllow || len(set.allow) > 0
+	}
+
+	if ip == nil {
+		if hasAllow {
+			return denied("not in the allow list, and its address is not known")
+		}
+		return nil
+	}
+
+	if network := blockedRange(ip, nil); network != nil {
+		return denied(fmt.Sprintf("%s is in the private range %s",
+			address, network.String()))
+	}
+
+	if hasAllow {
+		return denied("not in the allow list")
+	}
+	return nil
+}
+
+// blockedRange is the range blocked by default that ip is in, unless an
+// address or CIDR allow rule in sets matches it.
+func blockedRange(ip net.IP, sets []ruleSet) *net.IPNet {
+	if ip == nil {
+		return nil
+	}
+	for _, set := range sets {
+		for _, r := range set.allow {
+			if r.matchesIP(ip) {
+				return nil
+			}
+		}
+	}
+	for _, network := range blockedByDefault {
+		if network.Contains(ip) {
+			return network
+		}
+	}
+	return nil
+}
+
+// CheckURL checks the URL about to be requested, such as a redirect or one
+// sent through a proxy, resolving its host with CheckResolved.
+func (p *Policy) CheckURL(namespace string, u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return &DeniedError{Host: u.Host,
+			Reason: fmt.Sprintf("scheme %s is not allowed", u.Scheme)}
+	}
+	return p.CheckResolved(namespace, u.Hostname())
+}
+
+// CheckResolved resolves host and checks every address it has. It is for
+// fetches made by tools we cannot give our own dialer to, or through a proxy
+// that does its own resolving, so any denied address denies the host.
+func (p *Policy) CheckResolved(namespace string, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		return p.Check(namespace, host, ip)
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if err := p.Check(namespace, host, addr.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DialContext wraps dialer so that each connection is checked against the
+// policy after the host has been resolved. The connection is made to the
+// address that was checked so a second lookup cannot return another one.
+func (p *Policy) DialContext(namespace string,
+	dialer *net.Dialer) func(context.Context, string, string) (net.Conn, error) {
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else {
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for _, addr := range addrs {
+				ips = append(ips, addr.IP)
+			}
+		}
+
+		var lastErr error
+		for _, ip := range ips {
+			if err := p.Check(namespace, host, ip); err != nil {
+				lastErr = err
+				continue
+			}
+			conn, err := dialer.DialContext(ctx, network,
+				net.JoinHostPort(ip.String(), port))
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			return conn, nil
+		}
+		if lastErr == nil {
+			lastErr = errors.New(fmt.Sprintf("no addresses found for %s", host))
+		}
+		return nil, lastErr
+	}
+}
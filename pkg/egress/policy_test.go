@@ -0,0 +1,86 @@
+package egress
+
+import (
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	policy := NewPolicy(Config{
+		Rules: Rules{
+			Allow: []string{"config.internal", "10.20.0.0/16"},
+			Deny:  []string{"*.blocked.example.com", "203.0.113.7"},
+		},
+		Namespaces: map[string]Rules{
+			"platform": {Allow: []string{"10.96.0.1"}},
+			"sandbox":  {Deny: []string{"config.internal"}},
+		},
+	})
+
+	checks := []struct {
+		namespace string
+		host      string
+		ip        string
+		allowed   bool
+	}{
+		{"default", "config.internal", "93.184.216.34", true},
+		{"default", "config.internal", "10.1.2.3", false},
+		{"default", "config.internal", "169.254.169.254", false},
+		{"default", "config.internal", "10.20.4.5", true},
+		{"default", "api.internal", "10.20.4.5", true},
+		{"default", "metadata", "169.254.169.254", false},
+		{"default", "localhost", "127.0.0.1", false},
+		{"default", "kubernetes.default", "10.96.0.1", false},
+		{"platform", "kubernetes.default", "10.96.0.1", true},
+		{"sandbox", "config.internal", "93.184.216.34", false},
+		{"default", "www.blocked.example.com", "", false},
+		{"default", "example.com", "203.0.113.7", false},
+		{"default", "example.com", "93.184.216.34", false},
+		{"default", "example.com", "", false},
+		{"default", "config.internal", "", true},
+	}
+
+	for _, check := range checks {
+		err := policy.Check(check.namespace, check.host, net.ParseIP(check.ip))
+		if (err == nil) != check.allowed {
+			t.Logf("unexpected result for %s %s in %s: %v",
+				check.host, check.ip, check.namespace, err)
+			t.FailNow()
+		}
+		if err != nil {
+			if _, ok := AsDenied(&url.Error{Op: "Get", URL: "/", Err: err}); !ok {
+				t.Logf("expected a DeniedError, got %v", err)
+				t.FailNow()
+			}
+		}
+	}
+
+	// Without any allow rules only the private ranges are denied.
+	open := NewPolicy(Config{})
+	if err := open.Check("default", "example.com", net.ParseIP("93.184.216.34")); err != nil {
+		t.Logf("unexpected error: %s", err.Error())
+		t.FailNow()
+	}
+	if err := open.Check("default", "ip6-localhost", net.ParseIP("::1")); err == nil {
+		t.FailNow()
+	}
+	if err := open.Check("default", "example.com", nil); err != nil {
+		t.Logf("unexpected error for a host name alone: %s", err.Error())
+		t.FailNow()
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := (Config{Rules: Rules{Allow: []string{"10.0.0.0/33"}}}).Validate(); err == nil {
+		t.Log("expected the invalid CIDR to be rejected")
+		t.FailNow()
+	}
+	valid := Config{Namespaces: map[string]Rules{
+		"platform": {Allow: []string{"10.0.0.0/8", ".svc.cluster.local", "::1"}},
+	}}
+	if err := valid.Validate(); err != nil {
+		t.Logf("unexpected error: %s", err.Error())
+		t.FailNow()
+	}
+}
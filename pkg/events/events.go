@@ -2,6 +2,7 @@ package events
 
 import (
 	api_v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
 )
 
 type EventHandler interface {
@@ -10,6 +11,33 @@ type EventHandler interface {
 	ObjectUpdated(oldObj, newObj interface{})
 }
 
+// Queue takes the key of an object, like default/app, to be handled as
+// though it had been updated. The update is received with the Queued
+// reason.
+type Queue interface {
+	Enqueue(key string)
+}
+
+// Queued is the Reason of an update for an object that was queued to be
+// handled again, rather than one that was seen to change.
+const Queued = "queued"
+
+// IsQueued reports whether obj, as received by an EventHandler, is an update
+// for an object that was queued.
+func IsQueued(obj interface{}) bool {
+	ev, ok := obj.(Event)
+	return ok && ev.Reason == Queued
+}
+
+// InformedEventHandler is an EventHandler that reads the objects it needs
+// from the shared informers the controller runs, rather than listing them
+// from the API server, and has configMaps handled again by queueing them
+// onto configMaps. Inform is called before the informers are started.
+type InformedEventHandler interface {
+	EventHandler
+	Inform(factory informers.SharedInformerFactory, configMaps Queue) error
+}
+
 // Event received from Kubernetes from the watcher.
 type Event struct {
 	Namespace string
@@ -0,0 +1,113 @@
+package events
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+	apps_v1 "k8s.io/api/apps/v1"
+	api_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/JonPulfer/gofiggy/pkg/utils"
+)
+
+// maxMessageLength keeps event messages within what the API server accepts.
+const maxMessageLength = 1024
+
+// Recorder publishes Kubernetes events against the objects we act on so that
+// users can see what happened with `kubectl describe` rather than having to
+// read the controller logs.
+type Recorder struct {
+	logger     zerolog.Logger
+	kubeClient kubernetes.Interface
+}
+
+func NewRecorder(kubeClient kubernetes.Interface) Recorder {
+	return Recorder{
+		logger:     zerolog.New(os.Stderr).With().Timestamp().Logger(),
+		kubeClient: kubeClient,
+	}
+}
+
+// Normal records an informational event against obj.
+func (r Recorder) Normal(obj interface{}, reason string, message string) {
+	r.record(obj, api_v1.EventTypeNormal, reason, message)
+}
+
+// Warning records an event against obj that something needs attention.
+func (r Recorder) Warning(obj interface{}, reason string, message string) {
+	r.record(obj, api_v1.EventTypeWarning, reason, message)
+}
+
+func (r Recorder) record(obj interface{}, eventType string, reason string,
+	message string) {
+
+	if r.kubeClient == nil {
+		return
+	}
+
+	involved, ok := referenceTo(obj)
+	if !ok {
+		return
+	}
+
+	if len(message) > maxMessageLength {
+		message = message[:maxMessageLength]
+	}
+
+	now := meta_v1.NewTime(time.Now())
+	event := &api_v1.Event{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", involved.Name, now.UnixNano()),
+			Namespace: involved.Namespace,
+		},
+		InvolvedObject: involved,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         api_v1.EventSource{Component: "gofiggy"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	if _, err := r.kubeClient.CoreV1().Events(involved.Namespace).
+		Create(event); err != nil {
+		r.logger.Log().Err(err).Str("reason", reason).
+			Msg("failed to record event")
+	}
+}
+
+// referenceTo builds the ObjectReference for the kinds of object we raise
+// events against.
+func referenceTo(obj interface{}) (api_v1.ObjectReference, bool) {
+	var kind, apiVersion string
+
+	switch obj.(type) {
+	case *api_v1.ConfigMap:
+		kind, apiVersion = "ConfigMap", "v1"
+	case *api_v1.Secret:
+		kind, apiVersion = "Secret", "v1"
+	case *apps_v1.Deployment:
+		kind, apiVersion = "Deployment", "apps/v1"
+	case *apps_v1.StatefulSet:
+		kind, apiVersion = "StatefulSet", "apps/v1"
+	case *apps_v1.DaemonSet:
+		kind, apiVersion = "DaemonSet", "apps/v1"
+	default:
+		return api_v1.ObjectReference{}, false
+	}
+
+	objectMeta := utils.GetObjectMetaData(obj)
+	return api_v1.ObjectReference{
+		Kind:            kind,
+		APIVersion:      apiVersion,
+		Name:            objectMeta.Name,
+		Namespace:       objectMeta.Namespace,
+		UID:             objectMeta.UID,
+		ResourceVersion: objectMeta.ResourceVersion,
+	}, true
+}
@@ -0,0 +1,341 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// configMapKeyPattern matches the characters Kubernetes allows in a configMap
+// data key.
+var configMapKeyPattern = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+// entryOption applies a single `name=value` option from an annotation entry to
+// the FetchRequest. Anything after the first dot in the option name is passed
+// as arg so that `extract.version=.tag_name` arrives with arg "version".
+type entryOption func(fReq *FetchRequest, arg string, value string) error
+
+// entryOptions are the options that can follow the `key=site` part of an
+// annotation entry.
+var entryOptions = map[string]entryOption{
+	"extract": func(fReq *FetchRequest, arg string, value string) error {
+		if len(arg) == 0 {
+			return errors.New(
+				"extract needs a target key, e.g. extract.version=.tag_name")
+		}
+		if err := validateKey(arg); err != nil {
+			return err
+		}
+		fReq.Extract = append(fReq.Extract,
+			Extraction{IntoKey: arg, Expression: value})
+		return nil
+	},
+	"template": func(fReq *FetchRequest, arg string, value string) error {
+		fReq.Template = value
+		return nil
+	},
+	"template-key": func(fReq *FetchRequest, arg string, value string) error {
+		if err := validateKey(value); err != nil {
+			return err
+		}
+		fReq.TemplateKey = value
+		return nil
+	},
+	"format": func(fReq *FetchRequest, arg string, value string) error {
+		fReq.Format = value
+		return validateFormat(value)
+	},
+	"input": func(fReq *FetchRequest, arg string, value string) error {
+		fReq.InputFormat = value
+		return validateFormat(value)
+	},
+	"flatten": func(fReq *FetchRequest, arg string, value string) error {
+		flatten, err := strconv.ParseBool(value)
+		fReq.Flatten = flatten
+		return err
+	},
+	"separator": func(fReq *FetchRequest, arg string, value string) error {
+		if len(value) > 0 && !configMapKeyPattern.MatchString(value) {
+			return errors.New(
+				fmt.Sprintf("separator %q cannot be used in a configMap key",
+					value))
+		}
+		fReq.Separator = value
+		return nil
+	},
+	"archive": func(fReq *FetchRequest, arg string, value string) error {
+		if value == "tgz" {
+			value = ArchiveTarGz
+		}
+		fReq.Archive.Format = value
+		return validateArchiveFormat(value)
+	},
+	"include": func(fReq *FetchRequest, arg string, value string) error {
+		fReq.Archive.Include = append(fReq.Archive.Include, splitList(value)...)
+		return validateGlobs(fReq.Archive.Include)
+	},
+	"exclude": func(fReq *FetchRequest, arg string, value string) error {
+		fReq.Archive.Exclude = append(fReq.Archive.Exclude, splitList(value)...)
+		return validateGlobs(fReq.Archive.Exclude)
+	},
+	"strip": func(fReq *FetchRequest, arg string, value string) error {
+		strip, err := strconv.Atoi(value)
+		if err != nil || strip < 0 {
+			return errors.New(fmt.Sprintf("strip %s is not a count", value))
+		}
+		fReq.Archive.Strip = strip
+		return nil
+	},
+	"auth-secret": func(fReq *FetchRequest, arg string, value string) error {
+		fReq.AuthSecret = value
+		return nil
+	},
+	"tls": func(fReq *FetchRequest, arg string, value string) error {
+		fReq.TLSProfile = value
+		return nil
+	},
+	"method": func(fReq *FetchRequest, arg string, value string) error {
+		fReq.Method = strings.ToUpper(value)
+		return validateMethod(fReq.Method)
+	},
+	"header": func(fReq *FetchRequest, arg string, value string) error {
+		if len(arg) == 0 {
+			return errors.New(
+				"header needs a name, e.g. header.Accept=application/json")
+		}
+		if fReq.Header == nil {
+			fReq.Header = make(http.Header)
+		}
+		fReq.Header.Add(arg, value)
+		return nil
+	},
+	"body": func(fReq *FetchRequest, arg string, value string) error {
+		fReq.Body = value
+		return nil
+	},
+	"body-key": func(fReq *FetchRequest, arg string, value string) error {
+		fReq.BodyKey = value
+		return validateKey(value)
+	},
+	"body-template": func(fReq *FetchRequest, arg string, value string) error {
+		fReq.BodyTemplate = value
+		return nil
+	},
+	"retries": func(fReq *FetchRequest, arg string, value string) error {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 || retries > maxFetchRetries {
+			return errors.New(
+				fmt.Sprintf("retries must be between 0 and %d", maxFetchRetries))
+		}
+		fReq.Retries = retries
+		return nil
+	},
+	"idempotent": func(fReq *FetchRequest, arg string, value string) error {
+		idempotent, err := strconv.ParseBool(value)
+		fReq.Idempotent = idempotent
+		return err
+	},
+	"sensitive": func(fReq *FetchRequest, arg string, value string) error {
+		sensitive, err := strconv.ParseBool(value)
+		fReq.Sensitive = sensitive
+		return err
+	},
+	"secret-type": func(fReq *FetchRequest, arg string, value string) error {
+		fReq.SecretType = value
+		if len(value) == 0 {
+			return errors.New("secret-type needs a type, e.g. kubernetes.io/tls")
+		}
+		return nil
+	},
+	"write": func(fReq *FetchRequest, arg string, value string) error {
+		fReq.Write = value
+		return validateWriteStrategy(value)
+	},
+	"join": func(fReq *FetchRequest, arg string, value string) error {
+		fReq.Join = &value
+		return nil
+	},
+	"stage": func(fReq *FetchRequest, arg string, value string) error {
+		stage, err := strconv.ParseBool(value)
+		fReq.Stage = stage
+		return err
+	},
+	"schema-key": func(fReq *FetchRequest, arg string, value string) error {
+		fReq.SchemaKey = value
+		return validateKey(value)
+	},
+	"max-change": func(fReq *FetchRequest, arg string, value string) error {
+		ratio, err := strconv.ParseFloat(value, 64)
+		if err != nil || ratio <= 0 || ratio > 1 {
+			return errors.New(fmt.Sprintf(
+				"max-change must be a ratio above 0 and up to 1 but got %s", value))
+		}
+		fReq.MaxChange = ratio
+		return nil
+	},
+	"max-staleness": func(fReq *FetchRequest, arg string, value string) error {
+		maxStaleness, err := time.ParseDuration(value)
+		if err != nil || maxStaleness <= 0 {
+			return errors.New(fmt.Sprintf(
+				"max-staleness must be a duration like 1h but got %s", value))
+		}
+		fReq.MaxStaleness = maxStaleness
+		return nil
+	},
+	"fallback": func(fReq *FetchRequest, arg string, value string) error {
+		fReq.Fallback = &value
+		return nil
+	},
+	"map": func(fReq *FetchRequest, arg string, value string) error {
+		if err := validateKey(arg); err != nil {
+			return err
+		}
+		if fReq.Archive.Mapping == nil {
+			fReq.Archive.Mapping = make(map[string]string)
+		}
+		fReq.Archive.Mapping[strings.TrimPrefix(path.Clean("/"+value), "/")] = arg
+		return nil
+	},
+}
+
+// parseAnnotationEntries splits the annotation into one FetchRequest per
+// non-empty line so that a single configMap can pull from several sites: -
+//
+//	joke=curl-a-joke.herokuapp.com
+//	release=api.example.com/latest extract.version=.release.tag
+func parseAnnotationEntries(annotation string) ([]*FetchRequest, error) {
+	var fReqs []*FetchRequest
+	seen := make(map[string]bool)
+
+	for _, line := range strings.Split(annotation, "\n") {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		fReq, err := parseAnnotationData(line)
+		if err != nil {
+			return nil, err
+		}
+
+		if seen[fReq.IntoKey] {
+			return nil, errors.New(
+				fmt.Sprintf("key %s is requested more than once",
+					fReq.IntoKey))
+		}
+		seen[fReq.IntoKey] = true
+		fReqs = append(fReqs, fReq)
+	}
+
+	if len(fReqs) == 0 {
+		return nil, errors.New("annotation does not contain any entries")
+	}
+
+	return fReqs, nil
+}
+
+// applyEntryOption looks up the named option and applies it to fReq.
+func applyEntryOption(fReq *FetchRequest, option string) error {
+	parts := strings.SplitN(option, "=", 2)
+	if len(parts) != 2 {
+		return errors.New(
+			fmt.Sprintf("option %s is not of the form name=value", option))
+	}
+
+	name, arg := parts[0], ""
+	if dot := strings.Index(name, "."); dot >= 0 {
+		name, arg = name[:dot], name[dot+1:]
+	}
+
+	apply, ok := entryOptions[name]
+	if !ok {
+		return errors.New(fmt.Sprintf("unknown option %s", parts[0]))
+	}
+
+	value, err := unquoteValue(parts[1])
+	if err != nil {
+		return errors.Wrapf(err, "option %s", parts[0])
+	}
+
+	return apply(fReq, arg, value)
+}
+
+// splitEntryFields splits an entry on whitespace while keeping double quoted
+// values, such as `template="{{ .Body }}"`, together as a single field.
+func splitEntryFields(entry string) ([]string, error) {
+	var fields []string
+	var current strings.Builder
+	inQuotes, escaped := false, false
+
+	for _, r := range entry {
+		switch {
+		case escaped:
+			escaped = false
+		case inQuotes && r == '\\':
+			escaped = true
+		case r == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && (r == ' ' || r == '\t' || r == '\r'):
+			if current.Len() > 0 {
+				fields = append(fields, current.String())
+				current.Reset()
+			}
+			continue
+		}
+		current.WriteRune(r)
+	}
+
+	if inQuotes {
+		return nil, errors.New(
+			fmt.Sprintf("unterminated quote in entry: %s", entry))
+	}
+	if current.Len() > 0 {
+		fields = append(fields, current.String())
+	}
+
+	return fields, nil
+}
+
+// unquoteValue removes the Go style double quotes from an option value if it
+// has them.
+func unquoteValue(value string) (string, error) {
+	if !strings.HasPrefix(value, `"`) {
+		return value, nil
+	}
+	return strconv.Unquote(value)
+}
+
+// splitList splits a comma separated option value, ignoring empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// validateGlobs checks each glob is well formed.
+func validateGlobs(globs []string) error {
+	for _, glob := range globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return errors.Wrapf(err, "glob %s", glob)
+		}
+	}
+	return nil
+}
+
+// validateKey checks that key can be used as a configMap data key.
+func validateKey(key string) error {
+	if len(key) > 253 || !configMapKeyPattern.MatchString(key) {
+		return errors.New(
+			fmt.Sprintf("%q is not a valid configMap key", key))
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// maxConfigMapSize is the most data the API server will accept in a single
+// configMap.
+const maxConfigMapSize = 1024 * 1024
+
+// The archive formats we can expand. ArchiveAuto works the format out from
+// the content.
+const (
+	ArchiveAuto  = "auto"
+	ArchiveTar   = "tar"
+	ArchiveTarGz = "tar.gz"
+	ArchiveZip   = "zip"
+)
+
+// ArchiveOptions control how an archive is expanded into configMap keys.
+type ArchiveOptions struct {
+	Format  string
+	Include []string
+	Exclude []string
+	// Strip removes this many leading directories from each path.
+	Strip int
+	// Mapping names the key for particular paths in the archive, overriding
+	// the key the path would otherwise be given.
+	Mapping map[string]string
+}
+
+// archiveFile is a single regular file read from an archive.
+type archiveFile struct {
+	name    string
+	content []byte
+}
+
+// validateArchiveFormat checks the format given in the `archive` option.
+func validateArchiveFormat(format string) error {
+	switch format {
+	case ArchiveAuto, ArchiveTar, ArchiveTarGz, ArchiveZip:
+		return nil
+	}
+	return errors.New(fmt.Sprintf("unknown archive format %s", format))
+}
+
+// expandArchive replaces the fetched content with the files inside it, see
+// writeFiles.
+func expandArchive(fRequest *FetchRequest, fResp *FetchResponse) error {
+	content := []byte(fResp.Value)
+
+	format := fRequest.Archive.Format
+	if format == ArchiveAuto {
+		format = detectArchiveFormat(content)
+		if len(format) == 0 {
+			return errors.New("content is not a tar, tar.gz or zip archive")
+		}
+	}
+
+	selected := func(name string) bool {
+		_, ok := archiveKey(fRequest.Archive, name, fRequest.keySeparator())
+		return ok
+	}
+
+	var files []archiveFile
+	var err error
+	switch format {
+	case ArchiveZip:
+		files, err = readZip(content, selected, maxConfigMapSize)
+	case ArchiveTarGz:
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(bytes.NewReader(content)); err == nil {
+			files, err = readTar(gz, selected, maxConfigMapSize)
+		}
+	default:
+		files, err = readTar(bytes.NewReader(content), selected, maxConfigMapSize)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to read %s archive", format)
+	}
+
+	return writeFiles(fRequest, fResp, files, "archive file")
+}
+
+// writeFiles replaces the fetched content with a key for each of the files
+// selected by the archive options. Text files go into Data and anything else
+// into BinaryData. The total size has to fit in a configMap so we stop as
+// soon as that is exceeded. kind names the files in errors.
+func writeFiles(fRequest *FetchRequest, fResp *FetchResponse,
+	files []archiveFile, kind string) error {
+
+	options := fRequest.Archive
+	data := make(map[string]string)
+	binaryData := make(map[string][]byte)
+	seen := make(map[string]string)
+	total := 0
+
+	for _, file := range files {
+		key, selected := archiveKey(options, file.name, fRequest.keySeparator())
+		if !selected {
+			continue
+		}
+		if err := validateKey(key); err != nil {
+			return errors.Wrapf(err, "%s %s", kind, file.name)
+		}
+		if other, ok := seen[key]; ok {
+			return errors.New(
+				fmt.Sprintf("%ss %s and %s both map to key %s",
+					kind, other, file.name, key))
+		}
+		seen[key] = file.name
+
+		size := len(key) + len(file.content)
+		if isText(file.content) {
+			data[key] = string(file.content)
+		} else {
+			binaryData[key] = file.content
+			size = len(key) + base64.StdEncoding.EncodedLen(len(file.content))
+		}
+
+		total += size
+		if total > maxConfigMapSize {
+			return errors.New(
+				fmt.Sprintf("%s %s takes the expanded size over "+
+					"the %d bytes a configMap can hold", kind, file.name,
+					maxConfigMapSize))
+		}
+	}
+
+	if len(seen) == 0 {
+		return errors.New(fmt.Sprintf("no %ss matched", kind))
+	}
+
+	fResp.Value = ""
+	fResp.Data = data
+	fResp.BinaryData = binaryData
+	return nil
+}
+
+// detectArchiveFormat looks at the magic numbers at the start of content.
+func detectArchiveFormat(content []byte) string {
+	switch {
+	case bytes.HasPrefix(content, []byte{0x1f, 0x8b}):
+		return ArchiveTarGz
+	case bytes.HasPrefix(content, []byte("PK\x03\x04")):
+		return ArchiveZip
+	case len(content) > 262 && string(content[257:262]) == "ustar":
+		return ArchiveTar
+	}
+	return ""
+}
+
+// readLimited reads a single file refusing any that are too big to ever fit
+// into a configMap.
+func readLimited(name string, r io.Reader) ([]byte, error) {
+	content, err := ioutil.ReadAll(io.LimitReader(r, maxConfigMapSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > maxConfigMapSize {
+		return nil, errors.New(
+			fmt.Sprintf("file %s is larger than the %d bytes a configMap "+
+				"can hold", name, maxConfigMapSize))
+	}
+	return content, nil
+}
+
+// readEntry reads a file out of an archive taking its size from budget, the
+// bytes left for the whole archive. We give up as soon as the budget is
+// spent, which protects us from archives that decompress to far more than
+// they download as.
+func readEntry(name string, r io.Reader, budget *int) ([]byte, error) {
+	content, err := ioutil.ReadAll(io.LimitReader(r, int64(*budget)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > *budget {
+		return nil, errors.New(
+			fmt.Sprintf("archive file %s takes the archive over the %d bytes "+
+				"a configMap can hold", name, maxConfigMapSize))
+	}
+	*budget -= len(content)
+	return content, nil
+}
+
+// readTar reads the regular files that are selected from a tar archive, with
+// budget bytes between them.
+func readTar(r io.Reader, selected func(name string) bool,
+	budget int) ([]archiveFile, error) {
+
+	var files []archiveFile
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if !selected(header.Name) {
+			continue
+		}
+
+		content, err := readEntry(header.Name, tr, &budget)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, archiveFile{name: header.Name, content: content})
+	}
+}
+
+// readZip reads the regular files that are selected from a zip archive, with
+// budget bytes between them.
+func readZip(content []byte, selected func(name string) bool,
+	budget int) ([]archiveFile, error) {
+
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []archiveFile
+	for _, entry := range zr.File {
+		if !entry.Mode().IsRegular() || !selected(entry.Name) {
+			continue
+		}
+
+		rc, err := entry.Open()
+		if err != nil {
+			return nil, err
+		}
+		fileContent, err := readEntry(entry.Name, rc, &budget)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, archiveFile{name: entry.Name, content: fileContent})
+	}
+	return files, nil
+}
+
+// archiveKey works out the configMap key for the file at name, or reports
+// that the file is not selected by the include and exclude globs. Paths are
+// turned into keys by joining their directories with separator.
+func archiveKey(options ArchiveOptions, name string,
+	separator string) (string, bool) {
+
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if key, ok := options.Mapping[name]; ok {
+		return key, true
+	}
+
+	if len(options.Include) > 0 && !matchesAny(options.Include, name) {
+		return "", false
+	}
+	if matchesAny(options.Exclude, name) {
+		return "", false
+	}
+
+	parts := strings.Split(name, "/")
+	if options.Strip >= len(parts) {
+		return "", false
+	}
+	return strings.Join(parts[options.Strip:], separator), true
+}
+
+// matchesAny checks name against each glob. A glob without a slash is
+// matched against the file name alone, otherwise against the whole path.
+func matchesAny(globs []string, name string) bool {
+	for _, glob := range globs {
+		target := name
+		if !strings.Contains(glob, "/") {
+			target = path.Base(name)
+		}
+		if matched, _ := path.Match(glob, target); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isText reports whether content can be stored as a string in Data.
+func isText(content []byte) bool {
+	return utf8.Valid(content) && bytes.IndexByte(content, 0) < 0
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var bundleFiles = []archiveFile{
+	{name: "bundle/nginx/nginx.conf", content: []byte("worker_processes 1;\n")},
+	{name: "bundle/app.yaml", content: []byte("replicas: 2\n")},
+	{name: "bundle/README.md", content: []byte("# bundle\n")},
+	{name: "bundle/logo.png", content: []byte{0x89, 'P', 'N', 'G', 0x00, 0xff}},
+}
+
+func buildTarGz(t *testing.T, files []archiveFile) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, file := range files {
+		tw.WriteHeader(&tar.Header{
+			Name:     file.name,
+			Mode:     0644,
+			Size:     int64(len(file.content)),
+			Typeflag: tar.TypeReg,
+		})
+		tw.Write(file.content)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+	return buf.Bytes()
+}
+
+func buildZip(t *testing.T, files []archiveFile) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, file := range files {
+		w, _ := zw.Create(file.name)
+		w.Write(file.content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExpandArchive(t *testing.T) {
+	archives := map[string][]byte{
+		"tar.gz": buildTarGz(t, bundleFiles),
+		"zip":    buildZip(t, bundleFiles),
+	}
+
+	for format, content := range archives {
+		fRequest, err := parseAnnotationData("bundle=example.com archive=auto " +
+			"strip=1 exclude=*.md map.nginx.conf=bundle/nginx/nginx.conf")
+		if err != nil {
+			t.Logf("failed to parse the annotation data: %s\n", err.Error())
+			t.FailNow()
+		}
+
+		fResp := &FetchResponse{Key: "bundle", Value: string(content)}
+		if err := expandArchive(fRequest, fResp); err != nil {
+			t.Logf("failed to expand %s: %s\n", format, err.Error())
+			t.FailNow()
+		}
+
+		if fResp.Data["nginx.conf"] != "worker_processes 1;\n" ||
+			fResp.Data["app.yaml"] != "replicas: 2\n" || len(fResp.Data) != 2 {
+			t.Logf("%s data = %v", format, fResp.Data)
+			t.FailNow()
+		}
+
+		if len(fResp.BinaryData["logo.png"]) != 6 {
+			t.Logf("%s binary data = %v", format, fResp.BinaryData)
+			t.FailNow()
+		}
+	}
+}
+
+func TestExpandArchiveLimits(t *testing.T) {
+	large := []archiveFile{
+		{name: "a.txt", content: bytes.Repeat([]byte("a"), maxConfigMapSize/2)},
+		{name: "b.txt", content: bytes.Repeat([]byte("b"), maxConfigMapSize/2)},
+	}
+
+	fRequest, _ := parseAnnotationData("bundle=example.com archive=tgz")
+	fResp := &FetchResponse{Key: "bundle", Value: string(buildTarGz(t, large))}
+	err := expandArchive(fRequest, fResp)
+	if err == nil || !strings.Contains(err.Error(), "b.txt") {
+		t.Logf("expected b.txt to be rejected, got %v", err)
+		t.FailNow()
+	}
+
+	badKey := []archiveFile{{name: "my file.txt", content: []byte("x")}}
+	fResp = &FetchResponse{Key: "bundle", Value: string(buildTarGz(t, badKey))}
+	if err := expandArchive(fRequest, fResp); err == nil {
+		t.Log("expected a path that is not a valid key to be rejected")
+		t.FailNow()
+	}
+}
+
+func TestReadArchiveBudget(t *testing.T) {
+	// Compressible files that are far bigger expanded than the archive is.
+	var many []archiveFile
+	for i := 0; i < 20; i++ {
+		many = append(many, archiveFile{
+			name:    fmt.Sprintf("part-%02d.txt", i),
+			content: bytes.Repeat([]byte("a"), maxConfigMapSize/10),
+		})
+	}
+	all := func(name string) bool { return true }
+
+	_, err := readZip(buildZip(t, many), all, maxConfigMapSize)
+	if err == nil || !strings.Contains(err.Error(), "part-10.txt") {
+		t.Logf("expected zip reading to stop at part-10.txt, got %v", err)
+		t.FailNow()
+	}
+	gz, _ := gzip.NewReader(bytes.NewReader(buildTarGz(t, many)))
+	_, err = readTar(gz, all, maxConfigMapSize)
+	if err == nil || !strings.Contains(err.Error(), "part-10.txt") {
+		t.Logf("expected tar reading to stop at part-10.txt, got %v", err)
+		t.FailNow()
+	}
+
+	// Files that are excluded are never read so they do not count.
+	excluded := append([]archiveFile{{name: "huge.bin",
+		content: bytes.Repeat([]byte{0}, maxConfigMapSize*2)}}, bundleFiles...)
+	fRequest, _ := parseAnnotationData("bundle=example.com archive=zip " +
+		"strip=1 exclude=huge.bin")
+	fResp := &FetchResponse{Key: "bundle", Value: string(buildZip(t, excluded))}
+	if err := expandArchive(fRequest, fResp); err != nil {
+		t.Logf("expected the excluded file to be skipped, got %s", err.Error())
+		t.FailNow()
+	}
+	if len(fResp.Data) != 3 || len(fResp.BinaryData) != 1 {
+		t.Logf("data = %v, binary data = %v", fResp.Data, fResp.BinaryData)
+		t.FailNow()
+	}
+}
+
+func TestProcessConfigMapArchive(t *testing.T) {
+	content := buildTarGz(t, bundleFiles)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write(content)
+		}))
+	defer server.Close()
+
+	configMapToCreate := &api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: "default",
+			Name:      "bundle-config",
+			Annotations: map[string]string{
+				CurlAnnotation: "bundle=" + server.URL +
+					" archive=tar.gz include=*.png,*.conf separator=_",
+			},
+		},
+		Data: map[string]string{},
+	}
+
+	kubeClient := newFakeClientset()
+	kubeClient.CoreV1().ConfigMaps("default").Create(configMapToCreate)
+	wfh := newWebsiteFetchHandler(kubeClient, testConfig())
+	if err := wfh.processConfigMap("default", configMapToCreate); err != nil {
+		t.Logf("error processConfigMap: %s", err.Error())
+		t.FailNow()
+	}
+
+	configMap, _ := fetchConfigMap(kubeClient, "default", "bundle-config")
+	if configMap.Data["bundle_nginx_nginx.conf"] != "worker_processes 1;\n" {
+		t.Logf("data = %v", configMap.Data)
+		t.FailNow()
+	}
+	if configMap.Data["bundle_logo.png"] != "iVBORwD/" {
+		t.Logf("data = %v", configMap.Data)
+		t.FailNow()
+	}
+	if configMap.Annotations[BinaryKeysAnnotation] != "bundle_logo.png" {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"github.com/pkg/errors"
+	api_v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	apps_listers "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/JonPulfer/gofiggy/pkg/events"
+)
+
+var _ events.InformedEventHandler = WebsiteFetchHandler{}
+
+// referencesIndex indexes configMaps by the objects their entries reference,
+// as kind/namespace/name, so that the dependents of a changed object can be
+// found without reading every annotation again.
+const referencesIndex = "references"
+
+// ownerIndex indexes configMaps and secrets by the TargetOwnerLabel, so that
+// the targets written for a configMap can be found by its UID.
+const ownerIndex = "owner"
+
+// caches hold the objects the controller is informed of. They are read from
+// instead of listing objects from the API server on every event.
+type caches struct {
+	configMaps cache.Indexer
+	secrets    cache.Indexer
+	// The workloads restarted when content they use changes.
+	deployments  apps_listers.DeploymentLister
+	statefulSets apps_listers.StatefulSetLister
+	daemonSets   apps_listers.DaemonSetLister
+	// queue has configMaps handled by the controller.
+	queue events.Queue
+	// informed is closed once Inform has been called and synced reports
+	// whether the informers have listed everything since.
+	informed chan struct{}
+	synced   []cache.InformerSynced
+}
+
+// newCaches are empty until Inform is called, which the controller does
+// before it starts watching.
+func newCaches() *caches {
+	return &caches{
+		configMaps: cache.NewIndexer(cache.MetaNamespaceKeyFunc, configMapIndexers()),
+		secrets:    cache.NewIndexer(cache.MetaNamespaceKeyFunc, secretIndexers()),
+		deployments: apps_listers.NewDeploymentLister(
+			cache.NewIndexer(cache.MetaNamespaceKeyFunc, namespaceIndexers())),
+		statefulSets: apps_listers.NewStatefulSetLister(
+			cache.NewIndexer(cache.MetaNamespaceKeyFunc, namespaceIndexers())),
+		daemonSets: apps_listers.NewDaemonSetLister(
+			cache.NewIndexer(cache.MetaNamespaceKeyFunc, namespaceIndexers())),
+		informed: make(chan struct{}),
+	}
+}
+
+func namespaceIndexers() cache.Indexers {
+	return cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+}
+
+func configMapIndexers() cache.Indexers {
+	return cache.Indexers{
+		cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+		referencesIndex:      configMapReferences,
+		ownerIndex:           targetOwner,
+	}
+}
+
+func secretIndexers() cache.Indexers {
+	return cache.Indexers{
+		cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+		ownerIndex:           targetOwner,
+	}
+}
+
+// Inform has wfh read the objects it needs from the shared informers of
+// factory, and queue configMaps to be handled again onto configMaps. It has
+// to be called once, before the factory is started.
+func (wfh WebsiteFetchHandler) Inform(factory informers.SharedInformerFactory,
+	configMaps events.Queue) error {
+
+	configMapInformer := factory.Core().V1().ConfigMaps().Informer()
+	indexers := configMapIndexers()
+	delete(indexers, cache.NamespaceIndex)
+	if err := configMapInformer.AddIndexers(indexers); err != nil {
+		return errors.Wrap(err, "unable to index configMaps")
+	}
+	secretInformer := factory.Core().V1().Secrets().Informer()
+	indexers = secretIndexers()
+	delete(indexers, cache.NamespaceIndex)
+	if err := secretInformer.AddIndexers(indexers); err != nil {
+		return errors.Wrap(err, "unable to index secrets")
+	}
+
+	apps := factory.Apps().V1()
+	c := wfh.caches
+	c.configMaps = configMapInformer.GetIndexer()
+	c.secrets = secretInformer.GetIndexer()
+	c.deployments = apps.Deployments().Lister()
+	c.statefulSets = apps.StatefulSets().Lister()
+	c.daemonSets = apps.DaemonSets().Lister()
+	c.queue = configMaps
+	c.synced = []cache.InformerSynced{
+		configMapInformer.HasSynced,
+		secretInformer.HasSynced,
+		apps.Deployments().Informer().HasSynced,
+		apps.StatefulSets().Informer().HasSynced,
+		apps.DaemonSets().Informer().HasSynced,
+	}
+	close(c.informed)
+	return nil
+}
+
+// configMapReferences is the referencesIndex of a configMap.
+func configMapReferences(obj interface{}) ([]string, error) {
+	configMap, ok := obj.(*api_v1.ConfigMap)
+	if !ok || !configMapHasAnnotation(configMap) {
+		return nil, nil
+	}
+	fReqs, err := parseAnnotationEntries(configMap.Annotations[CurlAnnotation])
+	if err != nil {
+		return nil, nil
+	}
+
+	var keys []string
+	for _, fReq := range fReqs {
+		for _, ref := range fReq.references(configMap.Namespace) {
+			keys = append(keys, ref.key())
+		}
+	}
+	return keys, nil
+}
+
+// targetOwner is the ownerIndex of a configMap or secret.
+func targetOwner(obj interface{}) ([]string, error) {
+	var labels map[string]string
+	switch object := obj.(type) {
+	case *api_v1.ConfigMap:
+		labels = object.Labels
+	case *api_v1.Secret:
+		labels = object.Labels
+	}
+	if owner := labels[TargetOwnerLabel]; len(owner) > 0 {
+		return []string{owner}, nil
+	}
+	return nil, nil
+}
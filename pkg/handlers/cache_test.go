@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"sort"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	apps_listers "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/JonPulfer/gofiggy/pkg/events"
+)
+
+// queueFunc is an events.Queue handing each key to f.
+type queueFunc func(key string)
+
+func (f queueFunc) Enqueue(key string) {
+	f(key)
+}
+
+// handleQueued has wfh handle the configMaps it queues straight away, as the
+// controller would once it got to them.
+func handleQueued(wfh WebsiteFetchHandler) {
+	wfh.caches.queue = queueFunc(func(key string) {
+		wfh.ObjectUpdated(nil, events.Event{
+			Kind: "configmap", Name: key, Reason: events.Queued})
+	})
+}
+
+// syncCaches fills the caches of wfh with what kubeClient holds now, as the
+// informers would.
+func syncCaches(t *testing.T, wfh WebsiteFetchHandler, kubeClient kubernetes.Interface) {
+	configMaps, err := kubeClient.CoreV1().ConfigMaps("").List(v1.ListOptions{})
+	if err != nil {
+		t.Logf("unable to list configMaps: %s", err.Error())
+		t.FailNow()
+	}
+	var objects []interface{}
+	for i := range configMaps.Items {
+		objects = append(objects, &configMaps.Items[i])
+	}
+	wfh.caches.configMaps.Replace(objects, "")
+
+	secrets, err := kubeClient.CoreV1().Secrets("").List(v1.ListOptions{})
+	if err != nil {
+		t.Logf("unable to list secrets: %s", err.Error())
+		t.FailNow()
+	}
+	objects = nil
+	for i := range secrets.Items {
+		objects = append(objects, &secrets.Items[i])
+	}
+	wfh.caches.secrets.Replace(objects, "")
+
+	apps := kubeClient.AppsV1()
+	deployments, err := apps.Deployments("").List(v1.ListOptions{})
+	if err != nil {
+		t.Logf("unable to list deployments: %s", err.Error())
+		t.FailNow()
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, namespaceIndexers())
+	for i := range deployments.Items {
+		indexer.Add(&deployments.Items[i])
+	}
+	wfh.caches.deployments = apps_listers.NewDeploymentLister(indexer)
+
+	statefulSets, err := apps.StatefulSets("").List(v1.ListOptions{})
+	if err != nil {
+		t.Logf("unable to list statefulSets: %s", err.Error())
+		t.FailNow()
+	}
+	indexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, namespaceIndexers())
+	for i := range statefulSets.Items {
+		indexer.Add(&statefulSets.Items[i])
+	}
+	wfh.caches.statefulSets = apps_listers.NewStatefulSetLister(indexer)
+
+	daemonSets, err := apps.DaemonSets("").List(v1.ListOptions{})
+	if err != nil {
+		t.Logf("unable to list daemonSets: %s", err.Error())
+		t.FailNow()
+	}
+	indexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, namespaceIndexers())
+	for i := range daemonSets.Items {
+		indexer.Add(&daemonSets.Items[i])
+	}
+	wfh.caches.daemonSets = apps_listers.NewDaemonSetLister(indexer)
+}
+
+func TestConfigMapReferences(t *testing.T) {
+	keys, err := configMapReferences(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: "default",
+			Name:      "app",
+			Annotations: map[string]string{
+				CurlAnnotation: "database=configmap://shared/database.yaml\n" +
+					"api=configmap://endpoints/api?namespace=platform\n" +
+					"token=https://api.example.com/token auth-secret=api-credentials",
+			},
+		},
+	})
+	sort.Strings(keys)
+	expected := []string{
+		"configmap/default/shared",
+		"configmap/platform/endpoints",
+		"secret/default/api-credentials",
+	}
+	if err != nil || len(keys) != len(expected) {
+		t.Logf("unexpected references %v %v", keys, err)
+		t.FailNow()
+	}
+	for i, key := range expected {
+		if keys[i] != key {
+			t.Logf("expected %s but got %s", key, keys[i])
+			t.FailNow()
+		}
+	}
+
+	keys, _ = configMapReferences(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "plain"},
+	})
+	if len(keys) != 0 {
+		t.Logf("expected no references without the annotation but got %v", keys)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The ways credentials from a Secret can be presented to a site.
+const (
+	AuthBasic  = "basic"
+	AuthBearer = "bearer"
+	AuthHeader = "header"
+	AuthSSH    = "ssh"
+	AuthSigV4  = "sigv4"
+	// AuthKubernetes logs in to Vault with a service account token.
+	AuthKubernetes = "kubernetes"
+)
+
+// Credentials read from the Secret named by an entry's `auth-secret` option.
+// The Secret holds some of the keys: -
+//
+//	scheme:          basic, bearer, header, ssh, sigv4 or kubernetes (worked out from the other keys if absent)
+//	username:        with password for basic auth
+//	password:
+//	token:           sent as a bearer token
+//	header:          the name of the header to send apiKey in, e.g. X-API-Key
+//	apiKey:
+//	ssh-privatekey:  for git repositories reached over ssh
+//	known_hosts:     the host keys to trust, optional
+//	accessKeyId:     with secretAccessKey to sign S3 requests
+//	secretAccessKey:
+//	sessionToken:    optional, for temporary credentials
+//	role:            the Vault role to log in to with kubernetes auth
+//	authPath:        where the kubernetes auth method is mounted, optional
+//	jwt:             the service account token to log in with
+type Credentials struct {
+	Scheme        string
+	Username      string
+	Password      string
+	Token         string
+	Header        string
+	APIKey        string
+	SSHPrivateKey string
+	KnownHosts    string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	Role     string
+	AuthPath string
+	JWT      string
+}
+
+// String never includes the credential values so that they cannot end up in
+// the logs or the status by accident.
+func (c Credentials) String() string {
+	return fmt.Sprintf("Credentials{Scheme: %s}", c.Scheme)
+}
+
+// GoString keeps the values out of %#v formatting too.
+func (c Credentials) GoString() string {
+	return c.String()
+}
+
+// apply adds the credentials to req.
+func (c Credentials) apply(req *http.Request) {
+	switch c.Scheme {
+	case AuthBasic:
+		req.SetBasicAuth(c.Username, c.Password)
+	case AuthBearer:
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	case AuthHeader:
+		req.Header.Set(c.Header, c.APIKey)
+	}
+}
+
+// guardRedirects returns cl, or for header credentials a copy of it that
+// drops the header when a redirect leaves the host it was sent to. Go only
+// does that itself for the Authorization header.
+func (c Credentials) guardRedirects(cl *http.Client) *http.Client {
+	if c.Scheme != AuthHeader {
+		return cl
+	}
+	guarded := *cl
+	guarded.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Host != via[0].URL.Host {
+			req.Header.Del(c.Header)
+		}
+		if cl.CheckRedirect != nil {
+			return cl.CheckRedirect(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return &guarded
+}
+
+// credentialsFromSecretData reads Credentials from the data of a Secret. The
+// errors only ever name keys, never values.
+func credentialsFromSecretData(data map[string][]byte) (Credentials, error) {
+	value := func(key string) string {
+		return strings.TrimSpace(string(data[key]))
+	}
+
+	creds := Credentials{
+		Scheme:   strings.ToLower(value("scheme")),
+		Username: value("username"),
+		Password: value("password"),
+		Token:    value("token"),
+		Header:   value("header"),
+		APIKey:   value("apiKey"),
+
+		SSHPrivateKey: string(data["ssh-privatekey"]),
+		KnownHosts:    string(data["known_hosts"]),
+
+		AccessKeyID:     value("accessKeyId"),
+		SecretAccessKey: value("secretAccessKey"),
+		SessionToken:    value("sessionToken"),
+
+		Role:     value("role"),
+		AuthPath: value("authPath"),
+		JWT:      value("jwt"),
+	}
+
+	if len(creds.Scheme) == 0 {
+		switch {
+		case len(creds.Username) > 0:
+			creds.Scheme = AuthBasic
+		case len(creds.Token) > 0:
+			creds.Scheme = AuthBearer
+		case len(creds.Header) > 0:
+			creds.Scheme = AuthHeader
+		case len(creds.SSHPrivateKey) > 0:
+			creds.Scheme = AuthSSH
+		case len(creds.AccessKeyID) > 0:
+			creds.Scheme = AuthSigV4
+		case len(creds.Role) > 0:
+			creds.Scheme = AuthKubernetes
+		}
+	}
+
+	switch creds.Scheme {
+	case AuthBasic:
+		if len(creds.Username) == 0 {
+			return creds, errors.New("basic auth needs a username key")
+		}
+	case AuthBearer:
+		if len(creds.Token) == 0 {
+			return creds, errors.New("bearer auth needs a token key")
+		}
+	case AuthHeader:
+		if len(creds.Header) == 0 || len(creds.APIKey) == 0 {
+			return creds, errors.New("header auth needs header and apiKey keys")
+		}
+	case AuthSSH:
+		if len(creds.SSHPrivateKey) == 0 {
+			return creds, errors.New("ssh auth needs a ssh-privatekey key")
+		}
+	case AuthSigV4:
+		if len(creds.AccessKeyID) == 0 || len(creds.SecretAccessKey) == 0 {
+			return creds, errors.New(
+				"sigv4 auth needs accessKeyId and secretAccessKey keys")
+		}
+	case AuthKubernetes:
+		if len(creds.Role) == 0 || len(creds.JWT) == 0 {
+			return creds, errors.New("kubernetes auth needs role and jwt keys")
+		}
+	case "":
+		return creds, errors.New("secret needs username, token, header and " +
+			"apiKey, ssh-privatekey, accessKeyId or role keys")
+	default:
+		return creds, errors.New(
+			fmt.Sprintf("unknown auth scheme %s", creds.Scheme))
+	}
+
+	return creds, nil
+}
+
+// credentialCache saves reading a Secret for every fetch. Entries are
+// forgotten when the controller tells us the Secret has changed so that
+// rotated credentials are picked up on the next fetch.
+type credentialCache struct {
+	mu         sync.Mutex
+	kubeClient kubernetes.Interface
+	entries    map[string]Credentials
+}
+
+func newCredentialCache(kubeClient kubernetes.Interface) *credentialCache {
+	return &credentialCache{
+		kubeClient: kubeClient,
+		entries:    make(map[string]Credentials),
+	}
+}
+
+// get returns the Credentials held in the named Secret.
+func (cc *credentialCache) get(namespace string, name string) (Credentials, error) {
+	key := namespace + "/" + name
+
+	cc.mu.Lock()
+	creds, ok := cc.entries[key]
+	cc.mu.Unlock()
+	if ok {
+		return creds, nil
+	}
+
+	secret, err := cc.kubeClient.CoreV1().Secrets(namespace).
+		Get(name, v1.GetOptions{})
+	if err != nil {
+		return Credentials{}, errors.Wrapf(err, "unable to read secret %s", key)
+	}
+
+	creds, err = credentialsFromSecretData(secret.Data)
+	if err != nil {
+		return Credentials{}, errors.Wrapf(err, "secret %s", key)
+	}
+
+	cc.mu.Lock()
+	cc.entries[key] = creds
+	cc.mu.Unlock()
+	return creds, nil
+}
+
+// forget drops the cached Credentials for the named Secret.
+func (cc *credentialCache) forget(namespace string, name string) {
+	cc.mu.Lock()
+	delete(cc.entries, namespace+"/"+name)
+	cc.mu.Unlock()
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/JonPulfer/gofiggy/pkg/events"
+)
+
+func TestCredentialsFromSecretData(t *testing.T) {
+	creds, err := credentialsFromSecretData(map[string][]byte{
+		"username": []byte("gofiggy"),
+		"password": []byte("hunter2"),
+	})
+	if err != nil || creds.Scheme != AuthBasic {
+		t.FailNow()
+	}
+	if strings.Contains(fmt.Sprintf("%v %+v %#v", creds, creds, creds), "hunter2") {
+		t.Log("credential values must not be formatted")
+		t.FailNow()
+	}
+
+	creds, err = credentialsFromSecretData(map[string][]byte{
+		"header": []byte("X-API-Key"),
+		"apiKey": []byte("abc123"),
+	})
+	if err != nil || creds.Scheme != AuthHeader {
+		t.FailNow()
+	}
+
+	_, err = credentialsFromSecretData(map[string][]byte{
+		"role": []byte("gofiggy"),
+	})
+	if err == nil {
+		t.Log("expected kubernetes auth without a jwt to be refused")
+		t.FailNow()
+	}
+
+	_, err = credentialsFromSecretData(map[string][]byte{
+		"scheme":   []byte("bearer"),
+		"password": []byte("hunter2"),
+	})
+	if err == nil || strings.Contains(err.Error(), "hunter2") {
+		t.Logf("expected an error without the value, got %v", err)
+		t.FailNow()
+	}
+}
+
+func TestProcessConfigMapWithCredentials(t *testing.T) {
+	token := "first-token"
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer "+token {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, "internal config")
+		}))
+	defer server.Close()
+
+	kubeClient := newFakeClientset()
+	kubeClient.CoreV1().Secrets("default").Create(&api_v1.Secret{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "config-api"},
+		Data:       map[string][]byte{"token": []byte("first-token")},
+	})
+	kubeClient.CoreV1().ConfigMaps("default").Create(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: "default",
+			Name:      "internal-config",
+			Annotations: map[string]string{
+				CurlAnnotation: "settings=" + server.URL + " auth-secret=config-api",
+			},
+		},
+		Data: map[string]string{},
+	})
+
+	wfh := newWebsiteFetchHandler(kubeClient, testConfig())
+	configMap, _ := fetchConfigMap(kubeClient, "default", "internal-config")
+	if err := wfh.processConfigMap("default", configMap); err != nil {
+		t.Logf("error processConfigMap: %s", err.Error())
+		t.FailNow()
+	}
+
+	// Rotating the token upstream fails until the secret is updated, the
+	// cached credentials are still used in the meantime.
+	token = "second-token"
+	configMap, _ = fetchConfigMap(kubeClient, "default", "internal-config")
+	if err := wfh.processConfigMap("default", configMap); err == nil {
+		t.Log("expected the stale credentials to be refused")
+		t.FailNow()
+	}
+
+	kubeClient.CoreV1().Secrets("default").Update(&api_v1.Secret{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "config-api"},
+		Data:       map[string][]byte{"token": []byte("second-token")},
+	})
+	syncCaches(t, wfh, kubeClient)
+	handleQueued(wfh)
+	wfh.ObjectUpdated(nil, events.Event{Kind: "secret", Name: "default/config-api"})
+
+	configMap, _ = fetchConfigMap(kubeClient, "default", "internal-config")
+	if configMap.Data["settings"] != "internal config" {
+		t.FailNow()
+	}
+	if readStatus(configMap).Entries["settings"].State != StateSynced {
+		t.FailNow()
+	}
+	for _, value := range configMap.Annotations {
+		if strings.Contains(value, "-token") {
+			t.Log("credentials leaked into the annotations")
+			t.FailNow()
+		}
+	}
+}
+
+func TestHeaderCredentialsDroppedOnRedirectToAnotherHost(t *testing.T) {
+	var received []string
+	other := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			received = append(received, r.Header.Get("X-API-Key"))
+		}))
+	defer other.Close()
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/same":
+				http.Redirect(w, r, "/landed", http.StatusFound)
+			case "/other":
+				http.Redirect(w, r, other.URL, http.StatusFound)
+			default:
+				received = append(received, r.Header.Get("X-API-Key"))
+			}
+		}))
+	defer server.Close()
+
+	for _, path := range []string{"/same", "/other"} {
+		site, _ := url.Parse(server.URL + path)
+		_, err := fetchSiteData(&FetchRequest{IntoKey: "settings", FromSite: site,
+			credentials: &Credentials{Scheme: AuthHeader, Header: "X-API-Key",
+				APIKey: "abc123"}})
+		if err != nil {
+			t.Logf("error fetchSiteData: %s", err.Error())
+			t.FailNow()
+		}
+	}
+	if len(received) != 2 || received[0] != "abc123" || received[1] != "" {
+		t.Logf("expected the key to only follow redirects on the same host: %q",
+			received)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	api_v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// objectReference identifies another object an annotation entry depends on.
+type objectReference struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// references lists the objects, other than the configMap itself, that the
+// entry needs in order to be fetched. A change to any of them means the
+// entry should be fetched again.
+func (fr FetchRequest) references(namespace string) []objectReference {
+	var refs []objectReference
+	switch fr.FromSite.Scheme {
+	case "configmap", "secret":
+		if ref, _, err := objectSourceReference(fr.FromSite, namespace); err == nil {
+			refs = append(refs, ref)
+		}
+	}
+	if len(fr.AuthSecret) > 0 {
+		refs = append(refs, objectReference{
+			Kind:      "secret",
+			Namespace: namespace,
+			Name:      fr.AuthSecret,
+		})
+	}
+	return refs
+}
+
+// key identifies ref in the referencesIndex.
+func (ref objectReference) key() string {
+	return ref.Kind + "/" + ref.Namespace + "/" + ref.Name
+}
+
+// processDependents queues each configMap with an entry that references
+// ref to be processed again, finding them through the referencesIndex of the
+// cached configMaps. They are processed by the controller in turn with the
+// events it watches, so never at the same time as another change to them. A
+// configMap is never a dependent of itself.
+func (wfh WebsiteFetchHandler) processDependents(ref objectReference) {
+	dependents, err := wfh.caches.configMaps.ByIndex(referencesIndex, ref.key())
+	if err != nil {
+		wfh.logger.Log().Err(err).Msg("unable to look up dependent configMaps")
+		return
+	}
+
+	for _, obj := range dependents {
+		configMap, ok := obj.(*api_v1.ConfigMap)
+		if !ok || (ref.Kind == "configmap" && ref.Namespace == configMap.Namespace &&
+			ref.Name == configMap.Name) {
+			continue
+		}
+		key, err := cache.MetaNamespaceKeyFunc(configMap)
+		if err != nil {
+			continue
+		}
+
+		wfh.logger.Log().Str("configMap", configMap.Name).
+			Str("dependsOn", ref.Kind+"/"+ref.Name).
+			Msg("queueing dependent configMap")
+		wfh.caches.queue.Enqueue(key)
+	}
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/JonPulfer/gofiggy/pkg/config"
+	"github.com/JonPulfer/gofiggy/pkg/events"
+)
+
+func TestDependentsAreQueued(t *testing.T) {
+	// a and b copy from each other, which must not queue them forever.
+	kubeClient := newFakeClientset(
+		&api_v1.ConfigMap{
+			ObjectMeta: v1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "a",
+				Annotations: map[string]string{CurlAnnotation: "copy=configmap://b/value"},
+			},
+			Data: map[string]string{"value": "a-1"},
+		},
+		&api_v1.ConfigMap{
+			ObjectMeta: v1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "b",
+				Annotations: map[string]string{CurlAnnotation: "copy=configmap://a/value"},
+			},
+			Data: map[string]string{"value": "b-1"},
+		},
+	)
+
+	wfh := newWebsiteFetchHandler(kubeClient, config.Config{})
+	syncCaches(t, wfh, kubeClient)
+	var queued []string
+	wfh.caches.queue = queueFunc(func(key string) { queued = append(queued, key) })
+
+	wfh.ObjectUpdated(nil, events.Event{Kind: "configmap", Name: "default/b"})
+	configMap, _ := fetchConfigMap(kubeClient, "default", "a")
+	if len(queued) != 1 || queued[0] != "default/a" || len(configMap.Data["copy"]) > 0 {
+		t.Logf("expected only a to be queued, not processed: %v %v", queued, configMap.Data)
+		t.FailNow()
+	}
+
+	queued = nil
+	wfh.ObjectUpdated(nil, events.Event{Kind: "configmap", Name: "default/a",
+		Reason: events.Queued})
+	configMap, _ = fetchConfigMap(kubeClient, "default", "a")
+	if len(queued) != 0 || configMap.Data["copy"] != "b-1" {
+		t.Logf("expected a to be processed without queueing b: %v %v", queued, configMap.Data)
+		t.FailNow()
+	}
+
+	// Secrets are no different.
+	kubeClient.CoreV1().ConfigMaps("default").Create(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: "default",
+			Name:      "api",
+			Annotations: map[string]string{
+				CurlAnnotation: "token=https://api.example.com/token auth-secret=api-credentials",
+			},
+		},
+	})
+	syncCaches(t, wfh, kubeClient)
+	wfh.ObjectUpdated(nil, events.Event{Kind: "secret", Name: "default/api-credentials"})
+	if len(queued) != 1 || queued[0] != "default/api" {
+		t.Logf("expected api to be queued: %v", queued)
+		t.FailNow()
+	}
+}
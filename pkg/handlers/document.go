@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"encoding/json"
+	"mime"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// decodeDocument parses fetched content so that it can be used as structured
+// data. The Content-Type decides how when it is JSON or YAML, otherwise we try
+// JSON and then YAML. Content that is neither, or that is only a YAML scalar,
+// is returned as the plain string.
+func decodeDocument(body string, contentType string) interface{} {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch {
+	case strings.HasSuffix(mediaType, "json"):
+		if document, err := decodeJSON(body); err == nil {
+			return document
+		}
+	case strings.HasSuffix(mediaType, "yaml"):
+		if document, err := decodeYAML(body); err == nil {
+			return document
+		}
+	default:
+		if document, err := decodeJSON(body); err == nil {
+			return document
+		}
+		if document, err := decodeYAML(body); err == nil {
+			switch document.(type) {
+			case map[string]interface{}, []interface{}:
+				return document
+			}
+		}
+	}
+
+	return body
+}
+
+func decodeJSON(body string) (interface{}, error) {
+	var document interface{}
+	if err := json.Unmarshal([]byte(body), &document); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+func decodeYAML(body string) (interface{}, error) {
+	asJSON, err := yaml.YAMLToJSON([]byte(body))
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON(string(asJSON))
+}
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	api_v1 "k8s.io/api/core/v1"
+)
+
+// DriftPolicyAnnotation chooses what happens when a key we manage is edited
+// by hand, like: -
+//
+//	x-k8s.io/curl-me-that-drift-policy: pause
+//
+// revert, the default, writes the fetched value back straight away. pause
+// keeps the edit and stops refreshing the configMap until the
+// PausedAnnotation is removed. warn keeps the edit until the configMap is
+// next refreshed, by the controller queueing it or by a change to its
+// settings. Every drift raises a Warning event and is recorded in the status.
+const DriftPolicyAnnotation = "x-k8s.io/curl-me-that-drift-policy"
+
+// KeptEditAnnotation marks an object holding an edit kept by the warn policy.
+// It holds the settingsHash of the configMap the edit was made for, and the
+// edit is kept while that matches until the configMap is next refreshed.
+const KeptEditAnnotation = "x-k8s.io/curl-me-that-kept-edit"
+
+// PausedAnnotation stops a configMap being refreshed while it is "true". It
+// is set on the object that drifted by the pause policy, and can be set on
+// the annotated configMap by hand.
+const PausedAnnotation = "x-k8s.io/curl-me-that-paused"
+
+const (
+	DriftRevert = "revert"
+	DriftPause  = "pause"
+	DriftWarn   = "warn"
+)
+
+// maxDriftRecords is how many drifts are kept in the status.
+const maxDriftRecords = 10
+
+// DriftRecord is a hand edit of the keys we manage.
+type DriftRecord struct {
+	Keys       []string `json:"keys"`
+	Action     string   `json:"action"`
+	DetectedAt string   `json:"detectedAt"`
+}
+
+// contentHash is what's recorded of a value we wrote so that edits to it can
+// be spotted.
+func contentHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:])[:16]
+}
+
+// hash records the hash of each key in data written by the entries.
+func (mk managedKeys) hash(data map[string]string) {
+	for name, entry := range mk {
+		entry.Hashes = make(map[string]string)
+		for _, key := range entry.Keys {
+			if value, ok := data[key]; ok {
+				entry.Hashes[key] = contentHash(value)
+			}
+		}
+		mk[name] = entry
+	}
+}
+
+// drifted returns the sorted keys in data that no longer hash to what we
+// wrote, including those that have been removed.
+func (mk managedKeys) drifted(data map[string]string) []string {
+	var keys []string
+	for _, entry := range mk {
+		for key, hash := range entry.Hashes {
+			if value, ok := data[key]; !ok || contentHash(value) != hash {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// driftPolicy returns the DriftPolicyAnnotation of configMap.
+func driftPolicy(configMap *api_v1.ConfigMap) (string, error) {
+	policy := strings.TrimSpace(configMap.Annotations[DriftPolicyAnnotation])
+	switch policy {
+	case "":
+		return DriftRevert, nil
+	case DriftRevert, DriftPause, DriftWarn:
+		return policy, nil
+	}
+	return DriftRevert, errors.New(fmt.Sprintf(
+		"drift policy must be revert, pause or warn but got %s", policy))
+}
+
+// isPaused reports whether annotations turn refreshing off.
+func isPaused(annotations map[string]string) bool {
+	return annotations[PausedAnnotation] == "true"
+}
+
+// paused reports whether configMap, or the target configMap it writes to,
+// has been paused.
+func (wfh WebsiteFetchHandler) paused(configMap *api_v1.ConfigMap, t *target) bool {
+	if isPaused(configMap.Annotations) {
+		return true
+	}
+	if t == nil || t.Kind != "configmap" {
+		return false
+	}
+	written, err := fetchConfigMap(wfh.clientset, configMap.Namespace, t.Name)
+	return err == nil && isPaused(written.Annotations)
+}
+
+// settingsHash hashes the annotations configMap is set up with, so that we
+// can tell when they change.
+func settingsHash(configMap *api_v1.ConfigMap) string {
+	var settings []string
+	for _, annotation := range []string{CurlAnnotation, TargetAnnotation,
+		VersionsAnnotation, HistoryAnnotation, RollbackAnnotation,
+		RolloutAnnotation} {
+		settings = append(settings, configMap.Annotations[annotation])
+	}
+	return contentHash(strings.Join(settings, "\n"))
+}
+
+// keepingEdit reports whether configMap, or the target configMap it writes
+// to, holds an edit kept by the warn policy that should not be refetched
+// over yet. Changing the settings of configMap refetches straight away.
+func (wfh WebsiteFetchHandler) keepingEdit(configMap *api_v1.ConfigMap) bool {
+	written := configMap
+	t, err := parseTarget(configMap)
+	if err != nil {
+		return false
+	}
+	if t != nil {
+		if t.Kind != "configmap" {
+			return false
+		}
+		if written, err = fetchConfigMap(wfh.clientset, configMap.Namespace,
+			t.Name); err != nil {
+			return false
+		}
+	}
+	return written.Annotations[KeptEditAnnotation] == settingsHash(configMap)
+}
+
+// recordDrift adds record to the status in annotations, dropping the oldest
+// once there are more than maxDriftRecords.
+func recordDrift(annotations map[string]string, record DriftRecord) {
+	status := statusFromAnnotations(annotations)
+	status.Drift = append(status.Drift, record)
+	if len(status.Drift) > maxDriftRecords {
+		status.Drift = status.Drift[len(status.Drift)-maxDriftRecords:]
+	}
+	if encoded, err := encodeStatus(status); err == nil {
+		annotations[StatusAnnotation] = encoded
+	}
+}
+
+// targetOwner returns the configMap that configMap was written for as its
+// target, or nil when it isn't a target.
+func (wfh WebsiteFetchHandler) targetOwner(configMap *api_v1.ConfigMap) (*api_v1.ConfigMap, error) {
+	if len(configMap.Labels[TargetOwnerLabel]) == 0 {
+		return nil, nil
+	}
+	for _, owner := range configMap.OwnerReferences {
+		if owner.Kind != "ConfigMap" || owner.Controller == nil || !*owner.Controller {
+			continue
+		}
+		source, err := fetchConfigMap(wfh.clientset, configMap.Namespace, owner.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read the owner of target %s",
+				configMap.Name)
+		}
+		if ownedBy(configMap.ObjectMeta, source) {
+			return source, nil
+		}
+	}
+	return nil, nil
+}
+
+// handleDrift checks an updated configMap for hand edits to the keys we
+// manage and applies the DriftPolicyAnnotation of the configMap they were
+// fetched for. It returns the configMap to process, which is nil when
+// nothing should be refetched.
+func (wfh WebsiteFetchHandler) handleDrift(configMap *api_v1.ConfigMap) (*api_v1.ConfigMap, error) {
+	owner, err := wfh.targetOwner(configMap)
+	if err != nil {
+		return nil, err
+	}
+	isTarget := owner != nil
+	if !isTarget {
+		owner = configMap
+	}
+	if !configMapHasAnnotation(owner) || isPaused(configMap.Annotations) ||
+		isPaused(owner.Annotations) {
+		if isTarget {
+			return nil, nil
+		}
+		return configMap, nil
+	}
+
+	managed := readManagedKeys(configMap.Annotations)
+	keys := managed.drifted(configMap.Data)
+	if len(keys) == 0 {
+		if isTarget {
+			return nil, nil
+		}
+		return configMap, nil
+	}
+
+	original := configMap.DeepCopy()
+	policy, err := driftPolicy(owner)
+	if err != nil {
+		wfh.recorder.Warning(owner, "InvalidAnnotation", err.Error())
+	}
+	var action string
+	switch policy {
+	case DriftPause:
+		action = "keeping the edit and pausing until " + PausedAnnotation +
+			" is removed"
+		configMap.Annotations[PausedAnnotation] = "true"
+	case DriftWarn:
+		action = "keeping the edit until the next refresh"
+	default:
+		action = "reverting to the fetched value"
+	}
+	if policy != DriftRevert {
+		// The edit is kept, so it's what later edits are spotted against.
+		managed.hash(configMap.Data)
+		writeManagedKeys(configMap.Annotations, managed)
+	}
+	if policy == DriftWarn {
+		configMap.Annotations[KeptEditAnnotation] = settingsHash(owner)
+	} else {
+		delete(configMap.Annotations, KeptEditAnnotation)
+	}
+
+	wfh.recorder.Warning(owner, "Drifted", fmt.Sprintf(
+		"%s edited by hand in %s, %s", strings.Join(keys, ", "),
+		configMap.Name, action))
+	recordDrift(configMap.Annotations, DriftRecord{
+		Keys:       keys,
+		Action:     policy,
+		DetectedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+	updated, err := patchConfigMap(wfh.clientset, original, configMap)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to record drift in %s", configMap.Name)
+	}
+
+	if policy != DriftRevert {
+		return nil, nil
+	}
+	if isTarget {
+		return owner, nil
+	}
+	return updated, nil
+}
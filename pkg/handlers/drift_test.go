@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/JonPulfer/gofiggy/pkg/events"
+)
+
+func TestObjectUpdatedHandlesDrift(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "replicas: 3\n")
+		}))
+	defer server.Close()
+
+	kubeClient := newFakeClientset()
+	kubeClient.CoreV1().ConfigMaps("default").Create(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: "default",
+			Name:      "app",
+			UID:       "app-uid",
+			Annotations: map[string]string{
+				CurlAnnotation: "app.yaml=" + server.URL,
+			},
+		},
+		Data: map[string]string{},
+	})
+
+	wfh := newWebsiteFetchHandler(kubeClient, testConfig())
+	configMap, _ := fetchConfigMap(kubeClient, "default", "app")
+	if err := wfh.processConfigMap("default", configMap); err != nil {
+		t.Logf("error processConfigMap: %s", err.Error())
+		t.FailNow()
+	}
+
+	// edit changes app.yaml by hand with policy and sends the update event.
+	edit := func(name string, policy string) *api_v1.ConfigMap {
+		configMap, _ := fetchConfigMap(kubeClient, "default", name)
+		configMap.Data["app.yaml"] = "replicas: 10\n"
+		kubeClient.CoreV1().ConfigMaps("default").Update(configMap)
+		source, _ := fetchConfigMap(kubeClient, "default", "app")
+		source.Annotations[DriftPolicyAnnotation] = policy
+		kubeClient.CoreV1().ConfigMaps("default").Update(source)
+
+		wfh.ObjectUpdated(nil, events.Event{Kind: "configmap", Name: "default/" + name})
+		configMap, _ = fetchConfigMap(kubeClient, "default", name)
+		return configMap
+	}
+	expectDrift := func(configMap *api_v1.ConfigMap, records int, action string) {
+		drift := readStatus(configMap).Drift
+		if len(drift) != records || drift[records-1].Action != action ||
+			drift[records-1].Keys[0] != "app.yaml" {
+			t.Logf("expected %d drift records ending in %s: %+v", records, action, drift)
+			t.FailNow()
+		}
+	}
+
+	configMap = edit("app", DriftRevert)
+	if configMap.Data["app.yaml"] != "replicas: 3\n" {
+		t.Logf("expected the edit to be reverted: %v", configMap.Data)
+		t.FailNow()
+	}
+	expectDrift(configMap, 1, DriftRevert)
+
+	configMap = edit("app", DriftWarn)
+	if configMap.Data["app.yaml"] != "replicas: 10\n" {
+		t.Logf("expected the edit to be kept: %v", configMap.Data)
+		t.FailNow()
+	}
+	expectDrift(configMap, 2, DriftWarn)
+
+	// Another event without another edit isn't drift, and the edit is kept.
+	wfh.ObjectUpdated(nil, events.Event{Kind: "configmap", Name: "default/app"})
+	configMap, _ = fetchConfigMap(kubeClient, "default", "app")
+	if configMap.Data["app.yaml"] != "replicas: 10\n" {
+		t.Logf("expected the edit to still be kept: %v", configMap.Data)
+		t.FailNow()
+	}
+	expectDrift(configMap, 2, DriftWarn)
+
+	// A refresh queued by the controller fetches over it.
+	wfh.ObjectUpdated(nil, events.Event{Kind: "configmap", Name: "default/app",
+		Reason: events.Queued})
+	configMap, _ = fetchConfigMap(kubeClient, "default", "app")
+	if configMap.Data["app.yaml"] != "replicas: 3\n" ||
+		len(configMap.Annotations[KeptEditAnnotation]) > 0 {
+		t.Logf("expected the next refresh to fetch over the edit: %+v", configMap)
+		t.FailNow()
+	}
+	expectDrift(configMap, 2, DriftWarn)
+
+	configMap = edit("app", DriftPause)
+	if configMap.Data["app.yaml"] != "replicas: 10\n" || !isPaused(configMap.Annotations) {
+		t.Logf("expected the edit to be kept and paused: %+v", configMap)
+		t.FailNow()
+	}
+	expectDrift(configMap, 3, DriftPause)
+	wfh.processConfigMap("default", configMap)
+	configMap, _ = fetchConfigMap(kubeClient, "default", "app")
+	if configMap.Data["app.yaml"] != "replicas: 10\n" {
+		t.Logf("expected nothing to be fetched while paused: %v", configMap.Data)
+		t.FailNow()
+	}
+
+	// Removing the pause refetches.
+	delete(configMap.Annotations, PausedAnnotation)
+	kubeClient.CoreV1().ConfigMaps("default").Update(configMap)
+	wfh.ObjectUpdated(nil, events.Event{Kind: "configmap", Name: "default/app"})
+	configMap, _ = fetchConfigMap(kubeClient, "default", "app")
+	if configMap.Data["app.yaml"] != "replicas: 3\n" {
+		t.Logf("expected the fetched value once resumed: %v", configMap.Data)
+		t.FailNow()
+	}
+	expectDrift(configMap, 3, DriftPause)
+
+	// Edits to a target are reverted through the configMap that owns it.
+	configMap.Annotations[TargetAnnotation] = "app-config"
+	kubeClient.CoreV1().ConfigMaps("default").Update(configMap)
+	if err := wfh.processConfigMap("default", configMap); err != nil {
+		t.Logf("error processConfigMap into the target: %s", err.Error())
+		t.FailNow()
+	}
+	target := edit("app-config", DriftRevert)
+	if target.Data["app.yaml"] != "replicas: 3\n" {
+		t.Logf("expected the target edit to be reverted: %v", target.Data)
+		t.FailNow()
+	}
+	expectDrift(target, 1, DriftRevert)
+
+	// An edit kept in a target is kept through updates to its owner until
+	// the owner's settings change.
+	target = edit("app-config", DriftWarn)
+	expectDrift(target, 2, DriftWarn)
+	wfh.ObjectUpdated(nil, events.Event{Kind: "configmap", Name: "default/app"})
+	target, _ = fetchConfigMap(kubeClient, "default", "app-config")
+	if target.Data["app.yaml"] != "replicas: 10\n" {
+		t.Logf("expected the target edit to be kept: %v", target.Data)
+		t.FailNow()
+	}
+	configMap, _ = fetchConfigMap(kubeClient, "default", "app")
+	configMap.Annotations[CurlAnnotation] += " format=yaml"
+	kubeClient.CoreV1().ConfigMaps("default").Update(configMap)
+	wfh.ObjectUpdated(nil, events.Event{Kind: "configmap", Name: "default/app"})
+	target, _ = fetchConfigMap(kubeClient, "default", "app-config")
+	if target.Data["app.yaml"] != "replicas: 3\n" {
+		t.Logf("expected a change to the annotation to refetch: %v", target.Data)
+		t.FailNow()
+	}
+}
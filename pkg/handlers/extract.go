@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// Extraction selects a single field from a JSON response, or one in the format
+// given by the `input` option, and stores it under its own key in the
+// configMap. The Expression uses the same JSONPath syntax as
+// `kubectl -o jsonpath` with the surrounding braces being optional so both
+// `.release.tag` and `{.assets[0].href}` are accepted.
+type Extraction struct {
+	IntoKey    string
+	Expression string
+}
+
+// extractFields evaluates each of the Extract expressions in the FetchRequest
+// against the fetched content and places the results in the Data of the
+// FetchResponse. Every expression has to match, otherwise we return an error
+// naming each one that failed so that it can be reported in the status.
+func extractFields(fRequest *FetchRequest, fResp *FetchResponse) error {
+	if len(fRequest.Extract) == 0 {
+		return nil
+	}
+
+	input := fRequest.InputFormat
+	if len(input) == 0 {
+		input = FormatJSON
+	}
+	document, err := decodeFormat(fResp.Value, input, "")
+	if err != nil {
+		return errors.Wrap(err, "unable to extract fields")
+	}
+
+	extracted := make(map[string]string)
+	var failures []string
+	for _, ex := range fRequest.Extract {
+		value, err := evaluateExpression(document, ex.Expression)
+		if err != nil {
+			failures = append(failures,
+				fmt.Sprintf("%s=%s: %s", ex.IntoKey, ex.Expression, err.Error()))
+			continue
+		}
+		extracted[ex.IntoKey] = value
+	}
+
+	if len(failures) > 0 {
+		return errors.New(
+			fmt.Sprintf("extraction failed for %s",
+				strings.Join(failures, "; ")))
+	}
+
+	fResp.Data = extracted
+	return nil
+}
+
+// evaluateExpression runs a single JSONPath expression against document. A
+// single scalar result is returned as is, anything else is encoded as JSON.
+func evaluateExpression(document interface{}, expression string) (string, error) {
+	template := strings.TrimSpace(expression)
+	template = strings.TrimPrefix(template, "$")
+	if !strings.HasPrefix(template, "{") {
+		template = "{" + template + "}"
+	}
+
+	jp := jsonpath.New("extract").AllowMissingKeys(false)
+	if err := jp.Parse(template); err != nil {
+		return "", err
+	}
+
+	results, err := jp.FindResults(document)
+	if err != nil {
+		return "", err
+	}
+
+	var values []interface{}
+	for _, result := range results {
+		for _, value := range result {
+			values = append(values, indirect(value))
+		}
+	}
+
+	switch len(values) {
+	case 0:
+		return "", errors.New("no match")
+	case 1:
+		return formatExtracted(values[0])
+	}
+	return formatExtracted(values)
+}
+
+func indirect(value reflect.Value) interface{} {
+	for value.Kind() == reflect.Interface || value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	return value.Interface()
+}
+
+func formatExtracted(value interface{}) (string, error) {
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const releaseDocument = `{
+	"release": {"tag": "v1.2.3", "draft": false},
+	"assets": [{"href": "https://example.com/a.tgz"}, {"href": "https://example.com/b.tgz"}]
+}`
+
+func TestExtractFields(t *testing.T) {
+	fRequest, err := parseAnnotationData(
+		"release=example.com extract.version=.release.tag " +
+			"extract.url=.assets[0].href extract.draft=.release.draft " +
+			"extract.all=$.assets[*].href")
+	if err != nil {
+		t.Logf("failed to parse the annotation data: %s\n", err.Error())
+		t.FailNow()
+	}
+
+	fResp := &FetchResponse{Key: "release", Value: releaseDocument}
+	if err := extractFields(fRequest, fResp); err != nil {
+		t.Logf("failed to extract fields: %s\n", err.Error())
+		t.FailNow()
+	}
+
+	entries := fResp.Entries()
+	if entries["version"] != "v1.2.3" {
+		t.FailNow()
+	}
+	if entries["url"] != "https://example.com/a.tgz" {
+		t.FailNow()
+	}
+	if entries["draft"] != "false" {
+		t.FailNow()
+	}
+	if entries["all"] != `["https://example.com/a.tgz","https://example.com/b.tgz"]` {
+		t.Logf("all = %s", entries["all"])
+		t.FailNow()
+	}
+	if _, ok := entries["release"]; ok {
+		t.Log("whole response should not be stored when extracting")
+		t.FailNow()
+	}
+
+	missing, _ := parseAnnotationData(
+		"release=example.com extract.notes=.release.notes")
+	err = extractFields(missing, &FetchResponse{Key: "release", Value: releaseDocument})
+	if err == nil || !strings.Contains(err.Error(), "notes=.release.notes") {
+		t.Logf("expected the failing expression to be named, got %v", err)
+		t.FailNow()
+	}
+}
+
+func TestProcessConfigMapExtractFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, releaseDocument)
+		}))
+	defer server.Close()
+
+	configMapToCreate := &api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: "default",
+			Name:      "release-config",
+			Annotations: map[string]string{
+				CurlAnnotation: "release=" + server.URL +
+					" extract.version=.release.tag\n" +
+					"notes=" + server.URL + " extract.notes=.release.notes",
+			},
+		},
+		Data: map[string]string{},
+	}
+
+	kubeClient := newFakeClientset()
+	kubeClient.CoreV1().ConfigMaps("default").Create(configMapToCreate)
+
+	wfh := newWebsiteFetchHandler(kubeClient, testConfig())
+	if err := wfh.processConfigMap("default", configMapToCreate); err == nil {
+		t.Log("expected processConfigMap to report the failed entry")
+		t.FailNow()
+	}
+
+	configMap, err := fetchConfigMap(kubeClient, "default", "release-config")
+	if err != nil {
+		t.Logf("error getting configMap: %s", err.Error())
+		t.FailNow()
+	}
+
+	if configMap.Data["version"] != "v1.2.3" {
+		t.FailNow()
+	}
+
+	status := readStatus(configMap)
+	if status.Entries["release"].State != StateSynced {
+		t.FailNow()
+	}
+	if status.Entries["notes"].State != StateFailed {
+		t.FailNow()
+	}
+
+	eventList, _ := kubeClient.CoreV1().Events("default").List(v1.ListOptions{})
+	if len(eventList.Items) != 1 || eventList.Items[0].Reason != "FetchFailed" {
+		t.FailNow()
+	}
+}
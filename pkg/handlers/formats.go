@@ -0,0 +1,385 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+)
+
+// The formats we can convert fetched content between.
+const (
+	FormatJSON       = "json"
+	FormatYAML       = "yaml"
+	FormatTOML       = "toml"
+	FormatEnv        = "env"
+	FormatProperties = "properties"
+)
+
+// defaultSeparator joins the path to a leaf when a document is flattened.
+const defaultSeparator = "."
+
+var envNamePattern = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// validateFormat checks the name of a format given in an option.
+func validateFormat(format string) error {
+	switch format {
+	case FormatJSON, FormatYAML, FormatTOML, FormatEnv, FormatProperties:
+		return nil
+	}
+	return errors.New(fmt.Sprintf("unknown format %s", format))
+}
+
+// convertFormat changes the fetched content into the format requested by the
+// `format` option, or flattens it into one key per leaf when `flatten` is
+// set. The content is read as the `input` format, or detected from the
+// Content-Type when that is not given.
+func convertFormat(fRequest *FetchRequest, fResp *FetchResponse) error {
+	if len(fRequest.Format) == 0 && !fRequest.Flatten {
+		return nil
+	}
+	if fResp.Data != nil {
+		return errors.New(
+			"format and flatten cannot be combined with extract or archive")
+	}
+
+	document, err := decodeFormat(fResp.Value, fRequest.InputFormat,
+		fResp.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+
+	if fRequest.Flatten {
+		flattened := make(map[string]string)
+		flattenDocument(document, "", fRequest.keySeparator(), flattened)
+		for key := range flattened {
+			if err := validateKey(key); err != nil {
+				return errors.Wrap(err, "unable to flatten document")
+			}
+		}
+		fResp.Data = flattened
+		return nil
+	}
+
+	converted, err := encodeFormat(document, fRequest.Format,
+		fRequest.Separator)
+	if err != nil {
+		return err
+	}
+	fResp.Value = converted
+	return nil
+}
+
+// decodeFormat parses content in the given format. When no format is given
+// it is detected as in decodeDocument and has to turn out to be structured.
+func decodeFormat(content string, format string,
+	contentType string) (interface{}, error) {
+
+	switch format {
+	case FormatJSON:
+		document, err := decodeJSON(content)
+		return document, errors.Wrap(err, "unable to decode json")
+	case FormatYAML:
+		document, err := decodeYAML(content)
+		return document, errors.Wrap(err, "unable to decode yaml")
+	case FormatTOML:
+		document, err := decodeTOML(content)
+		return document, errors.Wrap(err, "unable to decode toml")
+	case FormatEnv:
+		return decodeKeyValues(content, FormatEnv)
+	case FormatProperties:
+		return decodeKeyValues(content, FormatProperties)
+	case "":
+		document := decodeDocument(content, contentType)
+		if _, plain := document.(string); plain {
+			return nil, errors.New(
+				"unable to detect the format of the content, set input")
+		}
+		return document, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown format %s", format))
+}
+
+// encodeFormat writes document out in format. The separator is used to join
+// nested keys for the flat formats.
+func encodeFormat(document interface{}, format string,
+	separator string) (string, error) {
+
+	switch format {
+	case FormatJSON:
+		encoded, err := json.MarshalIndent(document, "", "  ")
+		return string(encoded), err
+	case FormatYAML:
+		encoded, err := yaml.Marshal(document)
+		return string(encoded), err
+	}
+
+	table, ok := document.(map[string]interface{})
+	if !ok {
+		return "", errors.New(
+			fmt.Sprintf("only a document with keys can be written as %s",
+				format))
+	}
+
+	switch format {
+	case FormatTOML:
+		encoded, err := encodeTOML(table)
+		return encoded, errors.Wrap(err, "unable to encode toml")
+	case FormatEnv:
+		if len(separator) == 0 {
+			separator = "_"
+		}
+		return encodeEnv(table, separator), nil
+	case FormatProperties:
+		if len(separator) == 0 {
+			separator = defaultSeparator
+		}
+		return encodeProperties(table, separator), nil
+	}
+	return "", errors.New(fmt.Sprintf("unknown format %s", format))
+}
+
+// flattenDocument walks document recording each leaf in flattened under the
+// path that leads to it, joined with separator. Array elements use their
+// index in the path.
+func flattenDocument(document interface{}, prefix string, separator string,
+	flattened map[string]string) {
+
+	join := func(key string) string {
+		if len(prefix) == 0 {
+			return key
+		}
+		return prefix + separator + key
+	}
+
+	switch node := document.(type) {
+	case map[string]interface{}:
+		for key, value := range node {
+			flattenDocument(value, join(key), separator, flattened)
+		}
+	case []interface{}:
+		for i, value := range node {
+			flattenDocument(value, join(strconv.Itoa(i)), separator, flattened)
+		}
+	default:
+		flattened[prefix] = formatScalar(node)
+	}
+}
+
+// formatScalar renders a leaf value the way it would be written by hand,
+// whole numbers without a decimal point and null as an empty string.
+func formatScalar(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+			return strconv.FormatInt(int64(v), 10)
+		}
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	}
+	return fmt.Sprint(value)
+}
+
+func sortedKeys(table map[string]interface{}) []string {
+	keys := make([]string, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func encodeEnv(table map[string]interface{}, separator string) string {
+	flattened := make(map[string]string)
+	flattenDocument(table, "", separator, flattened)
+
+	names := make(map[string]string, len(flattened))
+	for key, value := range flattened {
+		name := envNamePattern.ReplaceAllString(strings.ToUpper(key), "_")
+		names[name] = value
+	}
+
+	var out strings.Builder
+	for _, name := range sortedStringKeys(names) {
+		value := names[name]
+		if strings.ContainsAny(value, " \t\n\"'#$\\") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&out, "%s=%s\n", name, value)
+	}
+	return out.String()
+}
+
+var propertiesEscaper = strings.NewReplacer(
+	`\`, `\\`, "\n", `\n`, "\t", `\t`, "\r", `\r`, "=", `\=`, ":", `\:`,
+	"#", `\#`, "!", `\!`)
+
+func encodeProperties(table map[string]interface{}, separator string) string {
+	flattened := make(map[string]string)
+	flattenDocument(table, "", separator, flattened)
+
+	var out strings.Builder
+	for _, key := range sortedStringKeys(flattened) {
+		value := propertiesEscaper.Replace(flattened[key])
+		if strings.HasPrefix(value, " ") {
+			value = `\` + value
+		}
+		fmt.Fprintf(&out, "%s=%s\n",
+			strings.Replace(propertiesEscaper.Replace(key), " ", `\ `, -1),
+			value)
+	}
+	return out.String()
+}
+
+func sortedStringKeys(table map[string]string) []string {
+	keys := make([]string, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// decodeKeyValues reads the line based dotenv and Java properties formats into
+// a flat document.
+func decodeKeyValues(content string, format string) (interface{}, error) {
+	document := make(map[string]interface{})
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), len(content)+1)
+
+	var pending string
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimLeft(scanner.Text(), " \t\f")
+
+		if format == FormatProperties {
+			line = pending + line
+			pending = ""
+			if continued(line) {
+				pending = line[:len(line)-1]
+				continue
+			}
+		}
+
+		if len(line) == 0 || line[0] == '#' ||
+			(format == FormatProperties && line[0] == '!') {
+			continue
+		}
+
+		var key, value string
+		var err error
+		if format == FormatEnv {
+			key, value, err = parseEnvLine(line)
+		} else {
+			key, value = parsePropertiesLine(line)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNumber)
+		}
+		document[key] = value
+	}
+
+	if len(pending) > 0 {
+		key, value := parsePropertiesLine(pending)
+		document[key] = value
+	}
+
+	return document, scanner.Err()
+}
+
+// continued reports whether a properties line ends with an unescaped
+// backslash and so carries on onto the next line.
+func continued(line string) bool {
+	slashes := 0
+	for i := len(line) - 1; i >= 0 && line[i] == '\\'; i-- {
+		slashes++
+	}
+	return slashes%2 == 1
+}
+
+func parseEnvLine(line string) (string, string, error) {
+	line = strings.TrimPrefix(line, "export ")
+	parts := strings.SplitN(line, "=", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New(fmt.Sprintf("expected KEY=value: %s", line))
+	}
+
+	key := strings.TrimSpace(parts[0])
+	value := strings.TrimSpace(parts[1])
+	switch {
+	case strings.HasPrefix(value, `"`):
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return "", "", errors.Wrapf(err, "value for %s", key)
+		}
+		value = unquoted
+	case strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") &&
+		len(value) > 1:
+		value = value[1 : len(value)-1]
+	default:
+		if comment := strings.Index(value, " #"); comment >= 0 {
+			value = strings.TrimSpace(value[:comment])
+		}
+	}
+	return key, value, nil
+}
+
+func parsePropertiesLine(line string) (string, string) {
+	var key strings.Builder
+	i := 0
+	for ; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) {
+			i++
+			key.WriteString(unescapeProperty(line[i]))
+			continue
+		}
+		if c == '=' || c == ':' || c == ' ' || c == '\t' {
+			break
+		}
+		key.WriteByte(c)
+	}
+
+	rest := strings.TrimLeft(line[i:], " \t")
+	if len(rest) > 0 && (rest[0] == '=' || rest[0] == ':') {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+
+	var value strings.Builder
+	for j := 0; j < len(rest); j++ {
+		if rest[j] == '\\' && j+1 < len(rest) {
+			j++
+			value.WriteString(unescapeProperty(rest[j]))
+			continue
+		}
+		value.WriteByte(rest[j])
+	}
+	return key.String(), value.String()
+}
+
+func unescapeProperty(c byte) string {
+	switch c {
+	case 'n':
+		return "\n"
+	case 't':
+		return "\t"
+	case 'r':
+		return "\r"
+	case 'f':
+		return "\f"
+	}
+	return string(c)
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const serviceTOML = `# service settings
+title = "gofiggy"
+ports = [ 8080, 8443 ]
+
+[database]
+host = "db.internal"
+port = 5432
+enabled = true
+options = { sslmode = "require" }
+
+[[users]]
+name = 'alice'
+
+[[users]]
+name = "bob\tsmith"
+`
+
+func TestDecodeTOML(t *testing.T) {
+	document, err := decodeTOML(serviceTOML)
+	if err != nil {
+		t.Logf("failed to decode toml: %s\n", err.Error())
+		t.FailNow()
+	}
+
+	flattened := make(map[string]string)
+	flattenDocument(document, "", ".", flattened)
+
+	expected := map[string]string{
+		"title":                    "gofiggy",
+		"ports.0":                  "8080",
+		"ports.1":                  "8443",
+		"database.host":            "db.internal",
+		"database.port":            "5432",
+		"database.enabled":         "true",
+		"database.options.sslmode": "require",
+		"users.0.name":             "alice",
+		"users.1.name":             "bob\tsmith",
+	}
+	for key, value := range expected {
+		if flattened[key] != value {
+			t.Logf("%s = %q, expected %q", key, flattened[key], value)
+			t.Fail()
+		}
+	}
+	if len(flattened) != len(expected) {
+		t.Logf("unexpected keys in %v", flattened)
+		t.Fail()
+	}
+}
+
+func TestConvertFormatRoundTrip(t *testing.T) {
+	for _, format := range []string{FormatJSON, FormatYAML, FormatTOML} {
+		fRequest, _ := parseAnnotationData(
+			"settings=example.com input=toml format=" + format)
+		fResp := &FetchResponse{Key: "settings", Value: serviceTOML}
+		if err := convertFormat(fRequest, fResp); err != nil {
+			t.Logf("failed to convert to %s: %s\n", format, err.Error())
+			t.FailNow()
+		}
+
+		document, err := decodeFormat(fResp.Value, format, "")
+		if err != nil {
+			t.Logf("failed to read back %s: %s\n%s", format, err.Error(),
+				fResp.Value)
+			t.FailNow()
+		}
+
+		flattened := make(map[string]string)
+		flattenDocument(document, "", ".", flattened)
+		if flattened["database.port"] != "5432" ||
+			flattened["users.1.name"] != "bob\tsmith" {
+			t.Logf("%s lost data: %v", format, flattened)
+			t.FailNow()
+		}
+	}
+}
+
+func TestConvertFormatFlat(t *testing.T) {
+	fResp := &FetchResponse{
+		Key:    "app.env",
+		Value:  `{"db": {"host": "db.internal", "password": "a b#c"}}`,
+		Header: http.Header{"Content-Type": []string{"application/json"}},
+	}
+	fRequest, _ := parseAnnotationData("app.env=example.com format=env")
+	if err := convertFormat(fRequest, fResp); err != nil {
+		t.Logf("failed to convert to env: %s\n", err.Error())
+		t.FailNow()
+	}
+	if fResp.Value != "DB_HOST=db.internal\nDB_PASSWORD=\"a b#c\"\n" {
+		t.Logf("env = %q", fResp.Value)
+		t.FailNow()
+	}
+
+	document, err := decodeFormat(fResp.Value, FormatEnv, "")
+	if err != nil || document.(map[string]interface{})["DB_PASSWORD"] != "a b#c" {
+		t.Logf("env did not read back: %v %v", document, err)
+		t.FailNow()
+	}
+
+	properties := "# comment\ndb.host = db.internal\ndb.url=jdbc\\:postgresql\\://db \\\n    /app\n"
+	document, err = decodeFormat(properties, FormatProperties, "")
+	if err != nil {
+		t.Logf("failed to decode properties: %s\n", err.Error())
+		t.FailNow()
+	}
+	table := document.(map[string]interface{})
+	if table["db.host"] != "db.internal" ||
+		table["db.url"] != "jdbc:postgresql://db /app" {
+		t.Logf("properties = %v", table)
+		t.FailNow()
+	}
+}
+
+func TestConvertFormatFlatten(t *testing.T) {
+	fRequest, _ := parseAnnotationData(
+		"settings=example.com flatten=true separator=_")
+	fResp := &FetchResponse{
+		Key:   "settings",
+		Value: "database:\n  host: db.internal\n  ports: [5432]\n",
+	}
+	if err := convertFormat(fRequest, fResp); err != nil {
+		t.Logf("failed to flatten: %s\n", err.Error())
+		t.FailNow()
+	}
+
+	entries := fResp.Entries()
+	if entries["database_host"] != "db.internal" ||
+		entries["database_ports_0"] != "5432" || len(entries) != 2 {
+		t.Logf("entries = %v", entries)
+		t.FailNow()
+	}
+
+	if _, err := parseAnnotationData(
+		"settings=example.com flatten=true separator=/"); err == nil ||
+		!strings.Contains(err.Error(), "separator") {
+		t.Log("expected an invalid separator to be rejected")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,374 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/JonPulfer/gofiggy/pkg/config"
+	"github.com/JonPulfer/gofiggy/pkg/egress"
+)
+
+// headRef is where the default branch of a repository is fetched to when the
+// entry does not name a ref.
+const headRef = "refs/gofiggy/HEAD"
+
+// gitSource reads files from a git repository. Entries name the repository,
+// the ref and the file, directory or glob to read like: -
+//
+//	app.yaml=git+https://github.com/example/config.git?ref=main&path=app/app.yaml
+//	nginx=git+ssh://git@github.com/example/config.git?ref=v1.2.0&path=nginx/*.conf
+//	local=git+file:///srv/config?path=app
+//
+// A single file is written to the entry key. A directory or glob is expanded
+// into a key per file like an archive, so the archive options apply to it.
+// The commit the content came from is recorded as the revision in the status.
+// Repositories are mirrored in the cache directory and fetched again each
+// time they are read.
+type gitSource struct {
+	policy    *egress.Policy
+	cacheDir  string
+	allowFile bool
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newGitSource(cfg config.GitConfig, policy *egress.Policy) *gitSource {
+	return &gitSource{
+		policy:    policy,
+		cacheDir:  cfg.GitCacheDir(),
+		allowFile: cfg.AllowFile,
+		locks:     make(map[string]*sync.Mutex),
+	}
+}
+
+// gitLocation is what a git source URL points to.
+type gitLocation struct {
+	remote string
+	ref    string
+	path   string
+}
+
+func parseGitLocation(u *url.URL) gitLocation {
+	remote := *u
+	remote.Scheme = strings.TrimPrefix(u.Scheme, "git+")
+	remote.RawQuery = ""
+
+	query := u.Query()
+	return gitLocation{
+		remote: remote.String(),
+		ref:    query.Get("ref"),
+		path:   strings.Trim(path.Clean("/"+query.Get("path")), "/"),
+	}
+}
+
+func (gs *gitSource) Fetch(namespace string, fRequest *FetchRequest) (*FetchResponse, error) {
+	location := parseGitLocation(fRequest.FromSite)
+
+	repo, unlock, err := gs.sync(namespace, fRequest, location)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	sha, err := repo.resolve(location.ref)
+	if err != nil {
+		return nil, err
+	}
+
+	fResp := &FetchResponse{
+		Key:      fRequest.IntoKey,
+		Header:   http.Header{},
+		Revision: sha,
+	}
+
+	dir, glob := location.path, ""
+	if strings.ContainsAny(dir, "*?[") {
+		dir, glob = globBase(dir), dir
+	}
+
+	objectType := "tree"
+	if len(dir) > 0 {
+		out, err := repo.run("cat-file", "-t", sha+":"+dir)
+		if err != nil {
+			return nil, errors.New(
+				fmt.Sprintf("path %s not found at %s", dir, shortSHA(sha)))
+		}
+		objectType = strings.TrimSpace(string(out))
+	}
+
+	if objectType == "blob" && len(glob) == 0 {
+		content, err := repo.run("cat-file", "blob", sha+":"+dir)
+		if err != nil {
+			return nil, err
+		}
+		if !isText(content) {
+			fResp.Data = map[string]string{}
+			fResp.BinaryData = map[string][]byte{fRequest.IntoKey: content}
+			return fResp, nil
+		}
+		fResp.Value = string(content)
+		return fResp, nil
+	}
+
+	// Directories and globs are handed over as a tar of the directory with
+	// the directory itself stripped from the keys.
+	args := []string{"archive", "--format=tar", sha}
+	if len(dir) > 0 {
+		args = append(args, "--", dir)
+	}
+	content, err := repo.run(args...)
+	if err != nil {
+		return nil, err
+	}
+	fResp.Value = string(content)
+
+	archive := &fRequest.Archive
+	archive.Format = ArchiveTar
+	if len(dir) > 0 {
+		archive.Strip += len(strings.Split(dir, "/"))
+	}
+	if len(glob) > 0 {
+		archive.Include = append(archive.Include, glob)
+	}
+	return fResp, nil
+}
+
+// Revision fetches the repository and returns the commit the ref points to.
+func (gs *gitSource) Revision(namespace string, fRequest *FetchRequest) (string, error) {
+	location := parseGitLocation(fRequest.FromSite)
+
+	repo, unlock, err := gs.sync(namespace, fRequest, location)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	return repo.resolve(location.ref)
+}
+
+// sync brings the mirror of the repository up to date and returns it locked,
+// the caller has to unlock it when done.
+func (gs *gitSource) sync(namespace string, fRequest *FetchRequest,
+	location gitLocation) (*gitRepository, func(), error) {
+
+	if err := gs.checkRemote(namespace, fRequest.FromSite); err != nil {
+		return nil, nil, err
+	}
+	if strings.HasPrefix(location.ref, "-") {
+		return nil, nil, errors.New(fmt.Sprintf("invalid ref %s", location.ref))
+	}
+
+	sum := sha256.Sum256([]byte(location.remote))
+	dir := filepath.Join(gs.cacheDir, hex.EncodeToString(sum[:8]))
+
+	gs.mu.Lock()
+	lock, ok := gs.locks[dir]
+	if !ok {
+		lock = &sync.Mutex{}
+		gs.locks[dir] = lock
+	}
+	gs.mu.Unlock()
+	lock.Lock()
+
+	// git is only allowed to use the protocol of the entry and cannot be
+	// redirected to another host the egress policy has not checked.
+	repo := &gitRepository{
+		dir: dir,
+		env: []string{
+			"GIT_TERMINAL_PROMPT=0",
+			"GIT_ALLOW_PROTOCOL=" + strings.TrimPrefix(fRequest.FromSite.Scheme, "git+"),
+		},
+		config: map[string]string{"http.followRedirects": "false"},
+	}
+	cleanup, err := repo.useCredentials(fRequest.credentials)
+	if err != nil {
+		lock.Unlock()
+		return nil, nil, err
+	}
+	unlock := func() {
+		cleanup()
+		lock.Unlock()
+	}
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			unlock()
+			return nil, nil, errors.Wrap(err, "unable to create git cache")
+		}
+		if _, err := repo.run("init", "--bare", "--quiet"); err != nil {
+			unlock()
+			return nil, nil, err
+		}
+	}
+
+	refspecs := []string{"+HEAD:" + headRef, "+refs/heads/*:refs/heads/*",
+		"+refs/tags/*:refs/tags/*"}
+	if _, err := repo.run(append([]string{"fetch", "--prune", "--quiet",
+		location.remote}, refspecs...)...); err != nil {
+		unlock()
+		return nil, nil, err
+	}
+
+	// A commit that no branch or tag points to has to be asked for by name.
+	if len(location.ref) > 0 {
+		if _, err := repo.resolve(location.ref); err != nil {
+			repo.run("fetch", "--quiet", location.remote, location.ref)
+		}
+	}
+
+	return repo, unlock, nil
+}
+
+// checkRemote applies the egress policy to the repository. git makes its own
+// connections so the host is resolved and checked before it is run.
+func (gs *gitSource) checkRemote(namespace string, u *url.URL) error {
+	switch u.Scheme {
+	case "git+file":
+		if !gs.allowFile {
+			return errors.New("git+file repositories are not allowed by the config")
+		}
+		return nil
+	case "git+https", "git+http", "git+ssh":
+		return gs.policy.CheckResolved(namespace, u.Hostname())
+	}
+	return errors.New(fmt.Sprintf("unsupported scheme %s", u.Scheme))
+}
+
+// gitRepository runs git commands against a bare mirror.
+type gitRepository struct {
+	dir    string
+	env    []string
+	config map[string]string
+}
+
+// run runs git with args in the repository, including what git wrote to
+// stderr in the error when it fails.
+func (repo *gitRepository) run(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = repo.dir
+	cmd.Env = append(os.Environ(), repo.env...)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(repo.config)))
+	i := 0
+	for key, value := range repo.config {
+		cmd.Env = append(cmd.Env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i, key),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, value))
+		i++
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if len(message) == 0 {
+			message = err.Error()
+		}
+		return nil, errors.New(fmt.Sprintf("git %s: %s", args[0], message))
+	}
+	return stdout.Bytes(), nil
+}
+
+// resolve returns the commit ref points to, the default branch when ref is
+// empty.
+func (repo *gitRepository) resolve(ref string) (string, error) {
+	if len(ref) == 0 {
+		ref = headRef
+	}
+	out, err := repo.run("rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("ref %s not found", ref))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// useCredentials passes the credentials to git in the environment, so they
+// never appear in the arguments or the mirror's config file. The returned func
+// removes anything written to disk for them.
+func (repo *gitRepository) useCredentials(creds *Credentials) (func(), error) {
+	nothing := func() {}
+	if creds == nil {
+		return nothing, nil
+	}
+
+	header := ""
+	switch creds.Scheme {
+	case AuthBasic:
+		header = "Authorization: Basic " + base64.StdEncoding.EncodeToString(
+			[]byte(creds.Username+":"+creds.Password))
+	case AuthBearer:
+		header = "Authorization: Bearer " + creds.Token
+	case AuthHeader:
+		header = creds.Header + ": " + creds.APIKey
+	case AuthSSH:
+		return repo.useSSHKey(creds)
+	}
+
+	repo.config["http.extraHeader"] = header
+	return nothing, nil
+}
+
+// useSSHKey writes the key, and known hosts if given, to a temporary
+// directory for ssh to read.
+func (repo *gitRepository) useSSHKey(creds *Credentials) (func(), error) {
+	dir, err := ioutil.TempDir("", "gofiggy-ssh")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	key := filepath.Join(dir, "id")
+	if err := ioutil.WriteFile(key, []byte(creds.SSHPrivateKey), 0600); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	hostKeys := "-o StrictHostKeyChecking=accept-new"
+	if len(creds.KnownHosts) > 0 {
+		knownHosts := filepath.Join(dir, "known_hosts")
+		if err := ioutil.WriteFile(knownHosts, []byte(creds.KnownHosts), 0600); err != nil {
+			cleanup()
+			return nil, err
+		}
+		hostKeys = "-o StrictHostKeyChecking=yes -o UserKnownHostsFile=" + knownHosts
+	}
+
+	repo.env = append(repo.env, fmt.Sprintf(
+		"GIT_SSH_COMMAND=ssh -i %s -o IdentitiesOnly=yes -o BatchMode=yes %s",
+		key, hostKeys))
+	return cleanup, nil
+}
+
+// globBase returns the directories of glob before the first one with a
+// wildcard in it.
+func globBase(glob string) string {
+	var base []string
+	for _, part := range strings.Split(glob, "/") {
+		if strings.ContainsAny(part, "*?[") {
+			break
+		}
+		base = append(base, part)
+	}
+	return strings.Join(base, "/")
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	return sha
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/JonPulfer/gofiggy/pkg/config"
+)
+
+// commitFiles writes files into the repository at dir and commits them,
+// returning the new commit.
+func commitFiles(t *testing.T, dir string, files map[string]string) string {
+	for name, content := range files {
+		target := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(target), 0755)
+		if err := ioutil.WriteFile(target, []byte(content), 0644); err != nil {
+			t.Logf("error writing %s: %s", name, err.Error())
+			t.FailNow()
+		}
+	}
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=gofiggy", "GIT_AUTHOR_EMAIL=gofiggy@example.com",
+			"GIT_COMMITTER_NAME=gofiggy", "GIT_COMMITTER_EMAIL=gofiggy@example.com")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Logf("error running git %v: %s", args, out)
+			t.FailNow()
+		}
+		return strings.TrimSpace(string(out))
+	}
+
+	git("add", ".")
+	git("commit", "--quiet", "-m", "update config")
+	return git("rev-parse", "HEAD")
+}
+
+func TestProcessConfigMapFromGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, _ := ioutil.TempDir("", "gofiggy-repo")
+	defer os.RemoveAll(dir)
+	cacheDir, _ := ioutil.TempDir("", "gofiggy-cache")
+	defer os.RemoveAll(cacheDir)
+
+	if out, err := exec.Command("git", "init", "--quiet", "-b", "main", dir).
+		CombinedOutput(); err != nil {
+		t.Logf("error creating repository: %s", out)
+		t.FailNow()
+	}
+	first := commitFiles(t, dir, map[string]string{
+		"app/app.yaml":           "replicas: 1\n",
+		"nginx/nginx.conf":       "worker_processes 1;\n",
+		"nginx/conf.d/site.conf": "server {}\n",
+		"nginx/README.md":        "# nginx\n",
+	})
+
+	kubeClient := newFakeClientset()
+	kubeClient.CoreV1().ConfigMaps("default").Create(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: "default",
+			Name:      "gitops",
+			Annotations: map[string]string{
+				CurlAnnotation: "app.yaml=git+file://" + dir + "?ref=main&path=app/app.yaml\n" +
+					"nginx=git+file://" + dir + "?path=nginx separator=_ exclude=*.md\n" +
+					"conf=git+file://" + dir + "?ref=" + first + "&path=nginx/conf.d/*.conf",
+			},
+		},
+		Data: map[string]string{},
+	})
+
+	cfg := testConfig()
+	cfg.Git = config.GitConfig{CacheDir: cacheDir}
+	wfh := newWebsiteFetchHandler(kubeClient, cfg)
+	configMap, _ := fetchConfigMap(kubeClient, "default", "gitops")
+	if err := wfh.processConfigMap("default", configMap); err == nil {
+		t.Log("expected git+file to be refused unless allowed")
+		t.FailNow()
+	}
+
+	cfg.Git.AllowFile = true
+	wfh = newWebsiteFetchHandler(kubeClient, cfg)
+	configMap, _ = fetchConfigMap(kubeClient, "default", "gitops")
+	if err := wfh.processConfigMap("default", configMap); err != nil {
+		t.Logf("error processConfigMap: %s", err.Error())
+		t.FailNow()
+	}
+
+	configMap, _ = fetchConfigMap(kubeClient, "default", "gitops")
+	expected := map[string]string{
+		"app.yaml":         "replicas: 1\n",
+		"nginx.conf":       "worker_processes 1;\n",
+		"conf.d_site.conf": "server {}\n",
+		"site.conf":        "server {}\n",
+	}
+	for key, value := range expected {
+		if configMap.Data[key] != value {
+			t.Logf("expected %s=%q but got %q", key, value, configMap.Data[key])
+			t.FailNow()
+		}
+	}
+	if _, ok := configMap.Data["README.md"]; ok {
+		t.FailNow()
+	}
+	if readStatus(configMap).Entries["app.yaml"].Revision != first {
+		t.Logf("expected revision %s in status %+v", first, readStatus(configMap))
+		t.FailNow()
+	}
+
+	// Nothing changes until there is a new commit, which is then picked up by
+	// polling. The entry pinned to the first commit stays where it is.
+	if wfh.revisionChanged(configMap) {
+		t.Log("expected no change before a new commit")
+		t.FailNow()
+	}
+	second := commitFiles(t, dir, map[string]string{
+		"app/app.yaml":     "replicas: 3\n",
+		"nginx/nginx.conf": "worker_processes 4;\n",
+	})
+	syncCaches(t, wfh, kubeClient)
+	var queued []string
+	wfh.caches.queue = queueFunc(func(key string) { queued = append(queued, key) })
+	wfh.pollConfigMaps()
+	configMap, _ = fetchConfigMap(kubeClient, "default", "gitops")
+	if len(queued) != 1 || queued[0] != "default/gitops" ||
+		configMap.Data["app.yaml"] != "replicas: 1\n" {
+		t.Logf("expected polling to only queue the configMap: %v %v", queued, configMap.Data)
+		t.FailNow()
+	}
+
+	handleQueued(wfh)
+	wfh.pollConfigMaps()
+
+	configMap, _ = fetchConfigMap(kubeClient, "default", "gitops")
+	status := readStatus(configMap)
+	if configMap.Data["app.yaml"] != "replicas: 3\n" ||
+		status.Entries["app.yaml"].Revision != second ||
+		status.Entries["conf"].Revision != first {
+		t.Logf("unexpected result after polling: %v %+v", configMap.Data, status)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,404 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	api_v1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// HistoryAnnotation is how many revisions of what we wrote for a configMap
+// are kept, 10 unless given, like: -
+//
+//	x-k8s.io/curl-me-that-history: "20"
+//
+// "0" keeps none. A revision is recorded each time the keys we manage change,
+// with when it was written, the sites it was fetched from and a hash of it,
+// in a configMap named after the annotated one with a -history suffix. It is
+// owned by the annotated configMap so it goes when that is deleted. Sensitive
+// keys are never recorded, nor are targets that are Secrets or versions,
+// which keep their own history.
+const HistoryAnnotation = "x-k8s.io/curl-me-that-history"
+
+// RollbackAnnotation restores a revision from the history, like: -
+//
+//	x-k8s.io/curl-me-that-rollback: "3"
+//
+// The keys we manage are put back as they were in that revision, and
+// refreshing is paused until the PausedAnnotation is removed so that the next
+// fetch doesn't undo it. The annotation is removed once it has been handled.
+const RollbackAnnotation = "x-k8s.io/curl-me-that-rollback"
+
+// HistoryOfLabel holds the UID of the configMap a history is kept for.
+const HistoryOfLabel = "x-k8s.io/curl-me-that-history-of"
+
+// defaultHistory is how many revisions are kept without a HistoryAnnotation.
+const defaultHistory = 10
+
+// maxHistorySize keeps the history comfortably under the 1MiB limit on a
+// configMap, the oldest revisions are dropped to stay within it.
+const maxHistorySize = 768 * 1024
+
+// Revision is what we wrote for a configMap at some point.
+type Revision struct {
+	Revision  int    `json:"revision"`
+	WrittenAt string `json:"writtenAt"`
+	Hash      string `json:"hash"`
+	// Sources are the sites each entry was fetched from.
+	Sources map[string]string `json:"sources,omitempty"`
+	// RollbackOf is the revision that was restored to write this one.
+	RollbackOf int `json:"rollbackOf,omitempty"`
+	// Keys are the keys of Data each entry wrote.
+	Keys map[string][]string `json:"keys,omitempty"`
+	Data map[string]string   `json:"data"`
+}
+
+// parseHistory returns the revisions to keep for configMap.
+func parseHistory(configMap *api_v1.ConfigMap) (int, error) {
+	raw := strings.TrimSpace(configMap.Annotations[HistoryAnnotation])
+	if len(raw) == 0 {
+		return defaultHistory, nil
+	}
+	keep, err := strconv.Atoi(raw)
+	if err != nil || keep < 0 {
+		return defaultHistory, errors.New(fmt.Sprintf(
+			"history must be the number of revisions to keep but got %s", raw))
+	}
+	return keep, nil
+}
+
+// historyName is the name of the configMap holding the history of source.
+func historyName(source string) string {
+	return suffixedName(source, "-history")
+}
+
+// suffixedName adds suffix to name, shortening name to keep it a valid one.
+func suffixedName(name string, suffix string) string {
+	if len(name) > 253-len(suffix) {
+		name = name[:253-len(suffix)]
+	}
+	return name + suffix
+}
+
+// revisionKey is the key a revision is held under in the history.
+func revisionKey(revision int) string {
+	return strconv.Itoa(revision) + ".json"
+}
+
+// entrySources returns the site each entry that wrote data was fetched from,
+// without any credentials in it.
+func (fr fetchResults) entrySources() map[string]string {
+	sources := make(map[string]string)
+	for _, fReq := range fr.requests {
+		site := *fReq.FromSite
+		site.User = nil
+		sources[fReq.IntoKey] = site.String()
+	}
+	return sources
+}
+
+// readHistory returns the history kept for the configMap source in
+// namespace, oldest first, along with the configMap holding it, which is nil
+// when there is no history yet.
+func readHistory(kubeClient kubernetes.Interface, namespace string,
+	source string) ([]Revision, *api_v1.ConfigMap, error) {
+
+	name := historyName(source)
+	history, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(name, v1.GetOptions{})
+	if k8s_errors.IsNotFound(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "unable to read history %s", name)
+	}
+	if _, ok := history.Labels[HistoryOfLabel]; !ok {
+		return nil, nil, errors.New(fmt.Sprintf("%s is not a history", name))
+	}
+
+	var revisions []Revision
+	for _, raw := range history.Data {
+		var revision Revision
+		if err := json.Unmarshal([]byte(raw), &revision); err == nil {
+			revisions = append(revisions, revision)
+		}
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Revision < revisions[j].Revision
+	})
+	return revisions, history, nil
+}
+
+// ReadHistory returns the revisions kept for the configMap name in
+// namespace, oldest first.
+func ReadHistory(kubeClient kubernetes.Interface, namespace string,
+	name string) ([]Revision, error) {
+
+	revisions, _, err := readHistory(kubeClient, namespace, name)
+	return revisions, err
+}
+
+// RequestRollback sets the RollbackAnnotation on the configMap name in
+// namespace so that the controller restores revision.
+func RequestRollback(kubeClient kubernetes.Interface, namespace string,
+	name string, revision int) error {
+
+	configMap, err := fetchConfigMap(kubeClient, namespace, name)
+	if err != nil {
+		return err
+	}
+	if !configMapHasAnnotation(configMap) {
+		return errors.New(fmt.Sprintf("%s is not managed by gofiggy", name))
+	}
+	original := configMap.DeepCopy()
+	configMap.Annotations[RollbackAnnotation] = strconv.Itoa(revision)
+	_, err = patchConfigMap(kubeClient, original, configMap)
+	return err
+}
+
+// managedData returns the values of the keys we manage in configMap, leaving
+// out any sensitive ones.
+func managedData(configMap *api_v1.ConfigMap) map[string]string {
+	keys, _ := readManagedKeys(configMap.Annotations).keys()
+	data := make(map[string]string)
+	for key := range keys {
+		if value, ok := configMap.Data[key]; ok {
+			data[key] = value
+		}
+	}
+	return data
+}
+
+// recordHistory adds what we manage in written, the configMap we wrote for
+// source, to the history of source when it has changed since the last
+// revision. Sources for entries that didn't write anything this time are
+// carried over from the last revision.
+func (wfh WebsiteFetchHandler) recordHistory(source *api_v1.ConfigMap,
+	written *api_v1.ConfigMap, sources map[string]string, rollbackOf int) error {
+
+	keep, _ := parseHistory(source)
+	if keep == 0 {
+		return nil
+	}
+	revisions, history, err := readHistory(wfh.clientset, source.Namespace, source.Name)
+	if err != nil {
+		return err
+	}
+	if history != nil && !ownedBy(history.ObjectMeta, source) {
+		return errors.New(fmt.Sprintf("history %s is not owned by %s",
+			history.Name, source.Name))
+	}
+
+	managed := readManagedKeys(written.Annotations)
+	data := managedData(written)
+	revision := Revision{
+		Revision:   1,
+		WrittenAt:  time.Now().UTC().Format(time.RFC3339),
+		Hash:       contentChecksum(data),
+		Sources:    make(map[string]string),
+		RollbackOf: rollbackOf,
+		Keys:       make(map[string][]string),
+		Data:       data,
+	}
+	for entry, written := range managed {
+		if len(written.Keys) > 0 {
+			revision.Keys[entry] = written.Keys
+		}
+	}
+	if len(revisions) > 0 {
+		last := revisions[len(revisions)-1]
+		if last.Hash == revision.Hash {
+			return nil
+		}
+		revision.Revision = last.Revision + 1
+		for entry, site := range last.Sources {
+			revision.Sources[entry] = site
+		}
+	} else if len(data) == 0 {
+		return nil
+	}
+	for entry := range revision.Sources {
+		if _, ok := managed[entry]; !ok {
+			delete(revision.Sources, entry)
+		}
+	}
+	for entry := range managed {
+		if site, ok := sources[entry]; ok {
+			revision.Sources[entry] = site
+		}
+	}
+	revisions = append(revisions, revision)
+
+	var original *api_v1.ConfigMap
+	if history == nil {
+		history = &api_v1.ConfigMap{ObjectMeta: v1.ObjectMeta{
+			Namespace:       source.Namespace,
+			Name:            historyName(source.Name),
+			Labels:          map[string]string{HistoryOfLabel: string(source.UID)},
+			OwnerReferences: []v1.OwnerReference{ownerReference(source)},
+		}}
+	} else {
+		original = history.DeepCopy()
+	}
+	history.Data = make(map[string]string)
+	size := 0
+	for i := len(revisions) - 1; i >= 0 && len(history.Data) < keep; i-- {
+		encoded, err := json.Marshal(revisions[i])
+		if err != nil {
+			return errors.Wrap(err, "unable to encode revision")
+		}
+		if size += len(encoded); size > maxHistorySize && len(history.Data) > 0 {
+			break
+		}
+		history.Data[revisionKey(revisions[i].Revision)] = string(encoded)
+	}
+
+	if original == nil {
+		_, err = wfh.clientset.CoreV1().ConfigMaps(source.Namespace).Create(history)
+	} else {
+		_, err = patchConfigMap(wfh.clientset, original, history)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to write history %s", history.Name)
+	}
+	return nil
+}
+
+// rollback restores the revision named by the RollbackAnnotation of
+// configMap into the configMap we write for it, and pauses refreshing.
+func (wfh WebsiteFetchHandler) rollback(configMap *api_v1.ConfigMap,
+	t *target, versions int) error {
+
+	raw := strings.TrimSpace(configMap.Annotations[RollbackAnnotation])
+	var revision *Revision
+	number, err := strconv.Atoi(raw)
+	switch {
+	case err != nil:
+		err = errors.New(fmt.Sprintf(
+			"rollback must be a revision number but got %s", raw))
+	case versions > 0:
+		err = errors.New("versions are rolled back by using an older version")
+	case t != nil && t.Kind == "secret":
+		err = errors.New("no history is kept for a secret target")
+	default:
+		revision, err = wfh.findRevision(configMap, number)
+	}
+	written := configMap
+	if err == nil && t != nil {
+		written, err = fetchConfigMap(wfh.clientset, configMap.Namespace, t.Name)
+	}
+	if err != nil {
+		wfh.recorder.Warning(configMap, "RollbackFailed", err.Error())
+		// The request is dropped so that it isn't retried on every update.
+		original := configMap.DeepCopy()
+		delete(configMap.Annotations, RollbackAnnotation)
+		if _, patchErr := patchConfigMap(wfh.clientset, original, configMap); patchErr != nil {
+			return patchErr
+		}
+		return err
+	}
+
+	original := written.DeepCopy()
+	if written.Data == nil {
+		written.Data = make(map[string]string)
+	}
+	managed := readManagedKeys(written.Annotations)
+	keys, _ := managed.keys()
+	for key := range keys {
+		if _, ok := revision.Data[key]; !ok {
+			delete(written.Data, key)
+		}
+	}
+	for key, value := range revision.Data {
+		written.Data[key] = value
+	}
+	managed = revision.managedKeys(managed)
+	managed.hash(written.Data)
+	writeManagedKeys(written.Annotations, managed)
+	written.Annotations[PausedAnnotation] = "true"
+	delete(written.Annotations, RollbackAnnotation)
+	if _, err := patchConfigMap(wfh.clientset, original, written); err != nil {
+		return err
+	}
+	wfh.configMapWritten(original, written)
+
+	if written != configMap {
+		original := configMap.DeepCopy()
+		delete(configMap.Annotations, RollbackAnnotation)
+		if _, err := patchConfigMap(wfh.clientset, original, configMap); err != nil {
+			return err
+		}
+	}
+
+	wfh.recorder.Normal(configMap, "RolledBack", fmt.Sprintf(
+		"restored revision %d written %s, refreshing is paused until %s is removed",
+		revision.Revision, revision.WrittenAt, PausedAnnotation))
+	return wfh.recordHistory(configMap, written, revision.Sources, revision.Revision)
+}
+
+// managedKeys returns current, the keys we manage now, changed to list the
+// keys each entry wrote in the revision. Revisions recorded without Keys
+// give keys no entry manages now to the entry of the same name.
+func (r Revision) managedKeys(current managedKeys) managedKeys {
+	entryKeys := r.Keys
+	if len(entryKeys) == 0 {
+		entryKeys = make(map[string][]string)
+		owned := make(map[string]bool)
+		for entry, managed := range current {
+			for _, key := range managed.Keys {
+				if _, ok := r.Data[key]; ok {
+					entryKeys[entry] = append(entryKeys[entry], key)
+					owned[key] = true
+				}
+			}
+		}
+		for key := range r.Data {
+			if !owned[key] {
+				entryKeys[key] = append(entryKeys[key], key)
+			}
+		}
+	}
+
+	managed := make(managedKeys)
+	for entry, written := range current {
+		written.Keys = nil
+		managed[entry] = written
+	}
+	for entry, keys := range entryKeys {
+		written := managed[entry]
+		written.Keys = append([]string(nil), keys...)
+		sort.Strings(written.Keys)
+		managed[entry] = written
+	}
+	for entry, written := range managed {
+		if len(written.Keys) == 0 && len(written.Sensitive) == 0 {
+			delete(managed, entry)
+		}
+	}
+	return managed
+}
+
+// findRevision returns the revision numbered number in the history of
+// configMap.
+func (wfh WebsiteFetchHandler) findRevision(configMap *api_v1.ConfigMap,
+	number int) (*Revision, error) {
+
+	revisions, _, err := readHistory(wfh.clientset, configMap.Namespace, configMap.Name)
+	if err != nil {
+		return nil, err
+	}
+	for i := range revisions {
+		if revisions[i].Revision == number {
+			return &revisions[i], nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf(
+		"revision %d is not in the history of %s", number, configMap.Name))
+}
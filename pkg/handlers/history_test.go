@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProcessConfigMapKeepsHistory(t *testing.T) {
+	replicas := 1
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "replicas: %d\n", replicas)
+		}))
+	defer server.Close()
+
+	kubeClient := newFakeClientset(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: "default",
+			Name:      "app",
+			Annotations: map[string]string{
+				CurlAnnotation:    "app.yaml=" + server.URL,
+				HistoryAnnotation: "2",
+			},
+		},
+		Data: map[string]string{"by-hand": "keep me"},
+	})
+
+	wfh := newWebsiteFetchHandler(kubeClient, testConfig())
+	process := func() *api_v1.ConfigMap {
+		configMap, _ := fetchConfigMap(kubeClient, "default", "app")
+		if err := wfh.processConfigMap("default", configMap); err != nil {
+			t.Logf("error processConfigMap: %s", err.Error())
+			t.FailNow()
+		}
+		configMap, _ = fetchConfigMap(kubeClient, "default", "app")
+		return configMap
+	}
+
+	process()
+	process()
+	replicas = 2
+	process()
+	replicas = 3
+	process()
+
+	revisions, err := ReadHistory(kubeClient, "default", "app")
+	if err != nil {
+		t.Logf("error ReadHistory: %s", err.Error())
+		t.FailNow()
+	}
+	if len(revisions) != 2 || revisions[0].Revision != 2 || revisions[1].Revision != 3 {
+		t.Logf("expected the two newest revisions to be kept: %+v", revisions)
+		t.FailNow()
+	}
+	if revisions[0].Data["app.yaml"] != "replicas: 2\n" || len(revisions[0].Data) != 1 ||
+		revisions[0].Sources["app.yaml"] != server.URL ||
+		revisions[0].Hash != contentChecksum(revisions[0].Data) {
+		t.Logf("unexpected revision %+v", revisions[0])
+		t.FailNow()
+	}
+
+	// Rolling back restores the revision and pauses refreshing.
+	if err := RequestRollback(kubeClient, "default", "app", 2); err != nil {
+		t.Logf("error RequestRollback: %s", err.Error())
+		t.FailNow()
+	}
+	replicas = 4
+	configMap := process()
+	if configMap.Data["app.yaml"] != "replicas: 2\n" || configMap.Data["by-hand"] != "keep me" ||
+		!isPaused(configMap.Annotations) ||
+		len(configMap.Annotations[RollbackAnnotation]) > 0 {
+		t.Logf("expected revision 2 to be restored and paused: %v %v",
+			configMap.Data, configMap.Annotations)
+		t.FailNow()
+	}
+	if drifted := readManagedKeys(configMap.Annotations).drifted(configMap.Data); len(drifted) > 0 {
+		t.Logf("expected the rollback not to be seen as drift: %v", drifted)
+		t.FailNow()
+	}
+	if configMap = process(); configMap.Data["app.yaml"] != "replicas: 2\n" {
+		t.Logf("expected the rollback to stick: %v", configMap.Data)
+		t.FailNow()
+	}
+
+	revisions, _ = ReadHistory(kubeClient, "default", "app")
+	if last := revisions[len(revisions)-1]; last.Revision != 4 || last.RollbackOf != 2 {
+		t.Logf("expected the rollback to be recorded: %+v", last)
+		t.FailNow()
+	}
+
+	// A revision that isn't kept is refused.
+	RequestRollback(kubeClient, "default", "app", 1)
+	configMap, _ = fetchConfigMap(kubeClient, "default", "app")
+	if err := wfh.processConfigMap("default", configMap); err == nil {
+		t.Log("expected rolling back to a revision that isn't kept to fail")
+		t.FailNow()
+	}
+	configMap, _ = fetchConfigMap(kubeClient, "default", "app")
+	if _, ok := configMap.Annotations[RollbackAnnotation]; ok {
+		t.Log("expected the failed rollback to be dropped")
+		t.FailNow()
+	}
+}
+
+func TestRollbackRestoresManagedKeys(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "replicas: 1\n")
+		}))
+	defer server.Close()
+
+	kubeClient := newFakeClientset(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "app",
+			Annotations: map[string]string{CurlAnnotation: "app.yaml=" + server.URL},
+		},
+	})
+
+	wfh := newWebsiteFetchHandler(kubeClient, testConfig())
+	process := func() *api_v1.ConfigMap {
+		configMap, _ := fetchConfigMap(kubeClient, "default", "app")
+		if err := wfh.processConfigMap("default", configMap); err != nil {
+			t.Logf("error processConfigMap: %s", err.Error())
+			t.FailNow()
+		}
+		configMap, _ = fetchConfigMap(kubeClient, "default", "app")
+		return configMap
+	}
+
+	configMap := process()
+	configMap.Annotations[CurlAnnotation] = "settings.yaml=" + server.URL
+	kubeClient.CoreV1().ConfigMaps("default").Update(configMap)
+	if configMap = process(); len(configMap.Data["app.yaml"]) > 0 {
+		t.Logf("expected the renamed entry to remove its old key: %v", configMap.Data)
+		t.FailNow()
+	}
+
+	RequestRollback(kubeClient, "default", "app", 1)
+	configMap = process()
+	managed := readManagedKeys(configMap.Annotations)
+	if configMap.Data["app.yaml"] != "replicas: 1\n" || len(configMap.Data["settings.yaml"]) > 0 ||
+		len(managed) != 1 || len(managed["app.yaml"].Keys) != 1 ||
+		len(managed["app.yaml"].Hashes["app.yaml"]) == 0 {
+		t.Logf("expected the keys of revision 1 to be managed again: %v %+v",
+			configMap.Data, managed)
+		t.FailNow()
+	}
+
+	// Once refreshing resumes the restored key is an orphan of the renamed
+	// entry and is removed.
+	delete(configMap.Annotations, PausedAnnotation)
+	kubeClient.CoreV1().ConfigMaps("default").Update(configMap)
+	if configMap = process(); len(configMap.Data["app.yaml"]) > 0 ||
+		configMap.Data["settings.yaml"] != "replicas: 1\n" {
+		t.Logf("expected the restored key to be removed on refresh: %v", configMap.Data)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	api_v1 "k8s.io/api/core/v1"
+)
+
+// ManagedKeysAnnotation records the keys each entry wrote, as JSON keyed by
+// the entry, like: -
+//
+//	{"joke":{"keys":["joke"],"hashes":{"joke":"sha256:5e884898da280471"}}}
+//
+// Keys that are no longer written by any entry, because it was removed or
+// renamed or now writes other keys, are deleted. Keys that were never
+// written by us, such as those added by hand, are left alone.
+const ManagedKeysAnnotation = "x-k8s.io/curl-me-that-managed-keys"
+
+// managedEntry lists the keys written by an entry, with Sensitive ones in
+// the Secret alongside the configMap. Hashes are of the values last written
+// into a configMap, to spot them being edited by hand. Bases are the values
+// keys had before the entry was layered over them, see WriteMerge.
+type managedEntry struct {
+	Keys      []string          `json:"keys,omitempty"`
+	Sensitive []string          `json:"sensitive,omitempty"`
+	Hashes    map[string]string `json:"hashes,omitempty"`
+	Bases     map[string]string `json:"bases,omitempty"`
+}
+
+// managedKeys are the managedEntry of each entry.
+type managedKeys map[string]managedEntry
+
+// readManagedKeys returns the keys recorded in annotations.
+func readManagedKeys(annotations map[string]string) managedKeys {
+	managed := make(managedKeys)
+	if raw := annotations[ManagedKeysAnnotation]; len(raw) > 0 {
+		json.Unmarshal([]byte(raw), &managed)
+	}
+	return managed
+}
+
+// writeManagedKeys records managed in annotations, removing the annotation
+// when there are none.
+func writeManagedKeys(annotations map[string]string, managed managedKeys) {
+	if len(managed) == 0 {
+		delete(annotations, ManagedKeysAnnotation)
+		return
+	}
+	encoded, _ := json.Marshal(managed)
+	annotations[ManagedKeysAnnotation] = string(encoded)
+}
+
+// managedEntryFor lists the keys fResp writes.
+func managedEntryFor(fResp *FetchResponse) managedEntry {
+	var entry managedEntry
+	for key := range fResp.Entries() {
+		entry.Keys = append(entry.Keys, key)
+	}
+	for key := range fResp.BinaryData {
+		entry.Keys = append(entry.Keys, key)
+	}
+	for key := range fResp.Sensitive {
+		entry.Sensitive = append(entry.Sensitive, key)
+	}
+	sort.Strings(entry.Keys)
+	sort.Strings(entry.Sensitive)
+	return entry
+}
+
+// keys returns every key in the configMap and the sensitive keys managed.
+func (mk managedKeys) keys() (map[string]bool, map[string]bool) {
+	keys, sensitive := make(map[string]bool), make(map[string]bool)
+	for _, entry := range mk {
+		for _, key := range entry.Keys {
+			keys[key] = true
+		}
+		for _, key := range entry.Sensitive {
+			sensitive[key] = true
+		}
+	}
+	return keys, sensitive
+}
+
+// base returns the value key had before an entry was layered over it.
+func (mk managedKeys) base(key string) (string, bool) {
+	for _, entry := range mk {
+		if base, ok := entry.Bases[key]; ok {
+			return base, true
+		}
+	}
+	return "", false
+}
+
+// setBase records the value key had before entry was layered over it.
+func (mk managedKeys) setBase(entry string, key string, base string) {
+	managed := mk[entry]
+	bases := make(map[string]string)
+	for k, v := range managed.Bases {
+		bases[k] = v
+	}
+	bases[key] = base
+	managed.Bases = bases
+	mk[entry] = managed
+}
+
+// forget stops key being managed by entry.
+func (mk managedKeys) forget(entry string, key string) {
+	managed := mk[entry]
+	var keys []string
+	for _, k := range managed.Keys {
+		if k != key {
+			keys = append(keys, k)
+		}
+	}
+	managed.Keys = keys
+	mk[entry] = managed
+}
+
+// release removes keys from data, putting back the values they had before
+// they were layered over.
+func (mk managedKeys) release(data map[string]string, keys []string) {
+	for _, key := range keys {
+		if base, ok := mk.base(key); ok {
+			data[key] = base
+			continue
+		}
+		delete(data, key)
+	}
+}
+
+// managedChange is what a run does to the keys we manage.
+type managedChange struct {
+	managed managedKeys
+	// orphans are the keys and sensitive keys no longer written.
+	orphans          []string
+	sensitiveOrphans []string
+	// kept are the keys of entries that failed, which keep their values.
+	kept map[string]bool
+}
+
+// reconcileManaged works out the keys managed once results are written over
+// what previous recorded. Entries that failed this time keep the keys they
+// had so that their last values aren't lost.
+func (fr fetchResults) reconcileManaged(previous managedKeys) managedChange {
+	change := managedChange{managed: make(managedKeys), kept: make(map[string]bool)}
+	for entry, keys := range fr.managed {
+		change.managed[entry] = keys
+	}
+	for _, entry := range fr.failed {
+		if keys, ok := previous[entry]; ok {
+			change.managed[entry] = keys
+			for _, key := range keys.Keys {
+				change.kept[key] = true
+			}
+		}
+	}
+
+	before, sensitiveBefore := previous.keys()
+	after, sensitiveAfter := change.managed.keys()
+	change.orphans = missingKeys(before, after)
+	change.sensitiveOrphans = missingKeys(sensitiveBefore, sensitiveAfter)
+	return change
+}
+
+// missingKeys returns the sorted keys in before but not in after.
+func missingKeys(before map[string]bool, after map[string]bool) []string {
+	var missing []string
+	for key := range before {
+		if !after[key] {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// keptBinaryKeys returns the keys previously recorded as binary that have
+// been kept.
+func keptBinaryKeys(annotations map[string]string, kept map[string]bool) []string {
+	var binaryKeys []string
+	for _, key := range strings.Split(annotations[BinaryKeysAnnotation], ",") {
+		if kept[key] {
+			binaryKeys = append(binaryKeys, key)
+		}
+	}
+	return binaryKeys
+}
+
+// releaseConfigMap removes everything we wrote into a configMap once its
+// CurlAnnotation has gone, reporting whether there was anything to remove.
+// Targets never have the CurlAnnotation, and are left to their owner.
+func (wfh WebsiteFetchHandler) releaseConfigMap(configMap *api_v1.ConfigMap) (bool, error) {
+	if (len(configMap.Annotations[ManagedKeysAnnotation]) == 0 &&
+		len(configMap.Annotations[CurrentVersionAnnotation]) == 0) ||
+		len(configMap.Labels[TargetOwnerLabel]) > 0 {
+		return false, nil
+	}
+
+	original := configMap.DeepCopy()
+	managed := readManagedKeys(configMap.Annotations)
+	keys, _ := managed.keys()
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	managed.release(configMap.Data, missingKeys(keys, nil))
+	for _, annotation := range []string{ManagedKeysAnnotation, StatusAnnotation,
+		BinaryKeysAnnotation, SensitiveSecretAnnotation, CurrentVersionAnnotation,
+		KeptEditAnnotation} {
+		delete(configMap.Annotations, annotation)
+	}
+
+	if err := wfh.removeSensitive(configMap); err != nil {
+		return true, err
+	}
+	if _, err := patchConfigMap(wfh.clientset, original, configMap); err != nil {
+		return true, err
+	}
+	wfh.configMapWritten(original, configMap)
+	return true, nil
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProcessConfigMapRemovesOrphanedKeys(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/broken" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprint(w, r.URL.Path)
+		}))
+	defer server.Close()
+
+	kubeClient := newFakeClientset()
+	kubeClient.CoreV1().ConfigMaps("default").Create(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "app",
+			Annotations: map[string]string{},
+		},
+		Data: map[string]string{"by-hand": "keep me"},
+	})
+
+	wfh := newWebsiteFetchHandler(kubeClient, testConfig())
+	process := func(annotation string) *api_v1.ConfigMap {
+		configMap, _ := fetchConfigMap(kubeClient, "default", "app")
+		configMap.Annotations[CurlAnnotation] = annotation
+		if len(annotation) == 0 {
+			delete(configMap.Annotations, CurlAnnotation)
+		}
+		wfh.processConfigMap("default", configMap)
+		configMap, _ = fetchConfigMap(kubeClient, "default", "app")
+		return configMap
+	}
+	expectKeys := func(configMap *api_v1.ConfigMap, expected map[string]string) {
+		if len(configMap.Data) != len(expected) {
+			t.Logf("expected %v but got %v", expected, configMap.Data)
+			t.FailNow()
+		}
+		for key, value := range expected {
+			if configMap.Data[key] != value {
+				t.Logf("expected %s=%q but got %v", key, value, configMap.Data)
+				t.FailNow()
+			}
+		}
+	}
+
+	configMap := process("joke=" + server.URL + "/joke\n" +
+		"quote=" + server.URL + "/quote")
+	expectKeys(configMap, map[string]string{
+		"by-hand": "keep me", "joke": "/joke", "quote": "/quote",
+	})
+
+	// Renaming an entry removes the key it used to write.
+	configMap = process("pun=" + server.URL + "/joke\n" +
+		"quote=" + server.URL + "/quote")
+	expectKeys(configMap, map[string]string{
+		"by-hand": "keep me", "pun": "/joke", "quote": "/quote",
+	})
+
+	// A failed entry keeps its last value.
+	configMap = process("pun=" + server.URL + "/joke\n" +
+		"quote=" + server.URL + "/broken")
+	expectKeys(configMap, map[string]string{
+		"by-hand": "keep me", "pun": "/joke", "quote": "/quote",
+	})
+	if readManagedKeys(configMap.Annotations)["quote"].Keys[0] != "quote" {
+		t.Logf("expected the failed entry to keep its keys: %s",
+			configMap.Annotations[ManagedKeysAnnotation])
+		t.FailNow()
+	}
+
+	// Removing the annotation removes everything we wrote.
+	configMap = process("")
+	expectKeys(configMap, map[string]string{"by-hand": "keep me"})
+	if len(configMap.Annotations) != 0 {
+		t.Logf("expected our annotations to be removed: %v", configMap.Annotations)
+		t.FailNow()
+	}
+}
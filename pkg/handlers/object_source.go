@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/JonPulfer/gofiggy/pkg/config"
+)
+
+// objectSource copies a key out of another ConfigMap or Secret. The entry
+// names the object and key like: -
+//
+//	database=configmap://shared-settings/database.yaml
+//	ca=secret://internal-ca/ca.crt?namespace=platform
+//
+// The namespace defaults to that of the configMap being processed. Whether
+// the object can be read at all is up to the references policy. Objects in
+// other namespaces are refused unless every namespace is watched, as changes
+// to them would never be seen to update the copy.
+type objectSource struct {
+	kubeClient kubernetes.Interface
+	policy     config.ReferencePolicy
+	// watching is the namespace the controller watches, empty for all.
+	watching string
+}
+
+func (src objectSource) Fetch(namespace string, fRequest *FetchRequest) (*FetchResponse, error) {
+	ref, key, err := objectSourceReference(fRequest.FromSite, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := src.policy.Allows(ref.Kind, namespace, ref.Namespace); err != nil {
+		return nil, err
+	}
+	if len(src.watching) > 0 && ref.Namespace != src.watching {
+		return nil, errors.New(fmt.Sprintf(
+			"namespace %s is not watched so the copy would not be kept up to "+
+				"date, watch every namespace to read from it", ref.Namespace))
+	}
+
+	var value []byte
+	var found bool
+	switch ref.Kind {
+	case "configmap":
+		configMap, err := src.kubeClient.CoreV1().ConfigMaps(ref.Namespace).
+			Get(ref.Name, v1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read configMap %s/%s",
+				ref.Namespace, ref.Name)
+		}
+		var text string
+		text, found = configMap.Data[key]
+		value = []byte(text)
+	case "secret":
+		secret, err := src.kubeClient.CoreV1().Secrets(ref.Namespace).
+			Get(ref.Name, v1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read secret %s/%s",
+				ref.Namespace, ref.Name)
+		}
+		value, found = secret.Data[key]
+	}
+	if !found {
+		return nil, errors.New(
+			fmt.Sprintf("key %s not found in %s %s/%s",
+				key, ref.Kind, ref.Namespace, ref.Name))
+	}
+
+	fResp := &FetchResponse{
+		Key:    fRequest.IntoKey,
+		Value:  string(value),
+		Header: http.Header{},
+	}
+	if !isText(value) {
+		fResp.Value = ""
+		fResp.Data = map[string]string{}
+		fResp.BinaryData = map[string][]byte{fRequest.IntoKey: value}
+	}
+	return fResp, nil
+}
+
+// objectSourceReference reads the object and key named by a `configmap://`
+// or `secret://` URL.
+func objectSourceReference(u *url.URL, namespace string) (objectReference, string, error) {
+	ref := objectReference{
+		Kind:      u.Scheme,
+		Namespace: namespace,
+		Name:      u.Host,
+	}
+	if target := u.Query().Get("namespace"); len(target) > 0 {
+		ref.Namespace = target
+	}
+
+	key := strings.TrimPrefix(u.Path, "/")
+	if len(ref.Name) == 0 || len(key) == 0 {
+		return ref, "", errors.New(
+			fmt.Sprintf("expected %s://<name>/<key> but got %s",
+				u.Scheme, u.String()))
+	}
+	return ref, key, nil
+}
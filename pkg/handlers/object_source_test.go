@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/JonPulfer/gofiggy/pkg/config"
+	"github.com/JonPulfer/gofiggy/pkg/events"
+)
+
+func TestProcessConfigMapFromObjects(t *testing.T) {
+	kubeClient := newFakeClientset()
+	kubeClient.CoreV1().ConfigMaps("default").Create(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "shared"},
+		Data:       map[string]string{"database.yaml": "host: db-1\n"},
+	})
+	kubeClient.CoreV1().ConfigMaps("platform").Create(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Namespace: "platform", Name: "endpoints"},
+		Data:       map[string]string{"api": "https://api.internal"},
+	})
+	kubeClient.CoreV1().Secrets("default").Create(&api_v1.Secret{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "internal-ca"},
+		Data:       map[string][]byte{"ca.crt": []byte("-----BEGIN CERTIFICATE-----")},
+	})
+	kubeClient.CoreV1().ConfigMaps("default").Create(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: "default",
+			Name:      "app",
+			Annotations: map[string]string{
+				CurlAnnotation: "database=configmap://shared/database.yaml\n" +
+					"api=configmap://endpoints/api?namespace=platform\n" +
+					"ca=secret://internal-ca/ca.crt",
+			},
+		},
+		Data: map[string]string{},
+	})
+
+	// Without a policy only configMaps in the same namespace can be read.
+	wfh := newWebsiteFetchHandler(kubeClient, config.Config{})
+	configMap, _ := fetchConfigMap(kubeClient, "default", "app")
+	if err := wfh.processConfigMap("default", configMap); err == nil {
+		t.Log("expected the secret and other namespace to be refused")
+		t.FailNow()
+	}
+	configMap, _ = fetchConfigMap(kubeClient, "default", "app")
+	status := readStatus(configMap)
+	if configMap.Data["database"] != "host: db-1\n" ||
+		status.Entries["api"].State != StateFailed ||
+		!strings.Contains(status.Entries["ca"].Message, "not allowed") {
+		t.Logf("unexpected result: %v %+v", configMap.Data, status)
+		t.FailNow()
+	}
+
+	// Other namespaces also have to be watched for the copy to be updated.
+	cfg := config.Config{
+		References: config.ReferencePolicy{
+			Secrets:    true,
+			Namespaces: map[string][]string{"default": {"platform"}},
+		},
+	}
+	wfh = newWebsiteFetchHandler(kubeClient, cfg)
+	wfh.processConfigMap("default", configMap)
+	configMap, _ = fetchConfigMap(kubeClient, "default", "app")
+	if message := readStatus(configMap).Entries["api"].Message; !strings.Contains(message, "not watched") {
+		t.Logf("expected the unwatched namespace to be refused: %s", message)
+		t.FailNow()
+	}
+
+	allNamespaces := ""
+	cfg.Namespace = &allNamespaces
+	wfh = newWebsiteFetchHandler(kubeClient, cfg)
+	if err := wfh.processConfigMap("default", configMap); err != nil {
+		t.Logf("error processConfigMap: %s", err.Error())
+		t.FailNow()
+	}
+
+	// Changing the shared configMap updates the copy.
+	kubeClient.CoreV1().ConfigMaps("default").Update(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "shared"},
+		Data:       map[string]string{"database.yaml": "host: db-2\n"},
+	})
+	syncCaches(t, wfh, kubeClient)
+	handleQueued(wfh)
+	wfh.ObjectUpdated(nil, events.Event{Kind: "configmap", Name: "default/shared"})
+
+	configMap, _ = fetchConfigMap(kubeClient, "default", "app")
+	expected := map[string]string{
+		"database": "host: db-2\n",
+		"api":      "https://api.internal",
+		"ca":       "-----BEGIN CERTIFICATE-----",
+	}
+	for key, value := range expected {
+		if configMap.Data[key] != value {
+			t.Logf("expected %s=%s but got %s", key, value, configMap.Data[key])
+			t.FailNow()
+		}
+	}
+}
+
+func TestObjectSourceReference(t *testing.T) {
+	fRequest, err := parseAnnotationData("api=configmap://endpoints/api?namespace=platform")
+	if err != nil {
+		t.FailNow()
+	}
+	refs := fRequest.references("default")
+	if len(refs) != 1 || refs[0] != (objectReference{
+		Kind: "configmap", Namespace: "platform", Name: "endpoints"}) {
+		t.Logf("unexpected references %v", refs)
+		t.FailNow()
+	}
+
+	fRequest, _ = parseAnnotationData("api=configmap://endpoints")
+	if _, _, err := objectSourceReference(fRequest.FromSite, "default"); err == nil {
+		t.Log("expected a missing key to be refused")
+		t.FailNow()
+	}
+}
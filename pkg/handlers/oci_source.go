@@ -0,0 +1,493 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/JonPulfer/gofiggy/pkg/config"
+)
+
+// The manifest media types we can read, and the index types we explain we
+// can't.
+const (
+	ociManifestType    = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestType = "application/vnd.docker.distribution.manifest.v2+json"
+	ociIndexType       = "application/vnd.oci.image.index.v1+json"
+	dockerListType     = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// ociTitleAnnotation names the file a layer holds, as set by tools like oras.
+const ociTitleAnnotation = "org.opencontainers.image.title"
+
+// ociSource pulls config distributed as OCI artifacts from a container
+// registry. Entries name the repository and a tag or digest, and optionally
+// the media type of the layers to pull, like: -
+//
+//	app.yaml=oci://localhost:5000/gofiggy/config:v1?mediaType=application/vnd.gofiggy.config.v1+yaml
+//	nginx=oci://registry.example.com/config/nginx@sha256:9f86d0... auth-secret=registry
+//
+// A single matching layer is written to the entry key, so the archive options
+// can expand a tar layer. Several are written to a key each, named by their
+// org.opencontainers.image.title annotation. The tag is resolved to the
+// digest of its manifest, which is the revision, and layers are only pulled
+// again once the tag moves to a new digest.
+type ociSource struct {
+	transports *transportCache
+	plainHTTP  map[string]bool
+
+	mu    *sync.Mutex
+	pulls map[string]ociPull
+}
+
+// ociPull is what was last pulled for an entry.
+type ociPull struct {
+	digest string
+	files  []archiveFile
+}
+
+func newOCISource(cfg config.OCIConfig, transports *transportCache) ociSource {
+	plainHTTP := map[string]bool{}
+	for _, registry := range cfg.PlainHTTP {
+		plainHTTP[registry] = true
+	}
+	return ociSource{
+		transports: transports,
+		plainHTTP:  plainHTTP,
+		mu:         &sync.Mutex{},
+		pulls:      map[string]ociPull{},
+	}
+}
+
+// ociLocation is what an oci URL points to.
+type ociLocation struct {
+	registry   *url.URL
+	repository string
+	reference  string
+	mediaType  string
+}
+
+// ociReferencePattern matches the tags and digests a manifest can be fetched
+// by.
+var ociReferencePattern = regexp.MustCompile(
+	`^([A-Za-z0-9_][A-Za-z0-9_.-]{0,127}|[a-z0-9]+:[a-f0-9]{32,})$`)
+
+func (oci ociSource) location(u *url.URL) (ociLocation, error) {
+	location := ociLocation{mediaType: rawQueryValue(u, "mediaType")}
+
+	repository := strings.TrimPrefix(u.Path, "/")
+	if i := strings.LastIndex(repository, "@"); i >= 0 {
+		repository, location.reference = repository[:i], repository[i+1:]
+	} else if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository, location.reference = repository[:i], repository[i+1:]
+	} else {
+		location.reference = "latest"
+	}
+	location.repository = repository
+
+	if len(u.Host) == 0 || len(repository) == 0 ||
+		!ociReferencePattern.MatchString(location.reference) {
+		return location, errors.New(fmt.Sprintf(
+			"expected oci://<registry>/<repository>:<tag> but got %s", u.String()))
+	}
+
+	scheme := "https"
+	if oci.plainHTTP[u.Host] || isLoopback(u.Hostname()) {
+		scheme = "http"
+	}
+	location.registry = &url.URL{Scheme: scheme, Host: u.Host}
+	return location, nil
+}
+
+// rawQueryValue returns the query parameter name without turning a + into a
+// space, as media types like application/vnd.oci.image.layer.v1.tar+gzip are
+// written with one.
+func rawQueryValue(u *url.URL, name string) string {
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		if strings.HasPrefix(pair, name+"=") {
+			value, err := url.PathUnescape(strings.TrimPrefix(pair, name+"="))
+			if err == nil {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// isLoopback reports whether host is this machine, where registries are
+// reached over plain http the same as docker does.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// endpoint returns the registry API URL for kind, either manifests or blobs.
+func (loc ociLocation) endpoint(kind string, reference string) string {
+	u := *loc.registry
+	u.Path = fmt.Sprintf("/v2/%s/%s/%s", loc.repository, kind, reference)
+	return u.String()
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+func (oci ociSource) Fetch(namespace string, fRequest *FetchRequest) (*FetchResponse, error) {
+	location, err := oci.location(fRequest.FromSite)
+	if err != nil {
+		return nil, err
+	}
+	session, err := oci.session(namespace, fRequest, location)
+	if err != nil {
+		return nil, err
+	}
+
+	content, header, err := session.do(http.MethodGet,
+		location.endpoint("manifests", location.reference), manifestAccept())
+	if err != nil {
+		return nil, err
+	}
+	digest, err := manifestDigest(location, content, header)
+	if err != nil {
+		return nil, err
+	}
+
+	pullKey := namespace + " " + fRequest.FromSite.String()
+	oci.mu.Lock()
+	pull, ok := oci.pulls[pullKey]
+	oci.mu.Unlock()
+
+	if !ok || pull.digest != digest {
+		files, err := oci.pullLayers(session, location, content)
+		if err != nil {
+			return nil, err
+		}
+		pull = ociPull{digest: digest, files: files}
+		oci.mu.Lock()
+		oci.pulls[pullKey] = pull
+		oci.mu.Unlock()
+	}
+
+	fResp := &FetchResponse{Key: fRequest.IntoKey, Header: header, Revision: digest}
+	if len(pull.files) > 1 {
+		if err := writeFiles(fRequest, fResp, pull.files, "layer"); err != nil {
+			return nil, err
+		}
+		return fResp, nil
+	}
+
+	layer := pull.files[0].content
+	fResp.Value = string(layer)
+	if !isText(layer) && len(fRequest.Archive.Format) == 0 {
+		fResp.Value = ""
+		fResp.Data = map[string]string{}
+		fResp.BinaryData = map[string][]byte{fRequest.IntoKey: layer}
+	}
+	return fResp, nil
+}
+
+// Revision resolves the tag to the digest of the manifest it points to.
+func (oci ociSource) Revision(namespace string, fRequest *FetchRequest) (string, error) {
+	location, err := oci.location(fRequest.FromSite)
+	if err != nil {
+		return "", err
+	}
+	session, err := oci.session(namespace, fRequest, location)
+	if err != nil {
+		return "", err
+	}
+
+	content, header, err := session.do(http.MethodHead,
+		location.endpoint("manifests", location.reference), manifestAccept())
+	if err != nil {
+		return "", err
+	}
+	if len(header.Get("Docker-Content-Digest")) == 0 {
+		// Not every registry gives the digest on a HEAD, so fall back to
+		// hashing the manifest ourselves.
+		content, header, err = session.do(http.MethodGet,
+			location.endpoint("manifests", location.reference), manifestAccept())
+		if err != nil {
+			return "", err
+		}
+	}
+	return manifestDigest(location, content, header)
+}
+
+// pullLayers pulls the layers of the manifest with the wanted media type,
+// naming each by its title annotation.
+func (oci ociSource) pullLayers(session *ociSession, location ociLocation,
+	content []byte) ([]archiveFile, error) {
+
+	var manifest ociManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, errors.Wrap(err, "unable to read the manifest")
+	}
+	if manifest.MediaType == ociIndexType || manifest.MediaType == dockerListType ||
+		len(manifest.Manifests) > 0 {
+		return nil, errors.New(fmt.Sprintf(
+			"%s:%s is an index of manifests, give the digest of one of them",
+			location.repository, location.reference))
+	}
+
+	var layers []ociDescriptor
+	var mediaTypes []string
+	for _, layer := range manifest.Layers {
+		mediaTypes = append(mediaTypes, layer.MediaType)
+		if len(location.mediaType) == 0 || layer.MediaType == location.mediaType {
+			layers = append(layers, layer)
+		}
+	}
+	if len(layers) == 0 {
+		return nil, errors.New(fmt.Sprintf(
+			"no layers with media type %s in %s:%s, found %s", location.mediaType,
+			location.repository, location.reference, strings.Join(mediaTypes, ", ")))
+	}
+
+	var files []archiveFile
+	for _, layer := range layers {
+		if layer.Size > maxConfigMapSize {
+			return nil, errors.New(fmt.Sprintf(
+				"layer %s is %d bytes, over the configMap limit of %d",
+				layer.Digest, layer.Size, maxConfigMapSize))
+		}
+		name := layer.Annotations[ociTitleAnnotation]
+		if len(layers) > 1 && len(name) == 0 {
+			return nil, errors.New(fmt.Sprintf(
+				"layer %s has no %s annotation to name its key, select a "+
+					"single layer with mediaType", layer.Digest, ociTitleAnnotation))
+		}
+
+		blob, _, err := session.do(http.MethodGet,
+			location.endpoint("blobs", layer.Digest), "")
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyDigest(layer.Digest, blob); err != nil {
+			return nil, err
+		}
+		files = append(files, archiveFile{name: name, content: blob})
+	}
+	return files, nil
+}
+
+func manifestAccept() string {
+	return strings.Join([]string{ociManifestType, dockerManifestType,
+		ociIndexType, dockerListType}, ", ")
+}
+
+// manifestDigest returns the digest the registry gave for the manifest, or
+// the one we work out from its content. Manifests asked for by digest must
+// match it.
+func manifestDigest(location ociLocation, content []byte,
+	header http.Header) (string, error) {
+
+	digest := header.Get("Docker-Content-Digest")
+	if len(digest) == 0 {
+		if content == nil {
+			return "", errors.New("the registry did not give the manifest digest")
+		}
+		sum := sha256.Sum256(content)
+		digest = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	if strings.Contains(location.reference, ":") {
+		if digest != location.reference {
+			return "", errors.New(fmt.Sprintf(
+				"asked for manifest %s but got %s", location.reference, digest))
+		}
+	}
+	if len(content) > 0 {
+		if err := verifyDigest(digest, content); err != nil {
+			return "", err
+		}
+	}
+	return digest, nil
+}
+
+// verifyDigest checks content hashes to the sha256 digest it was fetched by.
+func verifyDigest(digest string, content []byte) error {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return errors.New(fmt.Sprintf("unsupported digest %s", digest))
+	}
+	sum := sha256.Sum256(content)
+	if "sha256:"+hex.EncodeToString(sum[:]) != digest {
+		return errors.New(fmt.Sprintf("content does not match digest %s", digest))
+	}
+	return nil
+}
+
+// ociSession sends the requests for one entry, holding on to any token the
+// registry handed out.
+type ociSession struct {
+	cl       *http.Client
+	creds    *Credentials
+	location ociLocation
+	token    string
+}
+
+func (oci ociSource) session(namespace string, fRequest *FetchRequest,
+	location ociLocation) (*ociSession, error) {
+
+	cl, err := oci.transports.client(namespace, fRequest.TLSProfile)
+	if err != nil {
+		return nil, err
+	}
+	if fRequest.credentials != nil && fRequest.credentials.Scheme != AuthBasic &&
+		fRequest.credentials.Scheme != AuthBearer {
+		return nil, errors.New(
+			"oci needs a username and password or a token in the auth secret")
+	}
+	return &ociSession{cl: cl, creds: fRequest.credentials, location: location}, nil
+}
+
+// do sends a request, answering the registry's challenge for a token when it
+// asks for one and then sending the request again.
+func (s *ociSession) do(method string, target string,
+	accept string) ([]byte, http.Header, error) {
+
+	resp, err := s.send(method, target, accept)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && len(s.token) == 0 {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := s.authenticate(challenge); err != nil {
+			return nil, nil, err
+		}
+		if resp, err = s.send(method, target, accept); err != nil {
+			return nil, nil, err
+		}
+	}
+	defer resp.Body.Close()
+
+	content, err := readLimited(target, resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		message := fmt.Sprintf("registry %s %s: %d %s", method, target,
+			resp.StatusCode, http.StatusText(resp.StatusCode))
+		var registryErr struct {
+			Errors []struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"errors"`
+		}
+		if json.Unmarshal(content, &registryErr) == nil && len(registryErr.Errors) > 0 {
+			message += ": " + registryErr.Errors[0].Code + " " +
+				registryErr.Errors[0].Message
+		}
+		return nil, nil, errors.New(message)
+	}
+	if method == http.MethodHead {
+		content = nil
+	}
+	return content, resp.Header, nil
+}
+
+func (s *ociSession) send(method string, target string,
+	accept string) (*http.Response, error) {
+
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(accept) > 0 {
+		req.Header.Set("Accept", accept)
+	}
+	switch {
+	case len(s.token) > 0:
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	case s.creds != nil:
+		s.creds.apply(req)
+	}
+	return s.cl.Do(req)
+}
+
+// challengeParams matches the parameters of a WWW-Authenticate challenge.
+var challengeParams = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authenticate gets a pull token from the realm the registry challenged us
+// with, using the credentials from the auth-secret if there are any. See
+// https://docs.docker.com/registry/spec/auth/token/
+func (s *ociSession) authenticate(challenge string) error {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return errors.New(fmt.Sprintf(
+			"registry %s refused the credentials", s.location.registry.Host))
+	}
+
+	params := map[string]string{}
+	for _, match := range challengeParams.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || len(realm.Host) == 0 {
+		return errors.New(fmt.Sprintf("invalid token realm %q", params["realm"]))
+	}
+
+	query := realm.Query()
+	if service := params["service"]; len(service) > 0 {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if len(scope) == 0 {
+		scope = "repository:" + s.location.repository + ":pull"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if s.creds != nil && s.creds.Scheme == AuthBasic {
+		req.SetBasicAuth(s.creds.Username, s.creds.Password)
+	}
+	resp, err := s.cl.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "unable to get a registry token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("unable to get a registry token: %d %s",
+			resp.StatusCode, http.StatusText(resp.StatusCode)))
+	}
+
+	var tokens struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return errors.Wrap(err, "unable to read the registry token")
+	}
+	s.token = tokens.Token
+	if len(s.token) == 0 {
+		s.token = tokens.AccessToken
+	}
+	if len(s.token) == 0 {
+		return errors.New("the registry token response had no token")
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeRegistry serves manifests and blobs for any repository, handing out a
+// token to clients that log in with the expected password.
+type fakeRegistry struct {
+	password  string
+	tags      map[string]string
+	content   map[string][]byte
+	blobPulls int
+}
+
+func (fr *fakeRegistry) push(tag string, layers map[string]string) string {
+	manifest := ociManifest{MediaType: ociManifestType}
+	for title, content := range layers {
+		mediaType := "application/vnd.gofiggy.config.v1+yaml"
+		if strings.HasSuffix(title, ".conf") {
+			mediaType = "application/vnd.gofiggy.nginx.v1"
+		}
+		manifest.Layers = append(manifest.Layers, ociDescriptor{
+			MediaType:   mediaType,
+			Digest:      fr.store([]byte(content)),
+			Size:        int64(len(content)),
+			Annotations: map[string]string{ociTitleAnnotation: title},
+		})
+	}
+	encoded, _ := json.Marshal(manifest)
+	digest := fr.store(encoded)
+	fr.tags[tag] = digest
+	return digest
+}
+
+func (fr *fakeRegistry) store(content []byte) string {
+	sum := sha256.Sum256(content)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	fr.content[digest] = content
+	return digest
+}
+
+func (fr *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		if _, password, _ := r.BasicAuth(); password != fr.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"token": "pull-token"}`)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer pull-token" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+			`Bearer realm="http://%s/token",service="registry"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(r.URL.Path, "/")
+	reference := parts[len(parts)-1]
+	if digest, ok := fr.tags[reference]; ok {
+		reference = digest
+	}
+	content, ok := fr.content[reference]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors": [{"code": "MANIFEST_UNKNOWN", "message": "unknown"}]}`)
+		return
+	}
+	if parts[len(parts)-2] == "blobs" {
+		fr.blobPulls++
+	}
+	w.Header().Set("Docker-Content-Digest", reference)
+	if r.Method == http.MethodGet {
+		w.Write(content)
+	}
+}
+
+func TestProcessConfigMapFromOCI(t *testing.T) {
+	registry := &fakeRegistry{
+		password: "hunter2",
+		tags:     map[string]string{},
+		content:  map[string][]byte{},
+	}
+	first := registry.push("v1", map[string]string{
+		"app.yaml":   "replicas: 1\n",
+		"nginx.conf": "worker_processes 1;\n",
+		"site.conf":  "server {}\n",
+	})
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	kubeClient := newFakeClientset()
+	kubeClient.CoreV1().Secrets("default").Create(&api_v1.Secret{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "registry"},
+		Data: map[string][]byte{
+			"username": []byte("gofiggy"),
+			"password": []byte("hunter2"),
+		},
+	})
+	kubeClient.CoreV1().ConfigMaps("default").Create(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: "default",
+			Name:      "from-oci",
+			Annotations: map[string]string{
+				CurlAnnotation: "settings=oci://" + host + "/gofiggy/config:v1" +
+					"?mediaType=application/vnd.gofiggy.config.v1+yaml auth-secret=registry\n" +
+					"nginx=oci://" + host + "/gofiggy/config:v1" +
+					"?mediaType=application/vnd.gofiggy.nginx.v1 auth-secret=registry",
+			},
+		},
+		Data: map[string]string{},
+	})
+
+	wfh := newWebsiteFetchHandler(kubeClient, testConfig())
+	configMap, _ := fetchConfigMap(kubeClient, "default", "from-oci")
+	if err := wfh.processConfigMap("default", configMap); err != nil {
+		t.Logf("error processConfigMap: %s", err.Error())
+		t.FailNow()
+	}
+
+	configMap, _ = fetchConfigMap(kubeClient, "default", "from-oci")
+	expected := map[string]string{
+		"settings":   "replicas: 1\n",
+		"nginx.conf": "worker_processes 1;\n",
+		"site.conf":  "server {}\n",
+	}
+	for key, value := range expected {
+		if configMap.Data[key] != value {
+			t.Logf("expected %s=%q but got %q", key, value, configMap.Data[key])
+			t.FailNow()
+		}
+	}
+	if readStatus(configMap).Entries["settings"].Revision != first {
+		t.Logf("expected the digest as the revision: %+v", readStatus(configMap))
+		t.FailNow()
+	}
+
+	// The layers are not pulled again while the tag stays put.
+	pulls := registry.blobPulls
+	if err := wfh.processConfigMap("default", configMap); err != nil {
+		t.Logf("error processConfigMap: %s", err.Error())
+		t.FailNow()
+	}
+	if wfh.revisionChanged(configMap) || registry.blobPulls != pulls {
+		t.Logf("expected no new pulls, got %d after %d", registry.blobPulls, pulls)
+		t.FailNow()
+	}
+
+	// Moving the tag is picked up when polling.
+	second := registry.push("v1", map[string]string{
+		"app.yaml":   "replicas: 3\n",
+		"nginx.conf": "worker_processes 4;\n",
+		"site.conf":  "server {}\n",
+	})
+	syncCaches(t, wfh, kubeClient)
+	handleQueued(wfh)
+	wfh.pollConfigMaps()
+	configMap, _ = fetchConfigMap(kubeClient, "default", "from-oci")
+	if configMap.Data["settings"] != "replicas: 3\n" ||
+		readStatus(configMap).Entries["nginx"].Revision != second {
+		t.Logf("unexpected result after polling: %v %+v", configMap.Data,
+			readStatus(configMap))
+		t.FailNow()
+	}
+
+	// A wrong password gets no token.
+	registry.password = "rotated"
+	fRequest, _ := parseAnnotationData("settings=oci://" + host + "/gofiggy/config:v1 auth-secret=registry")
+	_, err := wfh.fetchEntry("default", fRequest, configMap)
+	if err == nil || !strings.Contains(err.Error(), "registry token") {
+		t.Logf("expected a token error, got %v", err)
+		t.FailNow()
+	}
+}
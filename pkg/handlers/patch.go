@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	api_v1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/JonPulfer/gofiggy/pkg/metrics"
+)
+
+var (
+	patchesSent = metrics.NewCounter("gofiggy_patches_total",
+		"Patches sent to configMaps and secrets.")
+	patchConflicts = metrics.NewCounter("gofiggy_patch_conflicts_total",
+		"Patches rejected because the object changed underneath them.")
+	patchRetries = metrics.NewCounter("gofiggy_patch_retries_total",
+		"Patches sent again after a conflict.")
+)
+
+// patchBackoff spaces out the attempts at a patch that keeps conflicting.
+var patchBackoff = wait.Backoff{
+	Steps:    5,
+	Duration: 50 * time.Millisecond,
+	Factor:   2.0,
+	Jitter:   0.1,
+}
+
+// configMapPatch is a JSON merge patch of the data and annotations that
+// differ between original and modified, so that we don't write over changes
+// made to anything else since original was read. The resourceVersion of
+// original is included so that the patch conflicts when the configMap has
+// changed since. It is nil when nothing differs.
+func configMapPatch(original *api_v1.ConfigMap, modified *api_v1.ConfigMap) []byte {
+	data := stringsPatch(original.Data, modified.Data)
+	return objectPatch(original.ObjectMeta, original.Annotations,
+		modified.Annotations, data)
+}
+
+// secretPatch is configMapPatch for a secret.
+func secretPatch(original *api_v1.Secret, modified *api_v1.Secret) []byte {
+	data := make(map[string]interface{})
+	for key, value := range modified.Data {
+		if previous, ok := original.Data[key]; !ok || string(previous) != string(value) {
+			data[key] = value
+		}
+	}
+	for key := range original.Data {
+		if _, ok := modified.Data[key]; !ok {
+			data[key] = nil
+		}
+	}
+	return objectPatch(original.ObjectMeta, original.Annotations,
+		modified.Annotations, data)
+}
+
+// objectPatch is the merge patch of the annotations and data changes, made
+// on the resourceVersion of meta.
+func objectPatch(meta v1.ObjectMeta, original map[string]string,
+	modified map[string]string, data map[string]interface{}) []byte {
+
+	patch := make(map[string]interface{})
+	metadata := make(map[string]interface{})
+	if annotations := stringsPatch(original, modified); len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+	if len(data) > 0 {
+		patch["data"] = data
+	}
+	if len(patch) == 0 && len(metadata) == 0 {
+		return nil
+	}
+	if len(meta.ResourceVersion) > 0 {
+		metadata["resourceVersion"] = meta.ResourceVersion
+	}
+	if len(metadata) > 0 {
+		patch["metadata"] = metadata
+	}
+	encoded, _ := json.Marshal(patch)
+	return encoded
+}
+
+// stringsPatch holds the values that changed, with null for those removed.
+func stringsPatch(original map[string]string,
+	modified map[string]string) map[string]interface{} {
+
+	patch := make(map[string]interface{})
+	for key, value := range modified {
+		if previous, ok := original[key]; !ok || previous != value {
+			patch[key] = value
+		}
+	}
+	for key := range original {
+		if _, ok := modified[key]; !ok {
+			patch[key] = nil
+		}
+	}
+	return patch
+}
+
+// rebaseStrings applies the changes made from original to modified onto
+// fresh, what is there now.
+func rebaseStrings(original map[string]string, modified map[string]string,
+	fresh map[string]string) map[string]string {
+
+	rebased := make(map[string]string)
+	for key, value := range fresh {
+		rebased[key] = value
+	}
+	for key, value := range stringsPatch(original, modified) {
+		if value == nil {
+			delete(rebased, key)
+			continue
+		}
+		rebased[key] = value.(string)
+	}
+	return rebased
+}
+
+// rebaseBytes is rebaseStrings for the data of a secret.
+func rebaseBytes(original map[string][]byte, modified map[string][]byte,
+	fresh map[string][]byte) map[string][]byte {
+
+	rebased := make(map[string][]byte)
+	for key, value := range fresh {
+		rebased[key] = value
+	}
+	for key := range original {
+		if _, ok := modified[key]; !ok {
+			delete(rebased, key)
+		}
+	}
+	for key, value := range modified {
+		if previous, ok := original[key]; !ok || string(previous) != string(value) {
+			rebased[key] = value
+		}
+	}
+	return rebased
+}
+
+// sendPatch sends a patch, retrying with backoff while it conflicts. send
+// is expected to rebase its changes onto a fresh read when it conflicts.
+func sendPatch(send func() error) error {
+	attempts := 0
+	return retry.RetryOnConflict(patchBackoff, func() error {
+		if attempts > 0 {
+			patchRetries.Inc()
+		}
+		attempts++
+		patchesSent.Inc()
+		err := send()
+		if k8s_errors.IsConflict(err) {
+			patchConflicts.Inc()
+		}
+		return err
+	})
+}
+
+// patchConfigMap writes the changes made to modified since it was read as
+// original, returning the configMap as written. When the configMap has
+// changed since original was read the changes are made again on what is
+// there now.
+func patchConfigMap(kubeClient kubernetes.Interface, original *api_v1.ConfigMap,
+	modified *api_v1.ConfigMap) (*api_v1.ConfigMap, error) {
+
+	if configMapPatch(original, modified) == nil {
+		return modified, nil
+	}
+
+	configMaps := kubeClient.CoreV1().ConfigMaps(modified.Namespace)
+	base, target := original, modified
+	var patched *api_v1.ConfigMap
+	err := sendPatch(func() error {
+		patch := configMapPatch(base, target)
+		if patch == nil {
+			patched = target
+			return nil
+		}
+		var err error
+		patched, err = configMaps.Patch(modified.Name, types.MergePatchType, patch)
+		if !k8s_errors.IsConflict(err) {
+			return err
+		}
+		fresh, getErr := configMaps.Get(modified.Name, v1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		base, target = fresh, fresh.DeepCopy()
+		target.Data = rebaseStrings(original.Data, modified.Data, fresh.Data)
+		target.Annotations = rebaseStrings(original.Annotations,
+			modified.Annotations, fresh.Annotations)
+		return err
+	})
+	return patched, errors.Wrapf(err, "unable to patch configMap %s", modified.Name)
+}
+
+// patchSecret is patchConfigMap for a secret.
+func patchSecret(kubeClient kubernetes.Interface, original *api_v1.Secret,
+	modified *api_v1.Secret) error {
+
+	if secretPatch(original, modified) == nil {
+		return nil
+	}
+
+	secrets := kubeClient.CoreV1().Secrets(modified.Namespace)
+	base, target := original, modified
+	err := sendPatch(func() error {
+		patch := secretPatch(base, target)
+		if patch == nil {
+			return nil
+		}
+		_, err := secrets.Patch(modified.Name, types.MergePatchType, patch)
+		if !k8s_errors.IsConflict(err) {
+			return err
+		}
+		fresh, getErr := secrets.Get(modified.Name, v1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		base, target = fresh, fresh.DeepCopy()
+		target.Data = rebaseBytes(original.Data, modified.Data, fresh.Data)
+		target.Annotations = rebaseStrings(original.Annotations,
+			modified.Annotations, fresh.Annotations)
+		return err
+	})
+	return errors.Wrapf(err, "unable to patch secret %s", modified.Name)
+}
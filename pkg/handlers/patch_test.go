@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8s_testing "k8s.io/client-go/testing"
+)
+
+// newFakeClientset is fake.NewSimpleClientset applying the JSON merge
+// patches we write with, which the fake doesn't understand. A patch made on
+// another resourceVersion than the one stored conflicts.
+func newFakeClientset(objects ...runtime.Object) *fake.Clientset {
+	tracker := k8s_testing.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder())
+	for _, obj := range objects {
+		if err := tracker.Add(obj); err != nil {
+			panic(err)
+		}
+	}
+
+	kubeClient := fake.NewSimpleClientset()
+	kubeClient.PrependReactor("*", "*", k8s_testing.ObjectReaction(tracker))
+	kubeClient.PrependReactor("patch", "*", func(action k8s_testing.Action) (
+		bool, runtime.Object, error) {
+
+		patch := action.(k8s_testing.PatchActionImpl)
+		obj, err := tracker.Get(patch.GetResource(), patch.GetNamespace(), patch.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+
+		var document, changes map[string]interface{}
+		encoded, _ := json.Marshal(obj)
+		json.Unmarshal(encoded, &document)
+		if err := json.Unmarshal(patch.GetPatch(), &changes); err != nil {
+			return true, nil, err
+		}
+		metadata, _ := changes["metadata"].(map[string]interface{})
+		if version, ok := metadata["resourceVersion"]; ok {
+			stored, _ := document["metadata"].(map[string]interface{})
+			if current, _ := stored["resourceVersion"].(string); current != version {
+				return true, nil, k8s_errors.NewConflict(patch.GetResource().GroupResource(),
+					patch.GetName(), errors.New("the object has been modified"))
+			}
+		}
+		encoded, _ = json.Marshal(applyMergePatch(document, changes))
+
+		patched := reflect.New(reflect.TypeOf(obj).Elem()).Interface().(runtime.Object)
+		if err := json.Unmarshal(encoded, patched); err != nil {
+			return true, nil, err
+		}
+		return true, patched, tracker.Update(patch.GetResource(), patched,
+			patch.GetNamespace())
+	})
+	return kubeClient
+}
+
+// applyMergePatch applies a JSON merge patch, RFC 7386, to document.
+func applyMergePatch(document map[string]interface{},
+	patch map[string]interface{}) map[string]interface{} {
+
+	if document == nil {
+		document = make(map[string]interface{})
+	}
+	for key, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			delete(document, key)
+		case map[string]interface{}:
+			existing, _ := document[key].(map[string]interface{})
+			document[key] = applyMergePatch(existing, value)
+		default:
+			document[key] = value
+		}
+	}
+	return document
+}
+
+func TestConfigMapPatch(t *testing.T) {
+	original := &api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{StatusAnnotation: "{}", "kept": "yes"},
+		},
+		Data: map[string]string{"joke": "old", "by-hand": "keep me", "gone": "x"},
+	}
+	modified := original.DeepCopy()
+	modified.Data["joke"] = "new"
+	delete(modified.Data, "gone")
+	delete(modified.Annotations, StatusAnnotation)
+
+	expected := `{"data":{"gone":null,"joke":"new"},` +
+		`"metadata":{"annotations":{"x-k8s.io/curl-me-that-status":null}}}`
+	if patch := string(configMapPatch(original, modified)); patch != expected {
+		t.Logf("expected %s but got %s", expected, patch)
+		t.FailNow()
+	}
+	if patch := configMapPatch(original, original.DeepCopy()); patch != nil {
+		t.Logf("expected no patch without changes but got %s", patch)
+		t.FailNow()
+	}
+}
+
+func TestPatchConfigMapRetriesConflicts(t *testing.T) {
+	original := &api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "app",
+			ResourceVersion: "1"},
+		Data: map[string]string{"joke": "old", "gone": "x"},
+	}
+	kubeClient := newFakeClientset(original)
+
+	// Someone else adds a key, and removes one we remove too, after we read
+	// the configMap.
+	concurrent := original.DeepCopy()
+	concurrent.ResourceVersion = "2"
+	concurrent.Data["by-hand"] = "keep me"
+	delete(concurrent.Data, "gone")
+	kubeClient.CoreV1().ConfigMaps("default").Update(concurrent)
+
+	var patches []string
+	kubeClient.PrependReactor("patch", "configmaps", func(action k8s_testing.Action) (
+		bool, runtime.Object, error) {
+
+		patches = append(patches, string(action.(k8s_testing.PatchActionImpl).GetPatch()))
+		return false, nil, nil
+	})
+
+	sent, conflicts, retried := patchesSent.Value(), patchConflicts.Value(),
+		patchRetries.Value()
+	modified := original.DeepCopy()
+	modified.Data["joke"] = "new"
+	delete(modified.Data, "gone")
+	patched, err := patchConfigMap(kubeClient, original, modified)
+	if err != nil || patched.Data["joke"] != "new" || patched.Data["by-hand"] != "keep me" {
+		t.Logf("unexpected patch %+v: %v", patched, err)
+		t.FailNow()
+	}
+	if patchesSent.Value()-sent != 2 || patchConflicts.Value()-conflicts != 1 ||
+		patchRetries.Value()-retried != 1 {
+		t.Logf("expected 2 patches, a conflict and a retry but got %d, %d and %d",
+			patchesSent.Value()-sent, patchConflicts.Value()-conflicts,
+			patchRetries.Value()-retried)
+		t.FailNow()
+	}
+	expected := []string{
+		`{"data":{"gone":null,"joke":"new"},"metadata":{"resourceVersion":"1"}}`,
+		`{"data":{"joke":"new"},"metadata":{"resourceVersion":"2"}}`,
+	}
+	if !reflect.DeepEqual(patches, expected) {
+		t.Logf("expected the patch to be made again on the fresh read: %q", patches)
+		t.FailNow()
+	}
+}
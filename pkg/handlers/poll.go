@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"time"
+
+	api_v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Poll checks the entries fetched from a revisionSource every interval and
+// queues the configMaps where one has moved on to a new revision to be
+// handled by the controller. Nothing else notifies us when a git repository
+// changes, so this is how new commits are picked up. Polling starts once the
+// controller has informed wfh and its caches have synced. It only returns
+// when polling is turned off.
+func (wfh WebsiteFetchHandler) Poll(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	<-wfh.caches.informed
+	if !cache.WaitForCacheSync(wait.NeverStop, wfh.caches.synced...) {
+		return
+	}
+	wait.Forever(wfh.pollConfigMaps, interval)
+}
+
+// pollConfigMaps queues each cached configMap with an entry that has
+// changed revision. They are handled along with the events the controller
+// watches, so never at the same time as another change to them.
+func (wfh WebsiteFetchHandler) pollConfigMaps() {
+	for _, obj := range wfh.caches.configMaps.List() {
+		configMap, ok := obj.(*api_v1.ConfigMap)
+		if !ok || !configMapHasAnnotation(configMap) || !wfh.revisionChanged(configMap) {
+			continue
+		}
+
+		key, err := cache.MetaNamespaceKeyFunc(configMap)
+		if err != nil {
+			continue
+		}
+		wfh.logger.Log().Str("configMap", configMap.Name).
+			Msg("queueing configMap with a new revision")
+		wfh.caches.queue.Enqueue(key)
+	}
+}
+
+// revisionChanged reports whether any entry fetched from a revisionSource has
+// a different revision to the one last written, or could not be checked.
+func (wfh WebsiteFetchHandler) revisionChanged(configMap *api_v1.ConfigMap) bool {
+	fReqs, err := parseAnnotationEntries(configMap.Annotations[CurlAnnotation])
+	if err != nil {
+		return false
+	}
+
+	status := wfh.currentStatus(configMap)
+	for _, fReq := range fReqs {
+		source, err := wfh.source(fReq.FromSite)
+		if err != nil {
+			continue
+		}
+		revisioned, ok := source.(revisionSource)
+		if !ok {
+			continue
+		}
+
+		if err := wfh.prepareRequest(configMap.Namespace, fReq, configMap); err != nil {
+			return true
+		}
+		revision, err := revisioned.Revision(configMap.Namespace, fReq)
+		if err != nil || revision != status.Entries[fReq.IntoKey].Revision {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	api_v1 "k8s.io/api/core/v1"
+
+	"github.com/JonPulfer/gofiggy/pkg/egress"
+)
+
+// retryBackoff is how long we wait before the first retry of a fetch, each
+// following retry waits a little longer.
+var retryBackoff = 500 * time.Millisecond
+
+// maxFetchRetries caps the `retries` option.
+const maxFetchRetries = 5
+
+// idempotentMethods are safe to send again when a fetch fails part way.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// validateMethod checks the method given in the `method` option.
+func validateMethod(method string) error {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return nil
+	}
+	return errors.New(fmt.Sprintf("unsupported method %s", method))
+}
+
+// method returns the HTTP method for the fetch, GET unless set.
+func (fr FetchRequest) method() string {
+	if len(fr.Method) == 0 {
+		return http.MethodGet
+	}
+	return fr.Method
+}
+
+// canRetry reports whether the fetch can safely be sent again. Methods that
+// are not idempotent, like POST, are only retried when the entry says it is
+// safe with `idempotent=true`.
+func (fr FetchRequest) canRetry() bool {
+	return idempotentMethods[fr.method()] || fr.Idempotent
+}
+
+// validateRequestOptions checks the options that only make sense together.
+func validateRequestOptions(fRequest *FetchRequest) error {
+	bodies := 0
+	for _, given := range []string{fRequest.Body, fRequest.BodyKey,
+		fRequest.BodyTemplate} {
+		if len(given) > 0 {
+			bodies++
+		}
+	}
+	if bodies > 1 {
+		return errors.New("only one of body, body-key and body-template can be given")
+	}
+
+	if fRequest.Sensitive && fRequest.writeStrategy() != WriteOverwrite {
+		return errors.New("sensitive values can only be overwritten")
+	}
+
+	if len(fRequest.SchemaKey) > 0 && !fRequest.isDocument() {
+		return errors.New(
+			"schema-key cannot be combined with extract, flatten, archive or a template")
+	}
+
+	if fRequest.Fallback != nil && fRequest.MaxStaleness == 0 {
+		return errors.New("fallback is only written after max-staleness")
+	}
+
+	if fRequest.Retries > 0 && !fRequest.canRetry() {
+		return errors.New(
+			fmt.Sprintf("retries are only made for idempotent methods, "+
+				"set idempotent=true if repeating the %s is safe",
+				fRequest.method()))
+	}
+	return nil
+}
+
+// resolveRequestBody works out the body to send, either given inline, read
+// from another key in the configMap or rendered from a template against the
+// configMap.
+func resolveRequestBody(fRequest *FetchRequest, configMap *api_v1.ConfigMap) error {
+	switch {
+	case len(fRequest.BodyKey) > 0:
+		body, ok := configMap.Data[fRequest.BodyKey]
+		if !ok {
+			return errors.New(
+				fmt.Sprintf("body key %s not found in configMap",
+					fRequest.BodyKey))
+		}
+		fRequest.body = body
+	case len(fRequest.BodyTemplate) > 0:
+		body, err := executeTemplate(fRequest.IntoKey+"-body",
+			fRequest.BodyTemplate, TemplateData{
+				Key:       fRequest.IntoKey,
+				ConfigMap: templateConfigMap(configMap),
+			})
+		if err != nil {
+			return errors.Wrap(err, "request body")
+		}
+		fRequest.body = body
+	default:
+		fRequest.body = fRequest.Body
+	}
+	return nil
+}
+
+// newHTTPRequest builds the request for a single attempt at the fetch.
+func newHTTPRequest(fRequest *FetchRequest) (*http.Request, error) {
+	var body io.Reader
+	if len(fRequest.body) > 0 {
+		body = bytes.NewReader([]byte(fRequest.body))
+	}
+
+	req, err := http.NewRequest(fRequest.method(), fRequest.FromSite.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range fRequest.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if body != nil && len(req.Header.Get("Content-Type")) == 0 {
+		req.Header.Set("Content-Type", detectBodyType(fRequest.body))
+	}
+
+	if fRequest.credentials != nil {
+		fRequest.credentials.apply(req)
+	}
+	return req, nil
+}
+
+// detectBodyType guesses the Content-Type for a body sent without one.
+func detectBodyType(body string) string {
+	trimmed := strings.TrimSpace(body)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		return "application/json"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// doRequest sends the fetch, retrying failed connections and server errors
+// up to the number of retries allowed for the entry. Fetches stopped by the
+// egress policy are never retried.
+func doRequest(cl *http.Client, fRequest *FetchRequest) (*http.Response, error) {
+	attempts := 1
+	if fRequest.canRetry() {
+		attempts += fRequest.Retries
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * retryBackoff)
+		}
+
+		req, err := newHTTPRequest(fRequest)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := cl.Do(req)
+		if denied, ok := egress.AsDenied(err); ok {
+			return nil, denied
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode >= http.StatusInternalServerError ||
+			resp.StatusCode == http.StatusTooManyRequests {
+			if attempt < attempts-1 {
+				resp.Body.Close()
+				lastErr = errors.New(
+					fmt.Sprintf("received %d status from fetch", resp.StatusCode))
+				continue
+			}
+		}
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
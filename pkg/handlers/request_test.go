@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestFetchWithMethodHeadersAndBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s %s %s %s", r.Method,
+				r.Header.Get("Accept"), r.Header.Get("Content-Type"), body)
+		}))
+	defer server.Close()
+
+	configMap := &api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "graphql-config"},
+		Data: map[string]string{
+			"query.graphql": `{"query": "{ settings { name } }"}`,
+		},
+	}
+
+	entries := map[string]string{
+		"settings=" + server.URL + " method=post header.Accept=application/json " +
+			"body-key=query.graphql": `POST application/json application/json ` +
+			`{"query": "{ settings { name } }"}`,
+		"settings=" + server.URL + ` method=PUT body-template="name={{ .ConfigMap.Name }}"`:              "PUT  text/plain; charset=utf-8 name=graphql-config",
+		"settings=" + server.URL + ` method=POST body="{}" header.Content-Type=application/vnd.api+json`: "POST  application/vnd.api+json {}",
+	}
+
+	for entry, expected := range entries {
+		fRequest, err := parseAnnotationData(entry)
+		if err != nil {
+			t.Logf("failed to parse %s: %s\n", entry, err.Error())
+			t.FailNow()
+		}
+		if err := resolveRequestBody(fRequest, configMap); err != nil {
+			t.Logf("failed to resolve the body: %s\n", err.Error())
+			t.FailNow()
+		}
+
+		fResp, err := fetchSiteData(fRequest)
+		if err != nil {
+			t.Logf("received error from fetchSiteData: %s\n", err.Error())
+			t.FailNow()
+		}
+		if fResp.Value != expected {
+			t.Logf("got %q, expected %q", fResp.Value, expected)
+			t.FailNow()
+		}
+	}
+}
+
+func TestFetchRetries(t *testing.T) {
+	retryBackoff = time.Millisecond
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, "ok")
+		}))
+	defer server.Close()
+
+	fRequest, _ := parseAnnotationData("status=" + server.URL + " retries=2")
+	if _, err := fetchSiteData(fRequest); err != nil || requests != 3 {
+		t.Logf("expected success after 3 requests, got %d: %v", requests, err)
+		t.FailNow()
+	}
+
+	if _, err := parseAnnotationData(
+		"status=" + server.URL + " method=POST retries=2"); err == nil {
+		t.Log("expected retries to be refused for a POST")
+		t.FailNow()
+	}
+
+	requests = 0
+	fRequest, _ = parseAnnotationData("status=" + server.URL + " method=POST")
+	if _, err := fetchSiteData(fRequest); err == nil || requests != 1 {
+		t.Logf("expected a single failed POST, got %d: %v", requests, err)
+		t.FailNow()
+	}
+
+	requests = 0
+	fRequest, _ = parseAnnotationData(
+		"status=" + server.URL + " method=POST retries=2 idempotent=true")
+	if _, err := fetchSiteData(fRequest); err != nil || requests != 3 {
+		t.Logf("expected the idempotent POST to be retried, got %d: %v",
+			requests, err)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,415 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	api_v1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/JonPulfer/gofiggy/pkg/config"
+	"github.com/JonPulfer/gofiggy/pkg/metrics"
+)
+
+// RolloutAnnotation on a Deployment, StatefulSet or DaemonSet lists the
+// configMaps and secrets, comma separated, whose changes restart it even
+// though its pods don't reference them, like: -
+//
+//	x-k8s.io/curl-me-that-rollout: app-config,secret/app-credentials
+//
+// A name alone is a configMap. Workloads with pods that mount them, or read
+// them through envFrom or valueFrom, are restarted without it.
+const RolloutAnnotation = "x-k8s.io/curl-me-that-rollout"
+
+// ChecksumAnnotation is set on the pod template of a workload to a checksum
+// of the content it uses, as JSON keyed by kind/name. Changing it is what
+// rolls the pods.
+const ChecksumAnnotation = "x-k8s.io/curl-me-that-checksum"
+
+var rolloutsTriggered = metrics.NewCounter("gofiggy_rollouts_total",
+	"Workloads restarted because content they use changed.")
+
+// workload is a Deployment, StatefulSet or DaemonSet.
+type workload struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// rollouts restarts the workloads using content we write, each no more
+// often than interval.
+type rollouts struct {
+	disabled bool
+	interval time.Duration
+	now      func() time.Time
+	after    func(time.Duration, func())
+
+	mu   *sync.Mutex
+	last map[workload]time.Time
+	// pending are the checksums waiting for the interval of each workload
+	// to pass, keyed by kind/name.
+	pending   map[workload]map[string]string
+	scheduled map[workload]bool
+}
+
+func newRollouts(cfg config.RolloutConfig) *rollouts {
+	interval, _ := cfg.Interval()
+	return &rollouts{
+		disabled: cfg.Disabled,
+		interval: interval,
+		now:      time.Now,
+		after: func(wait time.Duration, f func()) {
+			time.AfterFunc(wait, f)
+		},
+		mu:        &sync.Mutex{},
+		last:      make(map[workload]time.Time),
+		pending:   make(map[workload]map[string]string),
+		scheduled: make(map[workload]bool),
+	}
+}
+
+// contentChecksum identifies the content of a configMap or secret.
+func contentChecksum(data map[string]string) string {
+	hash := sha256.New()
+	for _, key := range sortedStringKeys(data) {
+		fmt.Fprintf(hash, "%s\x00%s\x00", key, data[key])
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// secretContent is the data of a secret as strings.
+func secretContent(data map[string][]byte) map[string]string {
+	content := make(map[string]string)
+	for key, value := range data {
+		content[key] = string(value)
+	}
+	return content
+}
+
+// configMapWritten restarts the workloads using configMap when writing it
+// changed its data.
+func (wfh WebsiteFetchHandler) configMapWritten(original *api_v1.ConfigMap,
+	configMap *api_v1.ConfigMap) {
+
+	if len(stringsPatch(original.Data, configMap.Data)) == 0 {
+		return
+	}
+	wfh.contentChanged(objectReference{
+		Kind:      "configmap",
+		Namespace: configMap.Namespace,
+		Name:      configMap.Name,
+	}, configMap.Data)
+}
+
+// secretWritten is configMapWritten for a secret, original is nil when it
+// was created.
+func (wfh WebsiteFetchHandler) secretWritten(original *api_v1.Secret,
+	secret *api_v1.Secret) {
+
+	if original != nil && secretPatch(original, secret) == nil {
+		return
+	}
+	wfh.contentChanged(objectReference{
+		Kind:      "secret",
+		Namespace: secret.Namespace,
+		Name:      secret.Name,
+	}, secretContent(secret.Data))
+}
+
+// contentChanged restarts the workloads using ref now that it holds data.
+// They are read from the cache rather than listed from the API server.
+func (wfh WebsiteFetchHandler) contentChanged(ref objectReference, data map[string]string) {
+	if wfh.rollouts == nil || wfh.rollouts.disabled {
+		return
+	}
+
+	checksum := contentChecksum(data)
+	deployments, err := wfh.caches.deployments.Deployments(ref.Namespace).
+		List(labels.Everything())
+	if err != nil {
+		wfh.logger.Log().Err(err).Msg("unable to list deployments to roll out")
+	}
+	for _, deployment := range deployments {
+		if usesObject(deployment.Annotations, deployment.Spec.Template.Spec, ref) {
+			wfh.rollout(workload{"Deployment", ref.Namespace, deployment.Name},
+				deployment, ref, checksum)
+		}
+	}
+
+	statefulSets, err := wfh.caches.statefulSets.StatefulSets(ref.Namespace).
+		List(labels.Everything())
+	if err != nil {
+		wfh.logger.Log().Err(err).Msg("unable to list statefulSets to roll out")
+	}
+	for _, statefulSet := range statefulSets {
+		if usesObject(statefulSet.Annotations, statefulSet.Spec.Template.Spec, ref) {
+			wfh.rollout(workload{"StatefulSet", ref.Namespace, statefulSet.Name},
+				statefulSet, ref, checksum)
+		}
+	}
+
+	daemonSets, err := wfh.caches.daemonSets.DaemonSets(ref.Namespace).
+		List(labels.Everything())
+	if err != nil {
+		wfh.logger.Log().Err(err).Msg("unable to list daemonSets to roll out")
+	}
+	for _, daemonSet := range daemonSets {
+		if usesObject(daemonSet.Annotations, daemonSet.Spec.Template.Spec, ref) {
+			wfh.rollout(workload{"DaemonSet", ref.Namespace, daemonSet.Name},
+				daemonSet, ref, checksum)
+		}
+	}
+}
+
+// usesObject reports whether a workload with annotations and pods of spec
+// uses ref, a configMap or secret.
+func usesObject(annotations map[string]string, spec api_v1.PodSpec,
+	ref objectReference) bool {
+
+	for _, name := range splitList(annotations[RolloutAnnotation]) {
+		kind := "configmap"
+		if parts := strings.SplitN(name, "/", 2); len(parts) == 2 {
+			kind, name = strings.ToLower(parts[0]), parts[1]
+		}
+		if kind == ref.Kind && name == ref.Name {
+			return true
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, volume := range spec.Volumes {
+		if volume.ConfigMap != nil {
+			names["configmap/"+volume.ConfigMap.Name] = true
+		}
+		if volume.Secret != nil {
+			names["secret/"+volume.Secret.SecretName] = true
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.ConfigMap != nil {
+					names["configmap/"+source.ConfigMap.Name] = true
+				}
+				if source.Secret != nil {
+					names["secret/"+source.Secret.Name] = true
+				}
+			}
+		}
+	}
+	var containers []api_v1.Container
+	containers = append(containers, spec.InitContainers...)
+	containers = append(containers, spec.Containers...)
+	for _, container := range containers {
+		for _, from := range container.EnvFrom {
+			if from.ConfigMapRef != nil {
+				names["configmap/"+from.ConfigMapRef.Name] = true
+			}
+			if from.SecretRef != nil {
+				names["secret/"+from.SecretRef.Name] = true
+			}
+		}
+		for _, env := range container.Env {
+			if env.ValueFrom == nil {
+				continue
+			}
+			if env.ValueFrom.ConfigMapKeyRef != nil {
+				names["configmap/"+env.ValueFrom.ConfigMapKeyRef.Name] = true
+			}
+			if env.ValueFrom.SecretKeyRef != nil {
+				names["secret/"+env.ValueFrom.SecretKeyRef.Name] = true
+			}
+		}
+	}
+	return names[ref.Kind+"/"+ref.Name]
+}
+
+// rollout restarts w, obj, with the checksum of ref now, or once the
+// interval since it was last restarted has passed.
+func (wfh WebsiteFetchHandler) rollout(w workload, obj interface{},
+	ref objectReference, checksum string) {
+
+	r := wfh.rollouts
+	r.mu.Lock()
+	if r.pending[w] == nil {
+		r.pending[w] = make(map[string]string)
+	}
+	r.pending[w][ref.Kind+"/"+ref.Name] = checksum
+	wait := r.last[w].Add(r.interval).Sub(r.now())
+	if wait > 0 {
+		deferred := !r.scheduled[w]
+		if deferred {
+			r.scheduled[w] = true
+			r.after(wait, func() { wfh.flushRollout(w) })
+		}
+		r.mu.Unlock()
+
+		if deferred {
+			wfh.recorder.Normal(obj, "RolloutDeferred", fmt.Sprintf(
+				"%s/%s changed, restarting in %s", ref.Kind, ref.Name,
+				wait.Round(time.Second)))
+		}
+		return
+	}
+	r.mu.Unlock()
+
+	wfh.flushRollout(w)
+}
+
+// flushRollout restarts w with the checksums pending for it. w is looked up
+// again as it may have changed, or gone, while the rollout was deferred.
+func (wfh WebsiteFetchHandler) flushRollout(w workload) {
+	r := wfh.rollouts
+	r.mu.Lock()
+	checksums := r.pending[w]
+	delete(r.pending, w)
+	delete(r.scheduled, w)
+	r.mu.Unlock()
+	if len(checksums) == 0 {
+		return
+	}
+
+	obj, err := wfh.cachedWorkload(w)
+	if k8s_errors.IsNotFound(err) {
+		return
+	}
+	if err != nil {
+		wfh.logger.Log().Err(err).Str("workload", w.Name).Msg("unable to roll out")
+		return
+	}
+
+	changed, err := wfh.patchChecksums(w, checksums)
+	if err != nil {
+		wfh.logger.Log().Err(err).Str("workload", w.Name).Msg("unable to roll out")
+		wfh.recorder.Warning(obj, "RolloutFailed", err.Error())
+		return
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	r.last[w] = r.now()
+	r.mu.Unlock()
+	rolloutsTriggered.Inc()
+	wfh.recorder.Normal(obj, "RolloutTriggered", fmt.Sprintf(
+		"restarting as %s changed", strings.Join(changed, ", ")))
+}
+
+// cachedWorkload is the object of w as last seen by the informers.
+func (wfh WebsiteFetchHandler) cachedWorkload(w workload) (interface{}, error) {
+	switch w.Kind {
+	case "Deployment":
+		return wfh.caches.deployments.Deployments(w.Namespace).Get(w.Name)
+	case "StatefulSet":
+		return wfh.caches.statefulSets.StatefulSets(w.Namespace).Get(w.Name)
+	default:
+		return wfh.caches.daemonSets.DaemonSets(w.Namespace).Get(w.Name)
+	}
+}
+
+// patchChecksums sets checksums in the ChecksumAnnotation of the pod
+// template of w, returning those that changed. The patch is made on the
+// resourceVersion that was read, and worked out again when w has changed
+// since.
+func (wfh WebsiteFetchHandler) patchChecksums(w workload,
+	checksums map[string]string) ([]string, error) {
+
+	var changed []string
+	sent := false
+	err := sendPatch(func() error {
+		sent = false
+		template, version, send, err := wfh.podTemplate(w)
+		if err != nil {
+			return err
+		}
+
+		current := make(map[string]string)
+		if raw := template[ChecksumAnnotation]; len(raw) > 0 {
+			json.Unmarshal([]byte(raw), &current)
+		}
+		changed = nil
+		for key, checksum := range checksums {
+			if current[key] != checksum {
+				current[key] = checksum
+				changed = append(changed, key)
+			}
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+		sort.Strings(changed)
+
+		encoded, _ := json.Marshal(current)
+		document := map[string]interface{}{
+			"spec": map[string]interface{}{
+				"template": map[string]interface{}{
+					"metadata": map[string]interface{}{
+						"annotations": map[string]string{ChecksumAnnotation: string(encoded)},
+					},
+				},
+			},
+		}
+		if len(version) > 0 {
+			document["metadata"] = map[string]interface{}{"resourceVersion": version}
+		}
+		patch, _ := json.Marshal(document)
+		sent = true
+		return send(patch)
+	})
+	if err != nil && sent {
+		return nil, errors.Wrapf(err, "unable to patch %s %s", w.Kind, w.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// podTemplate reads the annotations of the pod template of w, along with
+// the resourceVersion they were read at and how to patch w.
+func (wfh WebsiteFetchHandler) podTemplate(w workload) (map[string]string,
+	string, func(patch []byte) error, error) {
+
+	apps := wfh.clientset.AppsV1()
+	switch w.Kind {
+	case "Deployment":
+		deployment, err := apps.Deployments(w.Namespace).Get(w.Name, v1.GetOptions{})
+		if err != nil {
+			return nil, "", nil, errors.Wrapf(err, "unable to read deployment %s", w.Name)
+		}
+		return deployment.Spec.Template.Annotations, deployment.ResourceVersion,
+			func(patch []byte) error {
+				_, err := apps.Deployments(w.Namespace).Patch(w.Name, types.MergePatchType, patch)
+				return err
+			}, nil
+	case "StatefulSet":
+		statefulSet, err := apps.StatefulSets(w.Namespace).Get(w.Name, v1.GetOptions{})
+		if err != nil {
+			return nil, "", nil, errors.Wrapf(err, "unable to read statefulSet %s", w.Name)
+		}
+		return statefulSet.Spec.Template.Annotations, statefulSet.ResourceVersion,
+			func(patch []byte) error {
+				_, err := apps.StatefulSets(w.Namespace).Patch(w.Name, types.MergePatchType, patch)
+				return err
+			}, nil
+	default:
+		daemonSet, err := apps.DaemonSets(w.Namespace).Get(w.Name, v1.GetOptions{})
+		if err != nil {
+			return nil, "", nil, errors.Wrapf(err, "unable to read daemonSet %s", w.Name)
+		}
+		return daemonSet.Spec.Template.Annotations, daemonSet.ResourceVersion,
+			func(patch []byte) error {
+				_, err := apps.DaemonSets(w.Namespace).Patch(w.Name, types.MergePatchType, patch)
+				return err
+			}, nil
+	}
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	apps_v1 "k8s.io/api/apps/v1"
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUsesObject(t *testing.T) {
+	spec := api_v1.PodSpec{
+		Volumes: []api_v1.Volume{{
+			Name: "config",
+			VolumeSource: api_v1.VolumeSource{
+				ConfigMap: &api_v1.ConfigMapVolumeSource{
+					LocalObjectReference: api_v1.LocalObjectReference{Name: "mounted"},
+				},
+			},
+		}},
+		Containers: []api_v1.Container{{
+			EnvFrom: []api_v1.EnvFromSource{{
+				SecretRef: &api_v1.SecretEnvSource{
+					LocalObjectReference: api_v1.LocalObjectReference{Name: "env-from"},
+				},
+			}},
+			Env: []api_v1.EnvVar{{
+				Name: "LEVEL",
+				ValueFrom: &api_v1.EnvVarSource{
+					ConfigMapKeyRef: &api_v1.ConfigMapKeySelector{
+						LocalObjectReference: api_v1.LocalObjectReference{Name: "value-from"},
+						Key:                  "level",
+					},
+				},
+			}},
+		}},
+	}
+	annotations := map[string]string{RolloutAnnotation: "opted-in, secret/credentials"}
+
+	for _, used := range []objectReference{
+		{Kind: "configmap", Name: "mounted"},
+		{Kind: "secret", Name: "env-from"},
+		{Kind: "configmap", Name: "value-from"},
+		{Kind: "configmap", Name: "opted-in"},
+		{Kind: "secret", Name: "credentials"},
+	} {
+		if !usesObject(annotations, spec, used) {
+			t.Logf("expected %+v to be used", used)
+			t.FailNow()
+		}
+	}
+	for _, unused := range []objectReference{
+		{Kind: "secret", Name: "mounted"},
+		{Kind: "configmap", Name: "credentials"},
+		{Kind: "configmap", Name: "other"},
+	} {
+		if usesObject(annotations, spec, unused) {
+			t.Logf("expected %+v not to be used", unused)
+			t.FailNow()
+		}
+	}
+}
+
+func TestProcessConfigMapRollsOutWorkloads(t *testing.T) {
+	replicas := "replicas: 3\n"
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, replicas)
+		}))
+	defer server.Close()
+
+	podSpec := func(configMap string) api_v1.PodTemplateSpec {
+		return api_v1.PodTemplateSpec{Spec: api_v1.PodSpec{
+			Containers: []api_v1.Container{{
+				Name: "app",
+				EnvFrom: []api_v1.EnvFromSource{{
+					ConfigMapRef: &api_v1.ConfigMapEnvSource{
+						LocalObjectReference: api_v1.LocalObjectReference{Name: configMap},
+					},
+				}},
+			}},
+		}}
+	}
+	kubeClient := newFakeClientset(
+		&api_v1.ConfigMap{
+			ObjectMeta: v1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "app",
+				Annotations: map[string]string{CurlAnnotation: "app.yaml=" + server.URL},
+			},
+		},
+		&apps_v1.Deployment{
+			ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "app"},
+			Spec:       apps_v1.DeploymentSpec{Template: podSpec("app")},
+		},
+		&apps_v1.Deployment{
+			ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "unrelated"},
+			Spec:       apps_v1.DeploymentSpec{Template: podSpec("other")},
+		},
+		&apps_v1.DaemonSet{
+			ObjectMeta: v1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "agent",
+				Annotations: map[string]string{RolloutAnnotation: "app"},
+			},
+		},
+	)
+
+	wfh := newWebsiteFetchHandler(kubeClient, testConfig())
+	now := time.Now()
+	var scheduled []func()
+	wfh.rollouts.now = func() time.Time { return now }
+	wfh.rollouts.after = func(wait time.Duration, f func()) {
+		scheduled = append(scheduled, f)
+	}
+
+	process := func() {
+		syncCaches(t, wfh, kubeClient)
+		configMap, _ := fetchConfigMap(kubeClient, "default", "app")
+		if err := wfh.processConfigMap("default", configMap); err != nil {
+			t.Logf("error processConfigMap: %s", err.Error())
+			t.FailNow()
+		}
+	}
+	checksum := func(name string) string {
+		deployment, _ := kubeClient.AppsV1().Deployments("default").Get(name, v1.GetOptions{})
+		checksums := make(map[string]string)
+		json.Unmarshal([]byte(deployment.Spec.Template.Annotations[ChecksumAnnotation]),
+			&checksums)
+		return checksums["configmap/app"]
+	}
+
+	process()
+	first := checksum("app")
+	daemonSet, _ := kubeClient.AppsV1().DaemonSets("default").Get("agent", v1.GetOptions{})
+	if len(first) == 0 || len(checksum("unrelated")) > 0 ||
+		len(daemonSet.Spec.Template.Annotations[ChecksumAnnotation]) == 0 {
+		t.Logf("expected only the workloads using app to roll out: %q", first)
+		t.FailNow()
+	}
+
+	// A change within the interval waits for it to pass.
+	replicas = "replicas: 5\n"
+	process()
+	if checksum("app") != first || len(scheduled) != 2 {
+		t.Logf("expected the rollout to be deferred: %d scheduled", len(scheduled))
+		t.FailNow()
+	}
+	now = now.Add(time.Minute)
+	for _, f := range scheduled {
+		f()
+	}
+	second := checksum("app")
+	if second == first || len(second) == 0 {
+		t.Logf("expected the deferred rollout once the interval passed: %q", second)
+		t.FailNow()
+	}
+
+	// A workload removed while its rollout is deferred is looked up again
+	// when the interval passes and left alone.
+	replicas = "replicas: 7\n"
+	scheduled = nil
+	process()
+	if len(scheduled) != 2 {
+		t.Logf("expected the rollouts to be deferred: %d scheduled", len(scheduled))
+		t.FailNow()
+	}
+	kubeClient.AppsV1().Deployments("default").Delete("app", nil)
+	syncCaches(t, wfh, kubeClient)
+	kubeClient.ClearActions()
+	now = now.Add(time.Minute)
+	for _, f := range scheduled {
+		f()
+	}
+	for _, action := range kubeClient.Actions() {
+		if action.GetResource().Resource == "deployments" {
+			t.Logf("expected the removed deployment to be left alone: %v", action)
+			t.FailNow()
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/JonPulfer/gofiggy/pkg/config"
+)
+
+// defaultS3Region is signed for when neither the config nor the entry give a
+// region.
+const defaultS3Region = "us-east-1"
+
+// maxS3Objects caps how many objects a prefix can expand to, far more than
+// would fit in a configMap anyway.
+const maxS3Objects = 1000
+
+// s3Source reads objects from S3 or any S3 compatible object storage. Entries
+// name a single object, or a prefix ending in a slash to read every object
+// under it, like: -
+//
+//	app.yaml=s3://config-bucket/app/app.yaml
+//	nginx=s3://config-bucket/nginx/?endpoint=http://minio.storage:9000 auth-secret=minio
+//
+// Objects under a prefix are written to a key each, named by what follows the
+// prefix, and the archive options select and rename them. Only the selected
+// objects are downloaded, once their listed sizes are known to fit. Requests
+// are signed with the accessKeyId and secretAccessKey from the auth-secret.
+// The ETag of the object, or a hash of the ETags under the prefix, is the
+// revision so that polling picks up changes.
+type s3Source struct {
+	transports *transportCache
+	endpoint   string
+	region     string
+	now        func() time.Time
+}
+
+func newS3Source(cfg config.S3Config, transports *transportCache) s3Source {
+	return s3Source{
+		transports: transports,
+		endpoint:   cfg.Endpoint,
+		region:     cfg.Region,
+		now:        time.Now,
+	}
+}
+
+// s3Location is what an s3 URL points to.
+type s3Location struct {
+	endpoint *url.URL
+	region   string
+	bucket   string
+	key      string
+	// pathStyle puts the bucket in the path rather than the host name, which
+	// is what S3 compatible services expect.
+	pathStyle bool
+}
+
+func (ss s3Source) location(u *url.URL) (s3Location, error) {
+	query := u.Query()
+	location := s3Location{
+		region: ss.region,
+		bucket: u.Host,
+		key:    strings.TrimPrefix(u.Path, "/"),
+	}
+	if region := query.Get("region"); len(region) > 0 {
+		location.region = region
+	}
+	if len(location.region) == 0 {
+		location.region = defaultS3Region
+	}
+	if len(location.bucket) == 0 {
+		return location, errors.New(
+			fmt.Sprintf("expected s3://<bucket>/<key> but got %s", u.String()))
+	}
+
+	endpoint := ss.endpoint
+	if given := query.Get("endpoint"); len(given) > 0 {
+		endpoint = given
+	}
+	location.pathStyle = len(endpoint) > 0
+	if !location.pathStyle {
+		endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com",
+			location.bucket, location.region)
+	}
+
+	parsed, err := url.Parse(endpoint)
+	if err != nil || len(parsed.Host) == 0 {
+		return location, errors.New(fmt.Sprintf("invalid endpoint %s", endpoint))
+	}
+	location.endpoint = parsed
+	return location, nil
+}
+
+// isPrefix reports whether the location is every object under a prefix.
+func (loc s3Location) isPrefix() bool {
+	return len(loc.key) == 0 || strings.HasSuffix(loc.key, "/")
+}
+
+// objectURL returns the URL for key in the bucket with query added.
+func (loc s3Location) objectURL(key string, query url.Values) *url.URL {
+	u := *loc.endpoint
+	objectPath := "/" + key
+	if loc.pathStyle {
+		objectPath = "/" + loc.bucket + objectPath
+	}
+	u.Path = strings.TrimSuffix(loc.endpoint.Path, "/") + objectPath
+	u.RawPath = canonicalURI(&u)
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// s3Object is an object found under a prefix.
+type s3Object struct {
+	Key  string `xml:"Key"`
+	ETag string `xml:"ETag"`
+	Size int64  `xml:"Size"`
+}
+
+type s3ListResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (ss s3Source) Fetch(namespace string, fRequest *FetchRequest) (*FetchResponse, error) {
+	location, err := ss.location(fRequest.FromSite)
+	if err != nil {
+		return nil, err
+	}
+	cl, err := ss.transports.client(namespace, fRequest.TLSProfile)
+	if err != nil {
+		return nil, err
+	}
+
+	fResp := &FetchResponse{Key: fRequest.IntoKey, Header: http.Header{}}
+
+	if !location.isPrefix() {
+		content, header, err := ss.do(cl, fRequest, location,
+			http.MethodGet, location.objectURL(location.key, nil))
+		if err != nil {
+			return nil, err
+		}
+		fResp.Header = header
+		fResp.Value = string(content)
+		fResp.Revision = strings.Trim(header.Get("ETag"), `"`)
+		if !isText(content) {
+			fResp.Value = ""
+			fResp.Data = map[string]string{}
+			fResp.BinaryData = map[string][]byte{fRequest.IntoKey: content}
+		}
+		return fResp, nil
+	}
+
+	objects, err := ss.list(cl, fRequest, location)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := selectObjects(fRequest, location, objects)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []archiveFile
+	for _, object := range selected {
+		content, _, err := ss.do(cl, fRequest, location,
+			http.MethodGet, location.objectURL(object.Key, nil))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, archiveFile{
+			name:    strings.TrimPrefix(object.Key, location.key),
+			content: content,
+		})
+	}
+
+	if err := writeFiles(fRequest, fResp, files, "object"); err != nil {
+		return nil, err
+	}
+	fResp.Revision = objectsRevision(objects)
+	return fResp, nil
+}
+
+// selectObjects returns the objects the archive options select, refusing
+// them when their listed sizes add up to more than a configMap can hold so
+// that nothing is downloaded that could never be written.
+func selectObjects(fRequest *FetchRequest, location s3Location,
+	objects []s3Object) ([]s3Object, error) {
+
+	var selected []s3Object
+	var total int64
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, location.key)
+		if _, ok := archiveKey(fRequest.Archive, name, fRequest.keySeparator()); !ok {
+			continue
+		}
+		selected = append(selected, object)
+		total += object.Size
+	}
+	if total > maxConfigMapSize {
+		return nil, errors.New(fmt.Sprintf(
+			"objects under %s add up to %d bytes, more than the %d bytes "+
+				"a configMap can hold", location.key, total, maxConfigMapSize))
+	}
+	return selected, nil
+}
+
+// Revision returns the ETag of the object, or a hash of the ETags of the
+// objects under the prefix.
+func (ss s3Source) Revision(namespace string, fRequest *FetchRequest) (string, error) {
+	location, err := ss.location(fRequest.FromSite)
+	if err != nil {
+		return "", err
+	}
+	cl, err := ss.transports.client(namespace, fRequest.TLSProfile)
+	if err != nil {
+		return "", err
+	}
+
+	if !location.isPrefix() {
+		_, header, err := ss.do(cl, fRequest, location,
+			http.MethodHead, location.objectURL(location.key, nil))
+		if err != nil {
+			return "", err
+		}
+		return strings.Trim(header.Get("ETag"), `"`), nil
+	}
+
+	objects, err := ss.list(cl, fRequest, location)
+	if err != nil {
+		return "", err
+	}
+	return objectsRevision(objects), nil
+}
+
+// list returns the objects under the prefix, leaving out the zero length
+// objects some tools create to stand in for directories.
+func (ss s3Source) list(cl *http.Client, fRequest *FetchRequest,
+	location s3Location) ([]s3Object, error) {
+
+	var objects []s3Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {location.key}}
+		if len(token) > 0 {
+			query.Set("continuation-token", token)
+		}
+
+		content, _, err := ss.do(cl, fRequest, location, http.MethodGet,
+			location.objectURL("", query))
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+		if err := xml.Unmarshal(content, &result); err != nil {
+			return nil, errors.Wrap(err, "unable to read object list")
+		}
+		for _, object := range result.Contents {
+			if strings.HasSuffix(object.Key, "/") {
+				continue
+			}
+			objects = append(objects, object)
+		}
+
+		if len(objects) > maxS3Objects {
+			return nil, errors.New(
+				fmt.Sprintf("more than %d objects under %s", maxS3Objects,
+					location.key))
+		}
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	if len(objects) == 0 {
+		return nil, errors.New(
+			fmt.Sprintf("no objects found under %s/%s", location.bucket,
+				location.key))
+	}
+	return objects, nil
+}
+
+// do sends a signed request, turning S3 error responses into errors.
+func (ss s3Source) do(cl *http.Client, fRequest *FetchRequest,
+	location s3Location, method string, u *url.URL) ([]byte, http.Header, error) {
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fRequest.credentials != nil {
+		if fRequest.credentials.Scheme != AuthSigV4 {
+			return nil, nil, errors.New(
+				"s3 needs accessKeyId and secretAccessKey in the auth secret")
+		}
+		signV4(req, fRequest.credentials, location.region, "s3", ss.now())
+	}
+
+	resp, err := cl.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := readLimited(u.Path, resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var s3Err s3Error
+		xml.Unmarshal(content, &s3Err)
+		if len(s3Err.Code) == 0 {
+			s3Err.Code = http.StatusText(resp.StatusCode)
+		}
+		message := fmt.Sprintf("s3 %s %s: %d %s", method, u.Path,
+			resp.StatusCode, s3Err.Code)
+		if len(s3Err.Message) > 0 {
+			message += ": " + s3Err.Message
+		}
+		return nil, nil, errors.New(message)
+	}
+
+	return content, resp.Header, nil
+}
+
+// objectsRevision hashes the keys and ETags of objects so that any object
+// being added, removed or changed gives a new revision.
+func objectsRevision(objects []s3Object) string {
+	lines := make([]string, 0, len(objects))
+	for _, object := range objects {
+		lines = append(lines, object.Key+" "+strings.Trim(object.ETag, `"`))
+	}
+	sort.Strings(lines)
+
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return "sha256:" + hex.EncodeToString(sum[:])[:16]
+}
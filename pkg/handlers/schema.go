@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// validateSchema checks document against a JSON Schema. We understand the
+// subset of it that config is usually checked with: -
+//
+//	type, enum, const, required, properties, additionalProperties, items,
+//	minimum, maximum, minLength, maxLength, pattern, minItems, maxItems
+//
+// Anything else in the schema is ignored. The error names where in the
+// document it failed, like `$.log.level`.
+func validateSchema(schema interface{}, document interface{}) error {
+	return checkSchema(schema, document, "$")
+}
+
+func checkSchema(schema interface{}, value interface{}, at string) error {
+	switch schema := schema.(type) {
+	case bool:
+		if !schema {
+			return errors.New(fmt.Sprintf("%s is not allowed", at))
+		}
+		return nil
+	case map[string]interface{}:
+		return checkSchemaObject(schema, value, at)
+	}
+	return errors.New(fmt.Sprintf("the schema for %s is not an object", at))
+}
+
+func checkSchemaObject(schema map[string]interface{}, value interface{}, at string) error {
+	if types, ok := schema["type"]; ok && !matchesType(types, value) {
+		return errors.New(fmt.Sprintf("%s should be %v but is %s", at, types,
+			typeOf(value)))
+	}
+	if constant, ok := schema["const"]; ok && !reflect.DeepEqual(constant, value) {
+		return errors.New(fmt.Sprintf("%s should be %v", at, constant))
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			found = found || reflect.DeepEqual(allowed, value)
+		}
+		if !found {
+			return errors.New(fmt.Sprintf("%s should be one of %v", at, enum))
+		}
+	}
+
+	switch value := value.(type) {
+	case float64:
+		if minimum, ok := schema["minimum"].(float64); ok && value < minimum {
+			return errors.New(fmt.Sprintf("%s should be at least %v", at, minimum))
+		}
+		if maximum, ok := schema["maximum"].(float64); ok && value > maximum {
+			return errors.New(fmt.Sprintf("%s should be at most %v", at, maximum))
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(value))
+		if minLength, ok := schema["minLength"].(float64); ok && length < minLength {
+			return errors.New(fmt.Sprintf("%s should be at least %v long", at, minLength))
+		}
+		if maxLength, ok := schema["maxLength"].(float64); ok && length > maxLength {
+			return errors.New(fmt.Sprintf("%s should be at most %v long", at, maxLength))
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			matcher, err := regexp.Compile(pattern)
+			if err != nil {
+				return errors.Wrapf(err, "invalid pattern for %s", at)
+			}
+			if !matcher.MatchString(value) {
+				return errors.New(fmt.Sprintf("%s should match %s", at, pattern))
+			}
+		}
+	case []interface{}:
+		count := float64(len(value))
+		if minItems, ok := schema["minItems"].(float64); ok && count < minItems {
+			return errors.New(fmt.Sprintf("%s should have at least %v items", at, minItems))
+		}
+		if maxItems, ok := schema["maxItems"].(float64); ok && count > maxItems {
+			return errors.New(fmt.Sprintf("%s should have at most %v items", at, maxItems))
+		}
+		if items, ok := schema["items"]; ok {
+			for i, item := range value {
+				if err := checkSchema(items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := value[fmt.Sprint(name)]; !ok {
+					return errors.New(fmt.Sprintf("%s.%v is required", at, name))
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := properties[name]
+			if !ok {
+				property, ok = schema["additionalProperties"]
+			}
+			if !ok {
+				continue
+			}
+			if err := checkSchema(property, value[name], at+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// matchesType reports whether value is of the type, or one of the types,
+// given in a schema.
+func matchesType(types interface{}, value interface{}) bool {
+	if list, ok := types.([]interface{}); ok {
+		for _, t := range list {
+			if matchesType(t, value) {
+				return true
+			}
+		}
+		return false
+	}
+	actual := typeOf(value)
+	return actual == types ||
+		(types == "number" && actual == "integer")
+}
+
+// typeOf names the JSON Schema type of a decoded value.
+func typeOf(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
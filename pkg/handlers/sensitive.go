@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+	api_v1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SensitiveSecretAnnotation names the Secret alongside a configMap that holds
+// the values too sensitive to be written into the configMap itself.
+const SensitiveSecretAnnotation = "x-k8s.io/curl-me-that-secret"
+
+// errSensitiveFailure stands in for the errors of sensitive entries, which
+// can quote what was fetched, wherever they would be logged or recorded.
+var errSensitiveFailure = errors.New(
+	"the fetch failed, details are withheld as the entry is sensitive")
+
+// sensitiveSecretName is the name of the Secret for configMap's sensitive
+// values.
+func sensitiveSecretName(configMap *api_v1.ConfigMap) string {
+	return configMap.Name + "-sensitive"
+}
+
+// markSensitive moves everything fetched for an entry into its Sensitive
+// values.
+func markSensitive(fResp *FetchResponse) {
+	if fResp.Sensitive == nil {
+		fResp.Sensitive = make(map[string][]byte)
+	}
+	for key, value := range fResp.Entries() {
+		fResp.Sensitive[key] = []byte(value)
+	}
+	for key, value := range fResp.BinaryData {
+		fResp.Sensitive[key] = value
+	}
+	fResp.Value = ""
+	fResp.Data = map[string]string{}
+	fResp.BinaryData = nil
+}
+
+// mayBeSensitive reports whether the entry writes any sensitive values.
+func (fr FetchRequest) mayBeSensitive() bool {
+	return fr.Sensitive ||
+		(fr.FromSite.Scheme == "vault" && len(fr.FromSite.Query().Get("sensitive")) > 0)
+}
+
+// setSecretType records the type of Secret fReq wants its sensitive values
+// in, which all the entries of a configMap have to agree on.
+func (fr *fetchResults) setSecretType(fReq *FetchRequest) error {
+	if len(fReq.SecretType) == 0 {
+		return nil
+	}
+	if len(fr.secretType) > 0 && fr.secretType != fReq.SecretType {
+		return errors.New(fmt.Sprintf(
+			"entries ask for secrets of both type %s and %s",
+			fr.secretType, fReq.SecretType))
+	}
+	fr.secretType = fReq.SecretType
+	return nil
+}
+
+// syncSensitive writes the sensitive results of source into the Secret
+// alongside it, removing the orphaned keys, and points annotated at it. Once
+// none of the entries are sensitive the Secret is deleted.
+func (wfh WebsiteFetchHandler) syncSensitive(source *api_v1.ConfigMap,
+	annotated *api_v1.ConfigMap, results fetchResults, orphans []string) error {
+
+	if !results.hasSensitive {
+		delete(annotated.Annotations, SensitiveSecretAnnotation)
+		return wfh.removeSensitive(source)
+	}
+	if len(results.sensitive) == 0 && len(orphans) == 0 {
+		return nil
+	}
+
+	name, err := wfh.writeSensitive(source, results.sensitive, orphans,
+		results.secretType)
+	if err != nil {
+		return err
+	}
+	annotated.Annotations[SensitiveSecretAnnotation] = name
+	return nil
+}
+
+// removeSensitive deletes the Secret alongside configMap if we created one.
+func (wfh WebsiteFetchHandler) removeSensitive(configMap *api_v1.ConfigMap) error {
+	secrets := wfh.clientset.CoreV1().Secrets(configMap.Namespace)
+	name := sensitiveSecretName(configMap)
+
+	secret, err := secrets.Get(name, v1.GetOptions{})
+	if k8s_errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to read secret %s", name)
+	}
+	if !ownedBy(secret.ObjectMeta, configMap) {
+		return nil
+	}
+	if err := secrets.Delete(name, nil); err != nil && !k8s_errors.IsNotFound(err) {
+		return errors.Wrapf(err, "unable to delete secret %s", name)
+	}
+	return nil
+}
+
+// writeSensitive puts data into the Secret alongside configMap, and removes
+// the orphans, creating it when it doesn't exist yet, and returns its name.
+// The Secret is owned by the configMap so that it is deleted along with it.
+// The type of a Secret can't be changed, so it is made again when secretType
+// changes.
+func (wfh WebsiteFetchHandler) writeSensitive(configMap *api_v1.ConfigMap,
+	data map[string][]byte, orphans []string, secretType string) (string, error) {
+
+	secrets := wfh.clientset.CoreV1().Secrets(configMap.Namespace)
+	name := sensitiveSecretName(configMap)
+	if len(secretType) == 0 {
+		secretType = string(api_v1.SecretTypeOpaque)
+	}
+
+	secret, err := secrets.Get(name, v1.GetOptions{})
+	if err == nil && ownedBy(secret.ObjectMeta, configMap) &&
+		string(secret.Type) != secretType {
+		if err := secrets.Delete(name, nil); err != nil {
+			return "", errors.Wrapf(err, "unable to delete secret %s to change "+
+				"its type", name)
+		}
+		kept := make(map[string][]byte)
+		for key, value := range secret.Data {
+			kept[key] = value
+		}
+		for _, key := range orphans {
+			delete(kept, key)
+		}
+		for key, value := range data {
+			kept[key] = value
+		}
+		data = kept
+		err = k8s_errors.NewNotFound(api_v1.Resource("secrets"), name)
+	}
+
+	if k8s_errors.IsNotFound(err) {
+		secret = &api_v1.Secret{
+			ObjectMeta: v1.ObjectMeta{
+				Namespace:       configMap.Namespace,
+				Name:            name,
+				OwnerReferences: []v1.OwnerReference{ownerReference(configMap)},
+			},
+			Type: api_v1.SecretType(secretType),
+			Data: data,
+		}
+		if _, err := secrets.Create(secret); err != nil {
+			return "", errors.Wrapf(err, "unable to create secret %s", name)
+		}
+		wfh.secretWritten(nil, secret)
+	} else if err != nil {
+		return "", errors.Wrapf(err, "unable to read secret %s", name)
+	} else {
+		if !ownedBy(secret.ObjectMeta, configMap) {
+			return "", errors.New(fmt.Sprintf(
+				"secret %s already exists and is not owned by configMap %s",
+				name, configMap.Name))
+		}
+		original := secret.DeepCopy()
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		for _, key := range orphans {
+			delete(secret.Data, key)
+		}
+		for key, value := range data {
+			secret.Data[key] = value
+		}
+		if err := patchSecret(wfh.clientset, original, secret); err != nil {
+			return "", err
+		}
+		wfh.secretWritten(original, secret)
+	}
+
+	return name, nil
+}
+
+// ownerReference makes configMap the controlling owner of an object.
+func ownerReference(configMap *api_v1.ConfigMap) v1.OwnerReference {
+	controller := true
+	return v1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Name:       configMap.Name,
+		UID:        configMap.UID,
+		Controller: &controller,
+	}
+}
+
+// ownedBy reports whether meta has configMap as an owner.
+func ownedBy(meta v1.ObjectMeta, configMap *api_v1.ConfigMap) bool {
+	for _, owner := range meta.OwnerReferences {
+		if owner.Kind == "ConfigMap" && owner.Name == configMap.Name &&
+			owner.UID == configMap.UID {
+			return true
+		}
+	}
+	return false
+}
+
+// logSafe is what is logged of a configMap. The values of its keys are left
+// out in case any of them came from somewhere sensitive.
+func logSafe(configMap *api_v1.ConfigMap) interface{} {
+	if configMap == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(configMap.Data))
+	for key := range configMap.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return map[string]interface{}{
+		"namespace":   configMap.Namespace,
+		"name":        configMap.Name,
+		"annotations": configMap.Annotations,
+		"keys":        keys,
+	}
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProcessConfigMapWithSensitiveEntries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/token":
+				fmt.Fprint(w, "s3cr3t")
+			case "/broken":
+				w.WriteHeader(http.StatusInternalServerError)
+			default:
+				fmt.Fprint(w, "replicas: 3\n")
+			}
+		}))
+	defer server.Close()
+
+	kubeClient := newFakeClientset()
+	kubeClient.CoreV1().ConfigMaps("default").Create(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: "default",
+			Name:      "app",
+			UID:       "app-uid",
+			Annotations: map[string]string{
+				CurlAnnotation: "app.yaml=" + server.URL + "/app.yaml\n" +
+					"token=" + server.URL + "/token sensitive=true",
+			},
+		},
+		Data: map[string]string{},
+	})
+
+	wfh := newWebsiteFetchHandler(kubeClient, testConfig())
+	process := func(annotation string) (*api_v1.ConfigMap, error) {
+		configMap, _ := fetchConfigMap(kubeClient, "default", "app")
+		if len(annotation) > 0 {
+			configMap.Annotations[CurlAnnotation] = annotation
+		}
+		err := wfh.processConfigMap("default", configMap)
+		configMap, _ = fetchConfigMap(kubeClient, "default", "app")
+		return configMap, err
+	}
+	secret := func() *api_v1.Secret {
+		secret, _ := kubeClient.CoreV1().Secrets("default").
+			Get("app-sensitive", v1.GetOptions{})
+		return secret
+	}
+
+	configMap, err := process("")
+	if err != nil {
+		t.Logf("error processConfigMap: %s", err.Error())
+		t.FailNow()
+	}
+	if _, ok := configMap.Data["token"]; ok || configMap.Data["app.yaml"] != "replicas: 3\n" {
+		t.Logf("expected only the plain entry in the configMap: %v", configMap.Data)
+		t.FailNow()
+	}
+	if configMap.Annotations[SensitiveSecretAnnotation] != "app-sensitive" ||
+		string(secret().Data["token"]) != "s3cr3t" ||
+		secret().Type != api_v1.SecretTypeOpaque {
+		t.Logf("expected the token in the secret: %+v", secret())
+		t.FailNow()
+	}
+	logged, _ := json.Marshal(logSafe(configMap))
+	if strings.Contains(string(logged), "replicas") {
+		t.Logf("expected no values to be logged: %s", logged)
+		t.FailNow()
+	}
+
+	// Changing the type makes the secret again.
+	_, err = process("token=" + server.URL + "/token sensitive=true " +
+		"secret-type=example.com/token")
+	if err != nil || secret().Type != "example.com/token" ||
+		string(secret().Data["token"]) != "s3cr3t" {
+		t.Logf("expected the secret to change type: %+v %v", secret(), err)
+		t.FailNow()
+	}
+
+	// The errors of sensitive entries are withheld, and the secret kept.
+	configMap, err = process("token=" + server.URL + "/broken sensitive=true")
+	status := readStatus(configMap).Entries["token"]
+	if err == nil || status.Message != errSensitiveFailure.Error() || secret() == nil {
+		t.Logf("expected the error to be withheld: %+v %v", status, err)
+		t.FailNow()
+	}
+
+	// Without sensitive entries the secret is deleted.
+	configMap, err = process("app.yaml=" + server.URL + "/app.yaml")
+	if err != nil || secret() != nil ||
+		len(configMap.Annotations[SensitiveSecretAnnotation]) > 0 {
+		t.Logf("expected the secret to be deleted: %+v %v", secret(), err)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/JonPulfer/gofiggy/pkg/config"
+)
+
+// The ways a Service can be reached, given with the `via` query parameter.
+const (
+	ViaEndpoints = "endpoints"
+	ViaProxy     = "proxy"
+)
+
+// serviceSource fetches from a Service in the cluster, found through the
+// Kubernetes API rather than DNS, like: -
+//
+//	config=svc://config-api.platform:8080/v1/config
+//	config=svc+https://config-api.platform/v1/config?via=proxy
+//
+// The host is the Service name and namespace, which defaults to that of the
+// configMap, and the port can be left out when the Service only has one. By
+// default the request goes straight to one of the ready endpoints of the
+// Service, with all the usual request options. With `via=proxy` it is a GET
+// sent through the API server's service proxy instead, for when the
+// controller can't reach pods directly. Either way the egress policy is
+// checked with the name <service>.<namespace>.svc and the address dialled.
+// Services in other namespaces are only reached when the references policy
+// allows reading from them.
+type serviceSource struct {
+	kubeClient kubernetes.Interface
+	transports *transportCache
+	policy     config.ReferencePolicy
+	// next spreads fetches across the endpoints.
+	next *uint32
+}
+
+func newServiceSource(kubeClient kubernetes.Interface,
+	transports *transportCache, policy config.ReferencePolicy) serviceSource {
+
+	return serviceSource{
+		kubeClient: kubeClient,
+		transports: transports,
+		policy:     policy,
+		next:       new(uint32),
+	}
+}
+
+// serviceLocation is what a svc URL points to.
+type serviceLocation struct {
+	name      string
+	namespace string
+	port      int
+	scheme    string
+	via       string
+	path      string
+	query     url.Values
+}
+
+// host is the name the Service is checked against the egress policy with.
+func (loc serviceLocation) host() string {
+	return loc.name + "." + loc.namespace + ".svc"
+}
+
+func serviceSourceLocation(u *url.URL, namespace string) (serviceLocation, error) {
+	query := u.Query()
+	location := serviceLocation{
+		namespace: namespace,
+		scheme:    "http",
+		via:       query.Get("via"),
+		path:      u.Path,
+		query:     query,
+	}
+	query.Del("via")
+	if u.Scheme == "svc+https" {
+		location.scheme = "https"
+	}
+	if len(location.via) == 0 {
+		location.via = ViaEndpoints
+	}
+	if location.via != ViaEndpoints && location.via != ViaProxy {
+		return location, errors.New(fmt.Sprintf(
+			"via must be %s or %s but got %s", ViaEndpoints, ViaProxy, location.via))
+	}
+
+	host := strings.TrimSuffix(u.Hostname(), ".svc.cluster.local")
+	host = strings.TrimSuffix(host, ".svc")
+	parts := strings.Split(host, ".")
+	if len(parts) > 2 || len(parts[0]) == 0 {
+		return location, errors.New(fmt.Sprintf(
+			"expected svc://<service>.<namespace>:<port>/<path> but got %s", u.String()))
+	}
+	location.name = parts[0]
+	if len(parts) == 2 {
+		location.namespace = parts[1]
+	}
+	if port := u.Port(); len(port) > 0 {
+		location.port, _ = strconv.Atoi(port)
+	}
+	return location, nil
+}
+
+func (ss serviceSource) Fetch(namespace string, fRequest *FetchRequest) (*FetchResponse, error) {
+	location, err := serviceSourceLocation(fRequest.FromSite, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if err := ss.policy.Allows("service", namespace, location.namespace); err != nil {
+		return nil, err
+	}
+
+	service, err := ss.kubeClient.CoreV1().Services(location.namespace).
+		Get(location.name, v1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read service %s/%s",
+			location.namespace, location.name)
+	}
+	port, err := servicePort(service, location.port)
+	if err != nil {
+		return nil, err
+	}
+
+	if location.via == ViaProxy {
+		return ss.fetchViaProxy(namespace, fRequest, location, service, port)
+	}
+	return ss.fetchFromEndpoints(namespace, fRequest, location, port)
+}
+
+// servicePort finds the port of the Service being fetched from.
+func servicePort(service *api_v1.Service, number int) (api_v1.ServicePort, error) {
+	if number == 0 {
+		if len(service.Spec.Ports) != 1 {
+			return api_v1.ServicePort{}, errors.New(fmt.Sprintf(
+				"service %s/%s has %d ports, give the one to use",
+				service.Namespace, service.Name, len(service.Spec.Ports)))
+		}
+		return service.Spec.Ports[0], nil
+	}
+	for _, port := range service.Spec.Ports {
+		if int(port.Port) == number {
+			return port, nil
+		}
+	}
+	return api_v1.ServicePort{}, errors.New(fmt.Sprintf(
+		"service %s/%s has no port %d", service.Namespace, service.Name, number))
+}
+
+// fetchFromEndpoints sends the request to the ready endpoints of the Service
+// that the egress policy allows, trying the next when one can't be reached.
+func (ss serviceSource) fetchFromEndpoints(namespace string,
+	fRequest *FetchRequest, location serviceLocation,
+	port api_v1.ServicePort) (*FetchResponse, error) {
+
+	endpoints, err := ss.kubeClient.CoreV1().Endpoints(location.namespace).
+		Get(location.name, v1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read endpoints of service %s/%s",
+			location.namespace, location.name)
+	}
+
+	var addresses []string
+	notReady := 0
+	var denied error
+	for _, subset := range endpoints.Subsets {
+		for _, endpointPort := range subset.Ports {
+			if endpointPort.Name != port.Name || endpointPort.Protocol == api_v1.ProtocolUDP {
+				continue
+			}
+			notReady += len(subset.NotReadyAddresses)
+			for _, address := range subset.Addresses {
+				err := ss.transports.policy.Check(namespace, location.host(),
+					net.ParseIP(address.IP))
+				if err != nil {
+					denied = err
+					continue
+				}
+				addresses = append(addresses, net.JoinHostPort(address.IP,
+					strconv.Itoa(int(endpointPort.Port))))
+			}
+		}
+	}
+	if len(addresses) == 0 {
+		if denied != nil {
+			return nil, denied
+		}
+		return nil, errors.New(fmt.Sprintf(
+			"service %s/%s has no ready endpoints for port %d, %d not ready",
+			location.namespace, location.name, port.Port, notReady))
+	}
+
+	base, err := ss.transports.client(namespace, fRequest.TLSProfile)
+	if err != nil {
+		return nil, err
+	}
+	serviceAddress := net.JoinHostPort(location.host(), strconv.Itoa(int(port.Port)))
+
+	request := *fRequest
+	request.FromSite = &url.URL{
+		Scheme:   location.scheme,
+		Host:     serviceAddress,
+		Path:     location.path,
+		RawQuery: location.query.Encode(),
+	}
+	request.client = ss.endpointClient(base, serviceAddress, addresses)
+	return fetchSiteData(&request)
+}
+
+// endpointClient is base with dials to serviceAddress sent to the endpoints
+// instead, starting with the next one along. The service name is kept in
+// the request so that TLS is verified against it.
+func (ss serviceSource) endpointClient(base *http.Client, serviceAddress string,
+	addresses []string) *http.Client {
+
+	transport := base.Transport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DisableKeepAlives = true
+
+	baseDial := transport.DialContext
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	start := int(atomic.AddUint32(ss.next, 1))
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address != serviceAddress {
+			return baseDial(ctx, network, address)
+		}
+		var lastErr error
+		for i := range addresses {
+			conn, err := dialer.DialContext(ctx, network,
+				addresses[(start+i)%len(addresses)])
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}
+
+	return &http.Client{
+		Timeout:       base.Timeout,
+		Transport:     transport,
+		CheckRedirect: base.CheckRedirect,
+	}
+}
+
+// fetchViaProxy sends a GET through the API server's service proxy. Only the
+// path and query of the entry are sent, the API server's credentials are
+// used rather than any auth-secret. Headless and ExternalName Services are
+// refused as there is no cluster IP to check against the egress policy.
+func (ss serviceSource) fetchViaProxy(namespace string, fRequest *FetchRequest,
+	location serviceLocation, service *api_v1.Service,
+	port api_v1.ServicePort) (*FetchResponse, error) {
+
+	if fRequest.method() != http.MethodGet || len(fRequest.body) > 0 ||
+		len(fRequest.Header) > 0 {
+		return nil, errors.New("via=proxy can only send a GET without headers or a body")
+	}
+	clusterIP := net.ParseIP(service.Spec.ClusterIP)
+	if service.Spec.Type == api_v1.ServiceTypeExternalName || clusterIP == nil {
+		return nil, errors.New(fmt.Sprintf(
+			"service %s/%s has no cluster IP to reach through the proxy",
+			location.namespace, location.name))
+	}
+	if err := ss.transports.policy.Check(namespace, location.host(),
+		clusterIP); err != nil {
+		return nil, err
+	}
+
+	params := make(map[string]string)
+	for name := range location.query {
+		params[name] = location.query.Get(name)
+	}
+	portName := port.Name
+	if len(portName) == 0 {
+		portName = strconv.Itoa(int(port.Port))
+	}
+
+	content, err := ss.kubeClient.CoreV1().Services(location.namespace).
+		ProxyGet(location.scheme, location.name, portName, location.path, params).
+		DoRaw()
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to fetch through the proxy to %s/%s",
+			location.namespace, location.name)
+	}
+
+	return &FetchResponse{
+		Key:    fRequest.IntoKey,
+		Value:  string(content),
+		Header: http.Header{},
+	}, nil
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	restclient "k8s.io/client-go/rest"
+	k8s_testing "k8s.io/client-go/testing"
+
+	"github.com/JonPulfer/gofiggy/pkg/egress"
+)
+
+// proxyResponse is what the fake clientset gives back for a proxied GET.
+type proxyResponse string
+
+func (pr proxyResponse) DoRaw() ([]byte, error) {
+	return []byte(pr), nil
+}
+
+func (pr proxyResponse) Stream() (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(string(pr))), nil
+}
+
+// createService adds a Service with a single port along with its Endpoints.
+func createService(kubeClient *fake.Clientset, name string,
+	ready []string, notReady []string, port int32) {
+
+	kubeClient.CoreV1().Services("platform").Create(&api_v1.Service{
+		ObjectMeta: v1.ObjectMeta{Namespace: "platform", Name: name},
+		Spec: api_v1.ServiceSpec{
+			ClusterIP: "10.96.0.20",
+			Ports:     []api_v1.ServicePort{{Name: "http", Port: 8080}},
+		},
+	})
+
+	subset := api_v1.EndpointSubset{
+		Ports: []api_v1.EndpointPort{{Name: "http", Port: port}},
+	}
+	for _, ip := range ready {
+		subset.Addresses = append(subset.Addresses, api_v1.EndpointAddress{IP: ip})
+	}
+	for _, ip := range notReady {
+		subset.NotReadyAddresses = append(subset.NotReadyAddresses,
+			api_v1.EndpointAddress{IP: ip})
+	}
+	kubeClient.CoreV1().Endpoints("platform").Create(&api_v1.Endpoints{
+		ObjectMeta: v1.ObjectMeta{Namespace: "platform", Name: name},
+		Subsets:    []api_v1.EndpointSubset{subset},
+	})
+}
+
+func TestFetchFromService(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s?%s", r.Host, r.URL.Path, r.URL.RawQuery)
+		}))
+	defer server.Close()
+	_, rawPort, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	port, _ := strconv.Atoi(rawPort)
+
+	kubeClient := newFakeClientset()
+	createService(kubeClient, "config-api", []string{"127.0.0.1"}, nil, int32(port))
+	createService(kubeClient, "starting", nil, []string{"127.0.0.1"}, int32(port))
+	createService(kubeClient, "elsewhere", []string{"10.1.2.3"}, nil, int32(port))
+	kubeClient.AddProxyReactor("services", func(action k8s_testing.Action) (
+		bool, restclient.ResponseWrapper, error) {
+
+		proxy := action.(k8s_testing.ProxyGetAction)
+		return true, proxyResponse(fmt.Sprintf("proxied %s %s %s",
+			proxy.GetName(), proxy.GetPort(), proxy.GetPath())), nil
+	})
+
+	kubeClient.CoreV1().Services("platform").Create(&api_v1.Service{
+		ObjectMeta: v1.ObjectMeta{Namespace: "platform", Name: "headless"},
+		Spec: api_v1.ServiceSpec{
+			ClusterIP: api_v1.ClusterIPNone,
+			Ports:     []api_v1.ServicePort{{Name: "http", Port: 8080}},
+		},
+	})
+	kubeClient.CoreV1().Services("platform").Create(&api_v1.Service{
+		ObjectMeta: v1.ObjectMeta{Namespace: "platform", Name: "external"},
+		Spec: api_v1.ServiceSpec{
+			Type:         api_v1.ServiceTypeExternalName,
+			ExternalName: "metadata.google.internal",
+			Ports:        []api_v1.ServicePort{{Name: "http", Port: 80}},
+		},
+	})
+
+	cfg := testConfig()
+	wfh := newWebsiteFetchHandler(kubeClient, cfg)
+	fetch := func(entry string) (*FetchResponse, error) {
+		fRequest, err := parseAnnotationData(entry)
+		if err != nil {
+			t.Logf("error parsing %s: %s", entry, err.Error())
+			t.FailNow()
+		}
+		return wfh.fetchEntry("default", fRequest, &api_v1.ConfigMap{})
+	}
+
+	// Services in another namespace need the references policy to allow it.
+	_, err := fetch("config=svc://config-api.platform:8080/v1/config")
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Logf("expected the other namespace to be refused, got %v", err)
+		t.FailNow()
+	}
+	cfg.References.Namespaces = map[string][]string{"default": {"platform"}}
+	wfh = newWebsiteFetchHandler(kubeClient, cfg)
+
+	fResp, err := fetch("config=svc://config-api.platform:8080/v1/config?env=prod")
+	if err != nil || fResp.Value != "config-api.platform.svc:8080 /v1/config?env=prod" {
+		t.Logf("unexpected response %v: %v", fResp, err)
+		t.FailNow()
+	}
+
+	_, err = fetch("config=svc://starting.platform/v1/config")
+	if err == nil || !strings.Contains(err.Error(), "no ready endpoints") {
+		t.Logf("expected an error about no ready endpoints, got %v", err)
+		t.FailNow()
+	}
+
+	_, err = fetch("config=svc://elsewhere.platform/v1/config")
+	if _, denied := egress.AsDenied(err); !denied {
+		t.Logf("expected the endpoint to be denied, got %v", err)
+		t.FailNow()
+	}
+
+	_, err = fetch("config=svc://config-api.platform/v1/config?via=proxy")
+	if _, denied := egress.AsDenied(err); !denied {
+		t.Logf("expected the cluster IP to be denied, got %v", err)
+		t.FailNow()
+	}
+
+	// Allowing services by name isn't enough for their private cluster IP,
+	// which has to be allowed by address as well.
+	cfg.Egress.Allow = append(cfg.Egress.Allow, "*.platform.svc")
+	wfh = newWebsiteFetchHandler(kubeClient, cfg)
+	_, err = fetch("config=svc://config-api.platform/v1/config?via=proxy")
+	if _, denied := egress.AsDenied(err); !denied {
+		t.Logf("expected the cluster IP to still be denied, got %v", err)
+		t.FailNow()
+	}
+	cfg.Egress.Allow = append(cfg.Egress.Allow, "10.96.0.0/12")
+	wfh = newWebsiteFetchHandler(kubeClient, cfg)
+	fResp, err = fetch("config=svc://config-api.platform/v1/config?via=proxy")
+	if err != nil || fResp.Value != "proxied config-api http /v1/config" {
+		t.Logf("unexpected proxied response %v: %v", fResp, err)
+		t.FailNow()
+	}
+
+	// Without a cluster IP there is nothing to check the policy against.
+	for _, name := range []string{"headless", "external"} {
+		_, err = fetch("config=svc://" + name + ".platform/v1/config?via=proxy")
+		if err == nil || !strings.Contains(err.Error(), "no cluster IP") {
+			t.Logf("expected %s to be refused, got %v", name, err)
+			t.FailNow()
+		}
+	}
+}
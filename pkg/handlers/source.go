@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/JonPulfer/gofiggy/pkg/config"
+)
+
+// Source fetches the content for an entry from wherever its URL points. The
+// Source is chosen by the scheme of the URL.
+type Source interface {
+	Fetch(namespace string, fRequest *FetchRequest) (*FetchResponse, error)
+}
+
+// newSources registers the Source for each scheme entries can use.
+func newSources(kubeClient kubernetes.Interface, cfg config.Config,
+	transports *transportCache) map[string]Source {
+
+	web := httpSource{transports: transports}
+	objects := objectSource{kubeClient: kubeClient, policy: cfg.References,
+		watching: cfg.WatchNamespace()}
+	git := newGitSource(cfg.Git, transports.policy)
+	services := newServiceSource(kubeClient, transports, cfg.References)
+	return map[string]Source{
+		"http":      web,
+		"https":     web,
+		"configmap": objects,
+		"secret":    objects,
+		"git+https": git,
+		"git+http":  git,
+		"git+ssh":   git,
+		"git+file":  git,
+		"s3":        newS3Source(cfg.S3, transports),
+		"oci":       newOCISource(cfg.OCI, transports),
+		"vault":     newVaultSource(cfg.Vault, transports),
+		"svc":       services,
+		"svc+https": services,
+	}
+}
+
+// revisionSource is implemented by sources that can report the revision of
+// their content without fetching all of it. They are polled for changes.
+type revisionSource interface {
+	Revision(namespace string, fRequest *FetchRequest) (string, error)
+}
+
+// source returns the Source for the scheme of u.
+func (wfh WebsiteFetchHandler) source(u *url.URL) (Source, error) {
+	source, ok := wfh.sources[u.Scheme]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unsupported scheme %s", u.Scheme))
+	}
+	return source, nil
+}
+
+// httpSource fetches sites over http and https using the client for the
+// namespace and TLS profile of the entry.
+type httpSource struct {
+	transports *transportCache
+}
+
+func (hs httpSource) Fetch(namespace string, fRequest *FetchRequest) (*FetchResponse, error) {
+	cl, err := hs.transports.client(namespace, fRequest.TLSProfile)
+	if err != nil {
+		return nil, err
+	}
+	fRequest.client = cl
+
+	return fetchSiteData(fRequest)
+}
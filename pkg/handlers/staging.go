@@ -0,0 +1,277 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	api_v1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// StagingOfLabel holds the UID of the configMap a staging configMap holds
+// candidates for. Entries with `stage=true`, `schema-key` or `max-change`
+// are written to a configMap named after the annotated one with a -staging
+// suffix first, and only go live once they pass validateStaged, like: -
+//
+//	app.json=config.example.com/app.json schema-key=app.schema.json max-change=0.2
+//
+// An entry that fails keeps its last good value and raises a Warning event.
+const StagingOfLabel = "x-k8s.io/curl-me-that-staging-of"
+
+// staged reports whether the entry is checked before it goes live.
+func (fr FetchRequest) staged() bool {
+	return fr.Stage || len(fr.SchemaKey) > 0 || fr.MaxChange > 0
+}
+
+// isDocument reports whether the entry writes what it fetched to its key as
+// a whole, rather than keys taken from it or rendered by a template.
+func (fr FetchRequest) isDocument() bool {
+	return len(fr.Extract) == 0 && !fr.Flatten && len(fr.Archive.Format) == 0 &&
+		len(fr.Template) == 0 && len(fr.TemplateKey) == 0
+}
+
+// declaredFormat is the format the value of the entry should parse as, if
+// it names one.
+func (fr FetchRequest) declaredFormat() string {
+	if len(fr.Format) > 0 {
+		return fr.Format
+	}
+	return fr.InputFormat
+}
+
+// stagingName is the name of the configMap holding the candidates staged for
+// source.
+func stagingName(source string) string {
+	return suffixedName(source, "-staging")
+}
+
+// validateStaged checks what a staged entry fetched before it goes live: -
+//
+//	every value is non-empty
+//	the value parses as the format, or input format, given for the entry
+//	it passes the JSON Schema held in the schema-key of configMap
+//	no value changes more than max-change of the lines of its live value
+func validateStaged(fReq *FetchRequest, fResp *FetchResponse,
+	configMap *api_v1.ConfigMap, live map[string]string) error {
+
+	values := make(map[string]string)
+	for key, value := range fResp.Entries() {
+		values[key] = value
+	}
+	for key, value := range fResp.Sensitive {
+		values[key] = string(value)
+	}
+	if len(values)+len(fResp.BinaryData) == 0 {
+		return errors.New("nothing was fetched")
+	}
+	for _, key := range sortedStringKeys(values) {
+		if len(strings.TrimSpace(values[key])) == 0 {
+			return errors.New(fmt.Sprintf("%s is empty", key))
+		}
+	}
+	for key, value := range fResp.BinaryData {
+		if len(value) == 0 {
+			return errors.New(fmt.Sprintf("%s is empty", key))
+		}
+	}
+
+	if format := fReq.declaredFormat(); fReq.isDocument() &&
+		(len(format) > 0 || len(fReq.SchemaKey) > 0) {
+		document, err := decodeFormat(values[fResp.Key], format,
+			fResp.Header.Get("Content-Type"))
+		if err != nil {
+			return err
+		}
+		if len(fReq.SchemaKey) > 0 {
+			raw, ok := configMap.Data[fReq.SchemaKey]
+			if !ok {
+				return errors.New(fmt.Sprintf(
+					"schema key %s not found in configMap", fReq.SchemaKey))
+			}
+			schema, err := decodeYAML(raw)
+			if err != nil {
+				return errors.Wrapf(err, "unable to decode the schema in %s",
+					fReq.SchemaKey)
+			}
+			if err := validateSchema(schema, document); err != nil {
+				return err
+			}
+		}
+	}
+
+	if fReq.MaxChange > 0 {
+		for _, key := range sortedStringKeys(values) {
+			current, ok := live[key]
+			if !ok {
+				continue
+			}
+			if ratio := changeRatio(current, values[key]); ratio > fReq.MaxChange {
+				return errors.New(fmt.Sprintf(
+					"%s changes %.0f%% of its lines, more than the %.0f%% allowed",
+					key, ratio*100, fReq.MaxChange*100))
+			}
+		}
+	}
+	return nil
+}
+
+// changeRatio is the share of lines that differ between before and after.
+func changeRatio(before string, after string) float64 {
+	beforeLines := strings.Split(before, "\n")
+	afterLines := strings.Split(after, "\n")
+	remaining := make(map[string]int)
+	for _, line := range beforeLines {
+		remaining[line]++
+	}
+	kept := 0
+	for _, line := range afterLines {
+		if remaining[line] > 0 {
+			remaining[line]--
+			kept++
+		}
+	}
+
+	total := len(beforeLines)
+	if len(afterLines) > total {
+		total = len(afterLines)
+	}
+	return float64(total-kept) / float64(total)
+}
+
+// liveData returns what is currently written for configMap, which is where
+// staged values are compared with.
+func (wfh WebsiteFetchHandler) liveData(configMap *api_v1.ConfigMap,
+	t *target) (map[string]string, error) {
+
+	core := wfh.clientset.CoreV1()
+	name := configMap.Annotations[CurrentVersionAnnotation]
+	switch {
+	case t != nil && t.Kind == "secret":
+		secret, err := core.Secrets(configMap.Namespace).Get(t.Name, v1.GetOptions{})
+		if k8s_errors.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read target secret %s", t.Name)
+		}
+		return secretContent(secret.Data), nil
+	case t != nil:
+		name = t.Name
+	case len(name) == 0:
+		return configMap.Data, nil
+	}
+
+	written, err := core.ConfigMaps(configMap.Namespace).Get(name, v1.GetOptions{})
+	if k8s_errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read configMap %s", name)
+	}
+	return written.Data, nil
+}
+
+// staging gathers the candidates fetched by staged entries along with the
+// outcome of validating them.
+type staging struct {
+	data   map[string]string
+	status map[string]EntryStatus
+}
+
+func newStaging() staging {
+	return staging{
+		data:   make(map[string]string),
+		status: make(map[string]EntryStatus),
+	}
+}
+
+// add validates what a staged entry fetched and records it as a candidate.
+// Sensitive values are validated but are never written to the staging
+// configMap, nor are the reasons they fail.
+func (s staging) add(fReq *FetchRequest, fResp *FetchResponse,
+	configMap *api_v1.ConfigMap, live map[string]string) error {
+
+	err := validateStaged(fReq, fResp, configMap, live)
+	entry := EntryStatus{State: StatePromoted}
+	if err != nil {
+		if fReq.mayBeSensitive() {
+			err = errSensitiveFailure
+		}
+		entry = EntryStatus{State: StateRejected, Message: err.Error()}
+	}
+	s.status[fReq.IntoKey] = entry
+
+	if !fReq.mayBeSensitive() {
+		for key, value := range fResp.Entries() {
+			s.data[key] = value
+		}
+		for key, value := range fResp.BinaryData {
+			s.data[key] = base64.StdEncoding.EncodeToString(value)
+		}
+	}
+	return err
+}
+
+// isStaging reports whether configMap holds the candidates staged for source.
+func isStaging(configMap *api_v1.ConfigMap, source *api_v1.ConfigMap) bool {
+	_, labelled := configMap.Labels[StagingOfLabel]
+	return labelled && ownedBy(configMap.ObjectMeta, source)
+}
+
+// writeStaging writes the candidates staged for source to its staging
+// configMap, removing that once no entry is staged.
+func (wfh WebsiteFetchHandler) writeStaging(source *api_v1.ConfigMap, s staging) error {
+	configMaps := wfh.clientset.CoreV1().ConfigMaps(source.Namespace)
+	name := stagingName(source.Name)
+	existing, err := configMaps.Get(name, v1.GetOptions{})
+	switch {
+	case k8s_errors.IsNotFound(err):
+		if len(s.status) == 0 {
+			return nil
+		}
+		existing = nil
+	case err != nil:
+		return errors.Wrapf(err, "unable to read staging configMap %s", name)
+	case !isStaging(existing, source):
+		if len(s.status) == 0 {
+			return nil
+		}
+		return errors.New(fmt.Sprintf(
+			"staging configMap %s already exists and is not owned by %s",
+			name, source.Name))
+	case len(s.status) == 0:
+		if err := configMaps.Delete(name, nil); err != nil && !k8s_errors.IsNotFound(err) {
+			return errors.Wrapf(err, "unable to delete staging configMap %s", name)
+		}
+		return nil
+	}
+
+	staged := &api_v1.ConfigMap{ObjectMeta: v1.ObjectMeta{
+		Namespace:       source.Namespace,
+		Name:            name,
+		Labels:          map[string]string{StagingOfLabel: string(source.UID)},
+		Annotations:     map[string]string{},
+		OwnerReferences: []v1.OwnerReference{ownerReference(source)},
+	}}
+	if existing != nil {
+		staged = existing.DeepCopy()
+	}
+	if staged.Annotations == nil {
+		staged.Annotations = make(map[string]string)
+	}
+	staged.Data = s.data
+	writeStatus(staged, ConfigMapStatus{Entries: s.status})
+
+	if existing == nil {
+		_, err = configMaps.Create(staged)
+	} else {
+		_, err = patchConfigMap(wfh.clientset, existing, staged)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to write staging configMap %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testSchema = `
+type: object
+required: [replicas]
+properties:
+  replicas: {type: integer, minimum: 1}
+  log:
+    type: object
+    properties:
+      level: {enum: [debug, info, warn]}
+  hosts: {type: array, items: {type: string, pattern: "^[a-z.]+$"}}
+additionalProperties: false
+`
+
+func TestValidateSchema(t *testing.T) {
+	schema, err := decodeYAML(testSchema)
+	if err != nil {
+		t.Logf("error decoding schema: %s", err.Error())
+		t.FailNow()
+	}
+
+	for document, expected := range map[string]string{
+		`{"replicas": 2, "log": {"level": "info"}, "hosts": ["db.local"]}`: "",
+		`{"log": {"level": "info"}}`:                                       "$.replicas is required",
+		`{"replicas": 0}`:                                                  "$.replicas should be at least 1",
+		`{"replicas": 1.5}`:                                                "$.replicas should be integer but is number",
+		`{"replicas": 1, "log": {"level": "trace"}}`:                       "$.log.level should be one of [debug info warn]",
+		`{"replicas": 1, "hosts": ["db.local", "DB"]}`:                     "$.hosts[1] should match ^[a-z.]+$",
+		`{"replicas": 1, "extra": true}`:                                   "$.extra is not allowed",
+	} {
+		decoded, _ := decodeJSON(document)
+		err := validateSchema(schema, decoded)
+		if (err == nil && len(expected) > 0) || (err != nil && err.Error() != expected) {
+			t.Logf("expected %q for %s but got %v", expected, document, err)
+			t.FailNow()
+		}
+	}
+}
+
+func TestChangeRatio(t *testing.T) {
+	if ratio := changeRatio("a\nb\nc\nd", "a\nb\nc\ne"); ratio != 0.25 {
+		t.Logf("expected a quarter of the lines to change but got %v", ratio)
+		t.FailNow()
+	}
+	if ratio := changeRatio("a\nb", "a\nb"); ratio != 0 {
+		t.Logf("expected no change but got %v", ratio)
+		t.FailNow()
+	}
+}
+
+func TestProcessConfigMapStagesEntries(t *testing.T) {
+	content := "replicas: 2\nlog:\n  level: info\n"
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, content)
+		}))
+	defer server.Close()
+
+	kubeClient := newFakeClientset(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: "default",
+			Name:      "app",
+			Annotations: map[string]string{CurlAnnotation: "app.yaml=" + server.URL +
+				" input=yaml schema-key=schema.yaml max-change=0.3"},
+		},
+		Data: map[string]string{"schema.yaml": testSchema},
+	})
+
+	wfh := newWebsiteFetchHandler(kubeClient, testConfig())
+	process := func() (*api_v1.ConfigMap, error) {
+		configMap, _ := fetchConfigMap(kubeClient, "default", "app")
+		err := wfh.processConfigMap("default", configMap)
+		configMap, _ = fetchConfigMap(kubeClient, "default", "app")
+		return configMap, err
+	}
+	expectRejected := func(message string) {
+		configMap, err := process()
+		entry := readStatus(configMap).Entries["app.yaml"]
+		if err == nil || entry.State != StateRejected || entry.Message != message ||
+			configMap.Data["app.yaml"] != "replicas: 2\nlog:\n  level: info\n" {
+			t.Logf("expected %q to be rejected keeping the last good value: %+v %q",
+				message, entry, configMap.Data["app.yaml"])
+			t.FailNow()
+		}
+	}
+
+	if configMap, err := process(); err != nil || configMap.Data["app.yaml"] != content {
+		t.Logf("expected valid content to be promoted: %v %v", err, configMap.Data)
+		t.FailNow()
+	}
+	staged, err := fetchConfigMap(kubeClient, "default", stagingName("app"))
+	if err != nil || staged.Data["app.yaml"] != content ||
+		readStatus(staged).Entries["app.yaml"].State != StatePromoted {
+		t.Logf("expected the candidate to be staged: %v", staged)
+		t.FailNow()
+	}
+
+	content = "replicas: 0\nlog:\n  level: info\n"
+	expectRejected("$.replicas should be at least 1")
+	content = "replicas: [\n"
+	expectRejected("unable to decode yaml: yaml: line 1: did not find expected node content")
+	content = " \n"
+	expectRejected("app.yaml is empty")
+	content = "replicas: 3\nlog:\n  level: warn\n"
+	expectRejected("app.yaml changes 50% of its lines, more than the 30% allowed")
+
+	staged, _ = fetchConfigMap(kubeClient, "default", stagingName("app"))
+	if staged.Data["app.yaml"] != content {
+		t.Logf("expected the rejected candidate to be kept for a look: %v", staged.Data)
+		t.FailNow()
+	}
+
+	// Staging is removed along with the entries that use it.
+	configMap, _ := fetchConfigMap(kubeClient, "default", "app")
+	configMap.Annotations[CurlAnnotation] = "app.yaml=" + server.URL
+	kubeClient.CoreV1().ConfigMaps("default").Update(configMap)
+	if _, err := process(); err != nil {
+		t.Logf("error processConfigMap: %s", err.Error())
+		t.FailNow()
+	}
+	if _, err := fetchConfigMap(kubeClient, "default", stagingName("app")); err == nil {
+		t.Log("expected the staging configMap to be removed")
+		t.FailNow()
+	}
+}
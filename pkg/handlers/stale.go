@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	api_v1 "k8s.io/api/core/v1"
+
+	"github.com/JonPulfer/gofiggy/pkg/metrics"
+)
+
+// While an entry is failing the last good value it wrote is kept, and the
+// entry is marked stale in the status. The max-staleness option puts a
+// deadline on that, like: -
+//
+//	flags=flags.example.com/flags.json max-staleness=1h
+//	flags=flags.example.com/flags.json max-staleness=1h fallback={}
+//
+// Once the entry has been stale for longer its keys are cleared, or hold the
+// fallback when one is given, until a fetch succeeds again.
+var (
+	staleEntries = metrics.NewGauge("gofiggy_entry_stale",
+		"Whether an entry is keeping its last good value while it fails.",
+		"namespace", "configmap", "entry")
+	staleSince = metrics.NewGauge("gofiggy_entry_stale_since_timestamp_seconds",
+		"When a stale entry first failed, in seconds since the epoch.",
+		"namespace", "configmap", "entry")
+	staleAge = metrics.NewGauge("gofiggy_entry_stale_age_seconds",
+		"How long a stale entry had been failing when it was last fetched.",
+		"namespace", "configmap", "entry")
+)
+
+// expiries queue configMaps to be processed again once a stale entry reaches
+// its max-staleness, as nothing else may process them before then.
+type expiries struct {
+	after func(time.Duration, func())
+
+	mu *sync.Mutex
+	// scheduled are the deadlines queued for, keyed by namespace/name.
+	scheduled map[string]time.Time
+}
+
+func newExpiries() *expiries {
+	return &expiries{
+		after: func(wait time.Duration, f func()) {
+			time.AfterFunc(wait, f)
+		},
+		mu:        &sync.Mutex{},
+		scheduled: make(map[string]time.Time),
+	}
+}
+
+// expireAt queues configMap to be processed again at deadline, unless it
+// already will be by then.
+func (wfh WebsiteFetchHandler) expireAt(configMap *api_v1.ConfigMap,
+	deadline time.Time) {
+
+	e := wfh.expiries
+	key := configMap.Namespace + "/" + configMap.Name
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if scheduled, ok := e.scheduled[key]; ok && !scheduled.After(deadline) {
+		return
+	}
+	e.scheduled[key] = deadline
+	e.after(time.Until(deadline), func() {
+		e.mu.Lock()
+		if e.scheduled[key].Equal(deadline) {
+			delete(e.scheduled, key)
+		}
+		e.mu.Unlock()
+
+		wfh.logger.Log().Str("configMap", key).
+			Msg("queueing configMap with a stale entry to expire")
+		wfh.caches.queue.Enqueue(key)
+	})
+}
+
+// keepLastGood marks fReq stale in status when it had a good value before
+// failing this time, reporting whether its last value should be kept. Once
+// it has been stale for longer than its max-staleness the fallback is put in
+// results instead, or nothing when it has none so that its keys are cleared.
+// Until then the configMap is queued to be processed again when it is due to
+// expire. An entry that never had a good value has nothing to mark, and keeps
+// whatever it had.
+func (wfh WebsiteFetchHandler) keepLastGood(configMap *api_v1.ConfigMap,
+	fReq *FetchRequest, status ConfigMapStatus, previous ConfigMapStatus,
+	results fetchResults) bool {
+
+	entry := status.Entries[fReq.IntoKey]
+	last := previous.Entries[fReq.IntoKey]
+	// StaleSince is recorded to the second.
+	since := time.Now().Truncate(time.Second)
+	switch {
+	case last.Stale:
+		if parsed, err := time.Parse(time.RFC3339, last.StaleSince); err == nil {
+			since = parsed
+		}
+	case last.State != StateSynced:
+		return true
+	}
+
+	age := time.Since(since)
+	entry.Stale = true
+	entry.StaleSince = since.UTC().Format(time.RFC3339)
+	entry.Expired = fReq.MaxStaleness > 0 && age > fReq.MaxStaleness
+	status.Entries[fReq.IntoKey] = entry
+	if !entry.Expired {
+		if fReq.MaxStaleness > 0 {
+			wfh.expireAt(configMap, since.Add(fReq.MaxStaleness))
+		}
+		return true
+	}
+
+	if !last.Expired {
+		action := "clearing it"
+		if fReq.Fallback != nil {
+			action = "writing its fallback"
+		}
+		wfh.recorder.Warning(configMap, "StaleValueExpired", fmt.Sprintf(
+			"%s has been stale since %s, longer than %s, %s", fReq.IntoKey,
+			entry.StaleSince, fReq.MaxStaleness, action))
+	}
+	if fReq.Fallback != nil {
+		fResp := &FetchResponse{Key: fReq.IntoKey, Value: *fReq.Fallback}
+		if fReq.Sensitive {
+			markSensitive(fResp)
+		}
+		results.add(fReq, fResp)
+	}
+	return false
+}
+
+// recordStaleness sets the staleness metrics of each entry of configMap
+// from its status.
+func recordStaleness(configMap *api_v1.ConfigMap, status ConfigMapStatus) {
+	forgetStaleness(configMap.Namespace, configMap.Name)
+	for key, entry := range status.Entries {
+		stale := 0.0
+		if entry.Stale {
+			stale = 1
+			if since, err := time.Parse(time.RFC3339, entry.StaleSince); err == nil {
+				staleSince.Set(float64(since.Unix()),
+					configMap.Namespace, configMap.Name, key)
+				staleAge.Set(time.Since(since).Seconds(),
+					configMap.Namespace, configMap.Name, key)
+			}
+		}
+		staleEntries.Set(stale, configMap.Namespace, configMap.Name, key)
+	}
+}
+
+// forgetStaleness removes the staleness metrics of a configMap that is no
+// longer fetched for.
+func forgetStaleness(namespace string, name string) {
+	staleEntries.DeleteMatching(namespace, name)
+	staleSince.DeleteMatching(namespace, name)
+	staleAge.DeleteMatching(namespace, name)
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/JonPulfer/gofiggy/pkg/events"
+)
+
+func TestProcessConfigMapKeepsLastGoodValue(t *testing.T) {
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if failing {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			fmt.Fprint(w, r.URL.Path)
+		}))
+	defer server.Close()
+
+	kubeClient := newFakeClientset(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: "default",
+			Name:      "stale",
+			Annotations: map[string]string{CurlAnnotation: "flags=" + server.URL + "/flags" +
+				" max-staleness=1h fallback={}\n" +
+				"hosts=" + server.URL + "/hosts max-staleness=1h\n" +
+				"banner=" + server.URL + "/banner"},
+		},
+	})
+
+	wfh := newWebsiteFetchHandler(kubeClient, testConfig())
+	process := func() *api_v1.ConfigMap {
+		configMap, _ := fetchConfigMap(kubeClient, "default", "stale")
+		wfh.processConfigMap("default", configMap)
+		configMap, _ = fetchConfigMap(kubeClient, "default", "stale")
+		return configMap
+	}
+
+	process()
+	failing = true
+	configMap := process()
+	entry := readStatus(configMap).Entries["flags"]
+	if configMap.Data["flags"] != "/flags" || !entry.Stale || entry.State != StateFailed ||
+		len(entry.StaleSince) == 0 || entry.Expired {
+		t.Logf("expected the last good value to be kept and marked stale: %+v %v",
+			entry, configMap.Data)
+		t.FailNow()
+	}
+	if stale, _ := staleEntries.Value("default", "stale", "flags"); stale != 1 {
+		t.Logf("expected flags to be reported stale: %v", stale)
+		t.FailNow()
+	}
+	if _, ok := staleSince.Value("default", "stale", "flags"); !ok {
+		t.Log("expected when flags went stale to be reported")
+		t.FailNow()
+	}
+
+	// Past max-staleness the fallback is written, or the key cleared.
+	status := readStatus(configMap)
+	for key, entry := range status.Entries {
+		entry.StaleSince = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+		status.Entries[key] = entry
+	}
+	writeStatus(configMap, status)
+	kubeClient.CoreV1().ConfigMaps("default").Update(configMap)
+	configMap = process()
+	if configMap.Data["flags"] != "{}" || configMap.Data["banner"] != "/banner" {
+		t.Logf("expected the fallback for flags and banner to be kept: %v", configMap.Data)
+		t.FailNow()
+	}
+	if _, ok := configMap.Data["hosts"]; ok {
+		t.Logf("expected hosts to be cleared: %v", configMap.Data)
+		t.FailNow()
+	}
+	if entry := readStatus(configMap).Entries["hosts"]; !entry.Expired {
+		t.Logf("expected hosts to have expired: %+v", entry)
+		t.FailNow()
+	}
+	if age, _ := staleAge.Value("default", "stale", "hosts"); age < 7200 {
+		t.Logf("expected hosts to be reported stale for two hours: %v", age)
+		t.FailNow()
+	}
+	if entry := readStatus(configMap).Entries["banner"]; entry.Expired || !entry.Stale {
+		t.Logf("expected banner without max-staleness to stay stale: %+v", entry)
+		t.FailNow()
+	}
+
+	// A good fetch is no longer stale.
+	failing = false
+	configMap = process()
+	entry = readStatus(configMap).Entries["flags"]
+	if configMap.Data["flags"] != "/flags" || configMap.Data["hosts"] != "/hosts" ||
+		entry.Stale || len(entry.StaleSince) > 0 {
+		t.Logf("expected fresh values: %+v %v", entry, configMap.Data)
+		t.FailNow()
+	}
+	if stale, _ := staleEntries.Value("default", "stale", "flags"); stale != 0 {
+		t.Logf("expected flags to no longer be reported stale: %v", stale)
+		t.FailNow()
+	}
+	if _, ok := staleSince.Value("default", "stale", "flags"); ok {
+		t.Log("expected when flags went stale to be forgotten")
+		t.FailNow()
+	}
+}
+
+func TestStaleEntriesAreQueuedToExpire(t *testing.T) {
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if failing {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			fmt.Fprint(w, r.URL.Path)
+		}))
+	defer server.Close()
+
+	kubeClient := newFakeClientset(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: "default",
+			Name:      "expiring",
+			Annotations: map[string]string{CurlAnnotation: "flags=" + server.URL +
+				"/flags max-staleness=1h fallback={}"},
+		},
+	})
+
+	wfh := newWebsiteFetchHandler(kubeClient, testConfig())
+	handleQueued(wfh)
+	var waits []time.Duration
+	var scheduled []func()
+	wfh.expiries.after = func(wait time.Duration, f func()) {
+		waits = append(waits, wait)
+		scheduled = append(scheduled, f)
+	}
+	process := func() {
+		wfh.ObjectUpdated(nil, events.Event{Kind: "configmap", Name: "default/expiring"})
+	}
+
+	process()
+	failing = true
+	process()
+	process()
+	if len(scheduled) != 1 || waits[0] <= 59*time.Minute || waits[0] > time.Hour {
+		t.Logf("expected a single requeue in an hour: %v", waits)
+		t.FailNow()
+	}
+
+	// Nothing else processes the configMap before the deadline passes.
+	configMap, _ := fetchConfigMap(kubeClient, "default", "expiring")
+	status := readStatus(configMap)
+	entry := status.Entries["flags"]
+	entry.StaleSince = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	status.Entries["flags"] = entry
+	writeStatus(configMap, status)
+	kubeClient.CoreV1().ConfigMaps("default").Update(configMap)
+	scheduled[0]()
+
+	configMap, _ = fetchConfigMap(kubeClient, "default", "expiring")
+	if configMap.Data["flags"] != "{}" || !readStatus(configMap).Entries["flags"].Expired {
+		t.Logf("expected the requeue to expire flags: %v", configMap.Data)
+		t.FailNow()
+	}
+	if age, _ := staleAge.Value("default", "expiring", "flags"); age < 7200 {
+		t.Logf("expected the requeue to update the stale age: %v", age)
+		t.FailNow()
+	}
+	if len(scheduled) != 1 || len(wfh.expiries.scheduled) != 0 {
+		t.Logf("expected nothing more to be scheduled once expired: %v", waits)
+		t.FailNow()
+	}
+}
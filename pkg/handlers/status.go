@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+
+	api_v1 "k8s.io/api/core/v1"
+)
+
+// StatusAnnotation is where we report the outcome of processing each entry in
+// the CurlAnnotation back onto the configMap.
+const StatusAnnotation = "x-k8s.io/curl-me-that-status"
+
+const (
+	StateSynced = "Synced"
+	StateFailed = "Failed"
+	StateDenied = "Denied"
+	// StateRejected is a staged entry that failed validation, its last good
+	// value is kept. StatePromoted is one that passed and went live.
+	StateRejected = "Rejected"
+	StatePromoted = "Promoted"
+)
+
+// ConfigMapStatus is stored as JSON in the StatusAnnotation. Error is set when
+// the annotation itself could not be understood, otherwise each entry reports
+// its own state keyed by the key it writes into. Drift holds the latest hand
+// edits to the keys we manage.
+type ConfigMapStatus struct {
+	Error   string                 `json:"error,omitempty"`
+	Entries map[string]EntryStatus `json:"entries,omitempty"`
+	Drift   []DriftRecord          `json:"drift,omitempty"`
+}
+
+// EntryStatus is the outcome of the last attempt to process a single entry.
+type EntryStatus struct {
+	State   string `json:"state"`
+	Message string `json:"message,omitempty"`
+	// Revision is the version of the content last written, for sources
+	// that have one.
+	Revision string `json:"revision,omitempty"`
+	// Stale is set while a failing entry keeps the last good value, which
+	// has been the case since StaleSince. Expired is set once that is longer
+	// than its max-staleness.
+	Stale      bool   `json:"stale,omitempty"`
+	StaleSince string `json:"staleSince,omitempty"`
+	Expired    bool   `json:"expired,omitempty"`
+}
+
+// readStatus returns the status previously recorded on the configMap or an
+// empty one if there isn't any.
+func readStatus(configMap *api_v1.ConfigMap) ConfigMapStatus {
+	return statusFromAnnotations(configMap.Annotations)
+}
+
+// statusFromAnnotations reads the StatusAnnotation from any object's
+// annotations.
+func statusFromAnnotations(annotations map[string]string) ConfigMapStatus {
+	var status ConfigMapStatus
+	if raw := annotations[StatusAnnotation]; len(raw) != 0 {
+		json.Unmarshal([]byte(raw), &status)
+	}
+	if status.Entries == nil {
+		status.Entries = make(map[string]EntryStatus)
+	}
+	return status
+}
+
+// writeStatus records status on the configMap and reports whether that
+// changed the annotation so callers can avoid needless updates.
+func writeStatus(configMap *api_v1.ConfigMap, status ConfigMapStatus) bool {
+	encoded, err := encodeStatus(status)
+	if err != nil {
+		return false
+	}
+
+	if configMap.Annotations[StatusAnnotation] == encoded {
+		return false
+	}
+
+	if configMap.Annotations == nil {
+		configMap.Annotations = make(map[string]string)
+	}
+	configMap.Annotations[StatusAnnotation] = encoded
+	return true
+}
+
+// encodeStatus is the value of the StatusAnnotation for status.
+func encodeStatus(status ConfigMapStatus) (string, error) {
+	encoded, err := json.Marshal(status)
+	return string(encoded), err
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// The ways a fetched value can be written into a key that already has one,
+// chosen with the `write` option, like: -
+//
+//	app.json=config.example.com/app.json write=merge
+//	hosts=hosts.example.com/extra write=append join="\n# fetched\n"
+//
+// overwrite, the default, replaces the value. only-if-absent writes the key
+// when it isn't there and leaves it as it is after. append and prepend join
+// the fetched value after or before the value the key had, with join between
+// them. merge layers the fields of a fetched JSON or YAML document over the
+// document the key had, so that it can hold defaults.
+const (
+	WriteOverwrite = "overwrite"
+	WriteIfAbsent  = "only-if-absent"
+	WriteAppend    = "append"
+	WritePrepend   = "prepend"
+	WriteMerge     = "merge"
+)
+
+// defaultJoin goes between appended and prepended values.
+const defaultJoin = "\n"
+
+// validateWriteStrategy checks the name given in the `write` option.
+func validateWriteStrategy(strategy string) error {
+	switch strategy {
+	case WriteOverwrite, WriteIfAbsent, WriteAppend, WritePrepend, WriteMerge:
+		return nil
+	}
+	return errors.New(fmt.Sprintf("unknown write strategy %s", strategy))
+}
+
+// writeStrategy returns how the entry writes its keys, overwrite unless set.
+func (fr FetchRequest) writeStrategy() string {
+	if len(fr.Write) == 0 {
+		return WriteOverwrite
+	}
+	return fr.Write
+}
+
+// joiner returns what goes between appended and prepended values.
+func (fr FetchRequest) joiner() string {
+	if fr.Join == nil {
+		return defaultJoin
+	}
+	return *fr.Join
+}
+
+// layer works out the values to write for the data in the results over
+// existing, the values already in the object. The value a key had before we
+// first layered over it is recorded as its base in change, so that later
+// fetches layer over the same value rather than over what we wrote, and so
+// that it is put back when the entry goes away.
+func (fr fetchResults) layer(existing map[string]string, previous managedKeys,
+	change managedChange) (map[string]string, error) {
+
+	previousKeys, _ := previous.keys()
+	values := make(map[string]string)
+	for key, value := range fr.data {
+		fReq, ok := fr.requests[key]
+		if !ok || fReq.writeStrategy() == WriteOverwrite {
+			values[key] = value
+			continue
+		}
+
+		current, exists := existing[key]
+		base, hasBase := previous.base(key)
+		if !hasBase && exists && !previousKeys[key] {
+			base, hasBase = current, true
+		}
+
+		switch fReq.writeStrategy() {
+		case WriteIfAbsent:
+			if !exists {
+				values[key] = value
+			} else if previousKeys[key] {
+				values[key] = current
+			} else {
+				change.managed.forget(fReq.IntoKey, key)
+			}
+			continue
+		case WriteAppend:
+			if len(base) > 0 {
+				value = base + fReq.joiner() + value
+			}
+		case WritePrepend:
+			if len(base) > 0 {
+				value = value + fReq.joiner() + base
+			}
+		case WriteMerge:
+			merged, err := mergeDocuments(base, value, fReq)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to merge %s", key)
+			}
+			value = merged
+		}
+		values[key] = value
+		if hasBase {
+			change.managed.setBase(fReq.IntoKey, key, base)
+		}
+	}
+	return values, nil
+}
+
+// mergeDocuments layers the fields of the fetched document over base, both
+// JSON or YAML objects. The result is in the `format` of the entry, or in
+// the format base was written in.
+func mergeDocuments(base string, fetched string, fReq *FetchRequest) (string, error) {
+	if len(base) == 0 {
+		return fetched, nil
+	}
+
+	baseDocument, ok := decodeDocument(base, "").(map[string]interface{})
+	if !ok {
+		return "", errors.New("the existing value is not a JSON or YAML object")
+	}
+	document, err := decodeFormat(fetched, fReq.InputFormat, "")
+	if err != nil {
+		return "", err
+	}
+	fetchedDocument, ok := document.(map[string]interface{})
+	if !ok {
+		return "", errors.New("the fetched value is not a JSON or YAML object")
+	}
+
+	format := fReq.Format
+	if len(format) == 0 {
+		format = FormatYAML
+		if json.Valid([]byte(base)) {
+			format = FormatJSON
+		}
+	}
+	return encodeFormat(deepMerge(baseDocument, fetchedDocument), format,
+		fReq.Separator)
+}
+
+// deepMerge layers over onto base. Objects are merged field by field, any
+// other value in over replaces the one in base.
+func deepMerge(base map[string]interface{},
+	over map[string]interface{}) map[string]interface{} {
+
+	merged := make(map[string]interface{})
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range over {
+		overTable, overIsTable := value.(map[string]interface{})
+		baseTable, baseIsTable := merged[key].(map[string]interface{})
+		if overIsTable && baseIsTable {
+			merged[key] = deepMerge(baseTable, overTable)
+			continue
+		}
+		merged[key] = value
+	}
+	return merged
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDeepMerge(t *testing.T) {
+	merged := deepMerge(
+		map[string]interface{}{
+			"replicas": 1.0,
+			"log":      map[string]interface{}{"level": "info", "format": "json"},
+			"hosts":    []interface{}{"a", "b"},
+		},
+		map[string]interface{}{
+			"log":   map[string]interface{}{"level": "debug"},
+			"hosts": []interface{}{"c"},
+		})
+
+	log := merged["log"].(map[string]interface{})
+	if merged["replicas"] != 1.0 || log["level"] != "debug" || log["format"] != "json" ||
+		len(merged["hosts"].([]interface{})) != 1 {
+		t.Logf("unexpected merge %+v", merged)
+		t.FailNow()
+	}
+}
+
+func TestProcessConfigMapWithWriteStrategies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/app.json":
+				fmt.Fprint(w, `{"log":{"level":"debug"}}`)
+			case "/hosts":
+				fmt.Fprint(w, "10.0.0.1 db")
+			default:
+				fmt.Fprint(w, r.URL.Path)
+			}
+		}))
+	defer server.Close()
+
+	annotation := "app.json=" + server.URL + "/app.json write=merge\n" +
+		"hosts=" + server.URL + "/hosts write=append\n" +
+		"banner=" + server.URL + "/banner write=prepend join=\" - \"\n" +
+		"seed=" + server.URL + "/seed write=only-if-absent\n" +
+		"fresh=" + server.URL + "/fresh write=only-if-absent"
+	kubeClient := newFakeClientset()
+	kubeClient.CoreV1().ConfigMaps("default").Create(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "app",
+			Annotations: map[string]string{CurlAnnotation: annotation},
+		},
+		Data: map[string]string{
+			"app.json": `{"replicas":1,"log":{"level":"info","format":"json"}}`,
+			"hosts":    "127.0.0.1 localhost",
+			"banner":   "welcome",
+			"seed":     "mine",
+		},
+	})
+
+	wfh := newWebsiteFetchHandler(kubeClient, testConfig())
+	process := func() *api_v1.ConfigMap {
+		configMap, _ := fetchConfigMap(kubeClient, "default", "app")
+		if err := wfh.processConfigMap("default", configMap); err != nil {
+			t.Logf("error processConfigMap: %s", err.Error())
+			t.FailNow()
+		}
+		configMap, _ = fetchConfigMap(kubeClient, "default", "app")
+		return configMap
+	}
+
+	// Refreshing layers over the same values rather than over what we wrote.
+	process()
+	configMap := process()
+	expected := map[string]string{
+		"app.json": "{\n  \"log\": {\n    \"format\": \"json\",\n    \"level\": \"debug\"\n  },\n  \"replicas\": 1\n}",
+		"hosts":    "127.0.0.1 localhost\n10.0.0.1 db",
+		"banner":   "/banner - welcome",
+		"seed":     "mine",
+		"fresh":    "/fresh",
+	}
+	for key, value := range expected {
+		if configMap.Data[key] != value {
+			t.Logf("expected %s to be %q but got %q", key, value, configMap.Data[key])
+			t.FailNow()
+		}
+	}
+	if keys, _ := readManagedKeys(configMap.Annotations).keys(); keys["seed"] {
+		t.Log("expected a key we didn't write not to be managed")
+		t.FailNow()
+	}
+
+	// Removing an entry puts back the value it was layered over.
+	configMap.Annotations[CurlAnnotation] = "fresh=" + server.URL + "/fresh"
+	kubeClient.CoreV1().ConfigMaps("default").Update(configMap)
+	configMap = process()
+	if configMap.Data["hosts"] != "127.0.0.1 localhost" || configMap.Data["seed"] != "mine" ||
+		configMap.Data["app.json"] != `{"replicas":1,"log":{"level":"info","format":"json"}}` {
+		t.Logf("expected the values to be put back: %v", configMap.Data)
+		t.FailNow()
+	}
+}
+
+func TestProcessConfigMapWithoutData(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "replicas: 3\n")
+		}))
+	defer server.Close()
+
+	configMap := &api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "empty",
+			Annotations: map[string]string{CurlAnnotation: "app.yaml=" + server.URL},
+		},
+	}
+	kubeClient := newFakeClientset(configMap)
+
+	wfh := newWebsiteFetchHandler(kubeClient, testConfig())
+	if err := wfh.processConfigMap("default", configMap); err != nil {
+		t.Logf("error processConfigMap: %s", err.Error())
+		t.FailNow()
+	}
+	configMap, _ = fetchConfigMap(kubeClient, "default", "empty")
+	if configMap.Data["app.yaml"] != "replicas: 3\n" {
+		t.Logf("unexpected data %v", configMap.Data)
+		t.FailNow()
+	}
+}
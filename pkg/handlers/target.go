@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	api_v1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// TargetAnnotation names the ConfigMap or Secret that fetched content is
+// written to instead of the annotated configMap, like: -
+//
+//	x-k8s.io/curl-me-that-target: configmap/app-config
+//	x-k8s.io/curl-me-that-target: secret/app-credentials
+//
+// A name alone is a configMap. The target is created and owned by the
+// annotated configMap, so it is deleted along with it, and the annotated
+// configMap is never written to. That keeps it matching the manifest it was
+// applied from, so GitOps tools don't keep reverting what we fetched.
+const TargetAnnotation = "x-k8s.io/curl-me-that-target"
+
+// TargetOwnerLabel holds the UID of the configMap a target was written for,
+// so that targets left behind when the TargetAnnotation changes can be found.
+const TargetOwnerLabel = "x-k8s.io/curl-me-that-owner"
+
+// target is an object named by the TargetAnnotation.
+type target struct {
+	Kind string
+	Name string
+}
+
+// parseTarget returns the target named on configMap, or nil when it doesn't
+// name one.
+func parseTarget(configMap *api_v1.ConfigMap) (*target, error) {
+	raw := strings.TrimSpace(configMap.Annotations[TargetAnnotation])
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	t := &target{Kind: "configmap", Name: raw}
+	if parts := strings.SplitN(raw, "/", 2); len(parts) == 2 {
+		t.Kind, t.Name = strings.ToLower(parts[0]), parts[1]
+	}
+	if t.Kind != "configmap" && t.Kind != "secret" {
+		return nil, errors.New(fmt.Sprintf(
+			"target must be a configmap or secret but got %s", raw))
+	}
+	if problems := validation.IsDNS1123Subdomain(t.Name); len(problems) > 0 {
+		return nil, errors.New(fmt.Sprintf("invalid target name %s: %s",
+			t.Name, strings.Join(problems, ", ")))
+	}
+	if t.Kind == "configmap" && t.Name == configMap.Name {
+		return nil, errors.New("the target must be another configMap")
+	}
+	return t, nil
+}
+
+// targetMeta is the metadata of a new target for source.
+func targetMeta(source *api_v1.ConfigMap, name string) v1.ObjectMeta {
+	return v1.ObjectMeta{
+		Namespace:       source.Namespace,
+		Name:            name,
+		Labels:          map[string]string{TargetOwnerLabel: string(source.UID)},
+		Annotations:     map[string]string{},
+		OwnerReferences: []v1.OwnerReference{ownerReference(source)},
+	}
+}
+
+// writeTarget writes the results into the target of source, creating it when
+// it doesn't exist yet. Objects that exist but aren't owned by source are
+// never written to. Targets previously written for source are removed.
+func (wfh WebsiteFetchHandler) writeTarget(source *api_v1.ConfigMap, t target,
+	results fetchResults, status ConfigMapStatus) error {
+
+	var err error
+	if t.Kind == "secret" {
+		err = wfh.writeTargetSecret(source, t.Name, results, status)
+	} else {
+		err = wfh.writeTargetConfigMap(source, t.Name, results, status)
+	}
+	if err != nil {
+		return err
+	}
+	return wfh.pruneTargets(source, &t)
+}
+
+func (wfh WebsiteFetchHandler) writeTargetConfigMap(source *api_v1.ConfigMap,
+	name string, results fetchResults, status ConfigMapStatus) error {
+
+	configMaps := wfh.clientset.CoreV1().ConfigMaps(source.Namespace)
+	configMap, err := configMaps.Get(name, v1.GetOptions{})
+	create := k8s_errors.IsNotFound(err)
+	switch {
+	case create:
+		configMap = &api_v1.ConfigMap{ObjectMeta: targetMeta(source, name)}
+	case err != nil:
+		return errors.Wrapf(err, "unable to read target configMap %s", name)
+	case !ownedBy(configMap.ObjectMeta, source):
+		return errors.New(fmt.Sprintf(
+			"target configMap %s already exists and is not owned by %s",
+			name, source.Name))
+	}
+	original := configMap.DeepCopy()
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	if configMap.Annotations == nil {
+		configMap.Annotations = make(map[string]string)
+	}
+
+	previous := readManagedKeys(configMap.Annotations)
+	change := results.reconcileManaged(previous)
+	previous.release(configMap.Data, change.orphans)
+
+	values, err := results.layer(configMap.Data, previous, change)
+	if err != nil {
+		return err
+	}
+	binaryKeys := keptBinaryKeys(configMap.Annotations, change.kept)
+	for key, value := range values {
+		configMap.Data[key] = value
+	}
+	for key, value := range results.binary {
+		configMap.Data[key] = base64.StdEncoding.EncodeToString(value)
+		binaryKeys = append(binaryKeys, key)
+	}
+	if err := wfh.syncSensitive(source, configMap, results,
+		change.sensitiveOrphans); err != nil {
+		return err
+	}
+	status.Drift = readStatus(configMap).Drift
+	writeStatus(configMap, status)
+	setBinaryKeys(configMap, binaryKeys)
+	delete(configMap.Annotations, KeptEditAnnotation)
+	change.managed.hash(configMap.Data)
+	writeManagedKeys(configMap.Annotations, change.managed)
+
+	if create {
+		_, err = configMaps.Create(configMap)
+	} else {
+		_, err = patchConfigMap(wfh.clientset, original, configMap)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to write target configMap %s", name)
+	}
+	wfh.configMapWritten(original, configMap)
+	return wfh.recordHistory(source, configMap, results.entrySources(), 0)
+}
+
+// writeTargetSecret writes everything, sensitive or not, into the Secret.
+func (wfh WebsiteFetchHandler) writeTargetSecret(source *api_v1.ConfigMap,
+	name string, results fetchResults, status ConfigMapStatus) error {
+
+	secrets := wfh.clientset.CoreV1().Secrets(source.Namespace)
+	secret, err := secrets.Get(name, v1.GetOptions{})
+	create := k8s_errors.IsNotFound(err)
+	secretType := api_v1.SecretTypeOpaque
+	if len(results.secretType) > 0 {
+		secretType = api_v1.SecretType(results.secretType)
+	}
+	switch {
+	case create:
+		secret = &api_v1.Secret{
+			ObjectMeta: targetMeta(source, name),
+			Type:       secretType,
+		}
+	case err != nil:
+		return errors.Wrapf(err, "unable to read target secret %s", name)
+	case !ownedBy(secret.ObjectMeta, source):
+		return errors.New(fmt.Sprintf(
+			"target secret %s already exists and is not owned by %s",
+			name, source.Name))
+	case secret.Type != secretType:
+		return errors.New(fmt.Sprintf(
+			"target secret %s is of type %s, delete it to change it to %s",
+			name, secret.Type, secretType))
+	}
+	original := secret.DeepCopy()
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	if secret.Annotations == nil {
+		secret.Annotations = make(map[string]string)
+	}
+
+	previous := readManagedKeys(secret.Annotations)
+	change := results.reconcileManaged(previous)
+	existing := make(map[string]string)
+	for key, value := range secret.Data {
+		existing[key] = string(value)
+	}
+	previous.release(existing, change.orphans)
+	for _, key := range change.orphans {
+		if base, ok := existing[key]; ok {
+			secret.Data[key] = []byte(base)
+		} else {
+			delete(secret.Data, key)
+		}
+	}
+	for _, key := range change.sensitiveOrphans {
+		delete(secret.Data, key)
+	}
+
+	values, err := results.layer(existing, previous, change)
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		secret.Data[key] = []byte(value)
+	}
+	for _, values := range []map[string][]byte{results.binary, results.sensitive} {
+		for key, value := range values {
+			secret.Data[key] = value
+		}
+	}
+	encoded, err := encodeStatus(status)
+	if err != nil {
+		return err
+	}
+	secret.Annotations[StatusAnnotation] = encoded
+	writeManagedKeys(secret.Annotations, change.managed)
+
+	if create {
+		_, err = secrets.Create(secret)
+	} else {
+		err = patchSecret(wfh.clientset, original, secret)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to write target secret %s", name)
+	}
+	wfh.secretWritten(original, secret)
+	return nil
+}
+
+// pruneTargets deletes the targets written for source other than keep, left
+// behind when the TargetAnnotation is changed or removed. They are looked up
+// in the ownerIndex of the cache, so the API server is only asked to delete
+// targets that source has.
+func (wfh WebsiteFetchHandler) pruneTargets(source *api_v1.ConfigMap, keep *target) error {
+	if len(source.UID) == 0 {
+		return nil
+	}
+	core := wfh.clientset.CoreV1()
+
+	configMaps, err := wfh.caches.configMaps.ByIndex(ownerIndex, string(source.UID))
+	if err != nil {
+		return errors.Wrap(err, "unable to look up target configMaps")
+	}
+	for _, obj := range configMaps {
+		configMap, ok := obj.(*api_v1.ConfigMap)
+		if !ok || !ownedBy(configMap.ObjectMeta, source) ||
+			(keep != nil && *keep == target{Kind: "configmap", Name: configMap.Name}) {
+			continue
+		}
+		if err := core.ConfigMaps(source.Namespace).Delete(configMap.Name,
+			nil); err != nil && !k8s_errors.IsNotFound(err) {
+			return errors.Wrapf(err, "unable to delete old target %s", configMap.Name)
+		}
+	}
+
+	secrets, err := wfh.caches.secrets.ByIndex(ownerIndex, string(source.UID))
+	if err != nil {
+		return errors.Wrap(err, "unable to look up target secrets")
+	}
+	for _, obj := range secrets {
+		secret, ok := obj.(*api_v1.Secret)
+		if !ok || !ownedBy(secret.ObjectMeta, source) ||
+			(keep != nil && *keep == target{Kind: "secret", Name: secret.Name}) {
+			continue
+		}
+		if err := core.Secrets(source.Namespace).Delete(secret.Name,
+			nil); err != nil && !k8s_errors.IsNotFound(err) {
+			return errors.Wrapf(err, "unable to delete old target %s", secret.Name)
+		}
+	}
+	return nil
+}
+
+// currentStatus returns the status last recorded for configMap, which is on
+// its target when it has one.
+func (wfh WebsiteFetchHandler) currentStatus(configMap *api_v1.ConfigMap) ConfigMapStatus {
+	t, err := parseTarget(configMap)
+	if err != nil || t == nil {
+		return readStatus(configMap)
+	}
+
+	var annotations map[string]string
+	if t.Kind == "secret" {
+		secret, err := wfh.clientset.CoreV1().Secrets(configMap.Namespace).
+			Get(t.Name, v1.GetOptions{})
+		if err == nil {
+			annotations = secret.Annotations
+		}
+	} else {
+		target, err := wfh.clientset.CoreV1().ConfigMaps(configMap.Namespace).
+			Get(t.Name, v1.GetOptions{})
+		if err == nil {
+			annotations = target.Annotations
+		}
+	}
+	return statusFromAnnotations(annotations)
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProcessConfigMapIntoTarget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "replicas: 3\n")
+		}))
+	defer server.Close()
+
+	kubeClient := newFakeClientset()
+	kubeClient.CoreV1().ConfigMaps("default").Create(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "unowned"},
+	})
+	source := &api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: "default",
+			Name:      "app",
+			UID:       "app-uid",
+			Annotations: map[string]string{
+				CurlAnnotation:   "app.yaml=" + server.URL,
+				TargetAnnotation: "app-config",
+			},
+		},
+		Data: map[string]string{"defaults.yaml": "replicas: 1\n"},
+	}
+	kubeClient.CoreV1().ConfigMaps("default").Create(source)
+
+	wfh := newWebsiteFetchHandler(kubeClient, testConfig())
+	process := func(targetName string) *api_v1.ConfigMap {
+		source, _ := fetchConfigMap(kubeClient, "default", "app")
+		source.Annotations[TargetAnnotation] = targetName
+		if len(targetName) == 0 {
+			delete(source.Annotations, TargetAnnotation)
+		}
+		kubeClient.CoreV1().ConfigMaps("default").Update(source)
+		syncCaches(t, wfh, kubeClient)
+		if err := wfh.processConfigMap("default", source); err != nil {
+			t.Logf("error processConfigMap into %s: %s", targetName, err.Error())
+			t.FailNow()
+		}
+		source, _ = fetchConfigMap(kubeClient, "default", "app")
+		return source
+	}
+
+	source = process("app-config")
+	if _, ok := source.Data["app.yaml"]; ok || len(source.Annotations) != 2 {
+		t.Logf("expected the source to be left alone: %+v", source)
+		t.FailNow()
+	}
+	target, err := fetchConfigMap(kubeClient, "default", "app-config")
+	if err != nil || target.Data["app.yaml"] != "replicas: 3\n" ||
+		!ownedBy(target.ObjectMeta, source) ||
+		readStatus(target).Entries["app.yaml"].State != StateSynced {
+		t.Logf("unexpected target %+v: %v", target, err)
+		t.FailNow()
+	}
+	if wfh.revisionChanged(source) {
+		t.Log("expected the status to be read from the target")
+		t.FailNow()
+	}
+	wfh.processConfigMap("default", target)
+	target, _ = fetchConfigMap(kubeClient, "default", "app-config")
+	if target.Data["app.yaml"] != "replicas: 3\n" {
+		t.Logf("expected processing the target to leave it alone: %+v", target)
+		t.FailNow()
+	}
+
+	// A target annotation that doesn't parse leaves the old target in place.
+	for _, invalid := range []string{"deployment/app-config", "App_Config", "app"} {
+		source, _ := fetchConfigMap(kubeClient, "default", "app")
+		source.Annotations[TargetAnnotation] = invalid
+		kubeClient.CoreV1().ConfigMaps("default").Update(source)
+		syncCaches(t, wfh, kubeClient)
+		if err := wfh.processConfigMap("default", source); err == nil {
+			t.Logf("expected target %s to be refused", invalid)
+			t.FailNow()
+		}
+		if _, err := fetchConfigMap(kubeClient, "default", "app-config"); err != nil {
+			t.Logf("expected target %s to keep the old target: %v", invalid, err)
+			t.FailNow()
+		}
+	}
+
+	// Switching to a Secret removes the old target.
+	process("secret/app-secret")
+	secret, err := kubeClient.CoreV1().Secrets("default").Get("app-secret", v1.GetOptions{})
+	if err != nil || string(secret.Data["app.yaml"]) != "replicas: 3\n" {
+		t.Logf("unexpected target secret %+v: %v", secret, err)
+		t.FailNow()
+	}
+	if _, err := fetchConfigMap(kubeClient, "default", "app-config"); err == nil {
+		t.Log("expected the old target configMap to be deleted")
+		t.FailNow()
+	}
+
+	// Without a target the content is written in place again.
+	source = process("")
+	if source.Data["app.yaml"] != "replicas: 3\n" {
+		t.Logf("expected the content in place: %+v", source.Data)
+		t.FailNow()
+	}
+	if _, err := kubeClient.CoreV1().Secrets("default").
+		Get("app-secret", v1.GetOptions{}); err == nil {
+		t.Log("expected the old target secret to be deleted")
+		t.FailNow()
+	}
+
+	// Without targets nothing is listed from the API server to prune them.
+	kubeClient.ClearActions()
+	if err := wfh.processConfigMap("default", source); err != nil {
+		t.Logf("error processConfigMap: %s", err.Error())
+		t.FailNow()
+	}
+	for _, action := range kubeClient.Actions() {
+		if action.GetVerb() == "list" {
+			t.Logf("expected the targets to be read from the cache: %v", action)
+			t.FailNow()
+		}
+	}
+
+	// Objects we don't own are never written to.
+	source.Annotations[TargetAnnotation] = "unowned"
+	if err := wfh.processConfigMap("default", source); err == nil {
+		t.Log("expected an error writing to an object we don't own")
+		t.FailNow()
+	}
+	unowned, _ := fetchConfigMap(kubeClient, "default", "unowned")
+	if len(unowned.Data) > 0 {
+		t.Logf("expected the unowned configMap to be left alone: %+v", unowned)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	api_v1 "k8s.io/api/core/v1"
+)
+
+// TemplateData is what a template supplied with the `template` or
+// `template-key` options is executed against.
+type TemplateData struct {
+	// Key the rendered output is written to.
+	Key string
+	// Body is the fetched content as it was received.
+	Body string
+	// Data is the Body parsed as JSON or YAML, or the Body itself when it is
+	// plain text.
+	Data interface{}
+	// Extracted holds the fields selected by any extract options.
+	Extracted map[string]string
+	// Header holds the response headers from the fetch.
+	Header    http.Header
+	ConfigMap TemplateConfigMap
+}
+
+// TemplateConfigMap is the metadata and data of the configMap being
+// processed.
+type TemplateConfigMap struct {
+	Name        string
+	Namespace   string
+	Labels      map[string]string
+	Annotations map[string]string
+	Data        map[string]string
+}
+
+func templateConfigMap(configMap *api_v1.ConfigMap) TemplateConfigMap {
+	return TemplateConfigMap{
+		Name:        configMap.Name,
+		Namespace:   configMap.Namespace,
+		Labels:      configMap.Labels,
+		Annotations: configMap.Annotations,
+		Data:        configMap.Data,
+	}
+}
+
+// templateText returns the template for the entry, either given inline or
+// read from another key in the configMap. An empty string means the entry is
+// not templated.
+func templateText(fRequest *FetchRequest, configMap *api_v1.ConfigMap) (string, error) {
+	if len(fRequest.TemplateKey) == 0 {
+		return fRequest.Template, nil
+	}
+
+	text, ok := configMap.Data[fRequest.TemplateKey]
+	if !ok {
+		return "", errors.New(
+			fmt.Sprintf("template key %s not found in configMap",
+				fRequest.TemplateKey))
+	}
+	return text, nil
+}
+
+// renderTemplate executes the template for the entry, if it has one, and
+// stores the output under the entry key.
+func renderTemplate(fRequest *FetchRequest, fResp *FetchResponse,
+	configMap *api_v1.ConfigMap) error {
+
+	text, err := templateText(fRequest, configMap)
+	if err != nil || len(text) == 0 {
+		return err
+	}
+
+	data := TemplateData{
+		Key:       fRequest.IntoKey,
+		Body:      fResp.Value,
+		Data:      decodeDocument(fResp.Value, fResp.Header.Get("Content-Type")),
+		Extracted: fResp.Data,
+		Header:    fResp.Header,
+		ConfigMap: templateConfigMap(configMap),
+	}
+
+	rendered, err := executeTemplate(fRequest.IntoKey, text, data)
+	if err != nil {
+		return err
+	}
+
+	if fResp.Data != nil {
+		fResp.Data[fRequest.IntoKey] = rendered
+	} else {
+		fResp.Value = rendered
+	}
+	return nil
+}
+
+// executeTemplate parses text and renders it against data.
+func executeTemplate(name string, text string, data TemplateData) (string, error) {
+	tmpl, err := template.New(name).
+		Funcs(templateFuncs).
+		Option("missingkey=error").
+		Parse(text)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to parse template")
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", errors.Wrap(err, "unable to render template")
+	}
+	return rendered.String(), nil
+}
+
+// templateFuncs are helpers in the spirit of sprig for the transformations
+// that come up most often when wrapping fetched content.
+var templateFuncs = template.FuncMap{
+	"b64enc": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+	"b64dec": func(s string) (string, error) {
+		decoded, err := base64.StdEncoding.DecodeString(s)
+		return string(decoded), err
+	},
+	"sha256sum": func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	},
+	"default": func(fallback interface{}, given ...interface{}) interface{} {
+		if len(given) == 0 || isEmpty(given[0]) {
+			return fallback
+		}
+		return given[0]
+	},
+	"indent": func(spaces int, s string) string {
+		padding := strings.Repeat(" ", spaces)
+		return padding + strings.Replace(s, "\n", "\n"+padding, -1)
+	},
+	"nindent": func(spaces int, s string) string {
+		padding := strings.Repeat(" ", spaces)
+		return "\n" + padding + strings.Replace(s, "\n", "\n"+padding, -1)
+	},
+	"toJson": func(v interface{}) (string, error) {
+		encoded, err := json.Marshal(v)
+		return string(encoded), err
+	},
+	"toYaml": func(v interface{}) (string, error) {
+		encoded, err := yaml.Marshal(v)
+		return strings.TrimSuffix(string(encoded), "\n"), err
+	},
+	"quote": func(v interface{}) string {
+		return fmt.Sprintf("%q", fmt.Sprint(v))
+	},
+	"trim":    strings.TrimSpace,
+	"upper":   strings.ToUpper,
+	"lower":   strings.ToLower,
+	"replace": func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	"join": func(sep string, items []interface{}) string {
+		parts := make([]string, 0, len(items))
+		for _, item := range items {
+			parts = append(parts, fmt.Sprint(item))
+		}
+		return strings.Join(parts, sep)
+	},
+}
+
+// isEmpty follows the sprig idea of emptiness used by `default`.
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return value.Len() == 0
+	case reflect.Bool:
+		return !value.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int() == 0
+	case reflect.Float32, reflect.Float64:
+		return value.Float() == 0
+	case reflect.Ptr, reflect.Interface:
+		return value.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	configMap := &api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "nginx-config"},
+		Data: map[string]string{
+			"upstream.tmpl": "upstream backend {\n{{ range .Data.servers }}" +
+				"  server {{ . }};\n{{ end }}}",
+		},
+	}
+
+	fResp := &FetchResponse{
+		Key:    "upstream.conf",
+		Value:  `{"servers": ["10.0.0.1:80", "10.0.0.2:80"]}`,
+		Header: http.Header{"Content-Type": []string{"application/json"}},
+	}
+
+	fRequest, _ := parseAnnotationData(
+		"upstream.conf=example.com template-key=upstream.tmpl")
+	if err := renderTemplate(fRequest, fResp, configMap); err != nil {
+		t.Logf("failed to render template: %s\n", err.Error())
+		t.FailNow()
+	}
+
+	expected := "upstream backend {\n  server 10.0.0.1:80;\n  server 10.0.0.2:80;\n}"
+	if fResp.Value != expected {
+		t.Logf("rendered = %q", fResp.Value)
+		t.FailNow()
+	}
+}
+
+func TestRenderTemplateHelpers(t *testing.T) {
+	configMap := &api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "app-config"},
+	}
+
+	fRequest, err := parseAnnotationData(`token.properties=example.com ` +
+		`template="name={{ .ConfigMap.Name }}\ntoken={{ b64enc (trim .Body) }}\n` +
+		`region={{ default \"eu-west-1\" (.Header.Get \"Region\") }}\n` +
+		`sum={{ sha256sum .Body | printf \"%.8s\" }}"`)
+	if err != nil {
+		t.Logf("failed to parse the annotation data: %s\n", err.Error())
+		t.FailNow()
+	}
+
+	fResp := &FetchResponse{Key: "token.properties", Value: "secret\n"}
+	if err := renderTemplate(fRequest, fResp, configMap); err != nil {
+		t.Logf("failed to render template: %s\n", err.Error())
+		t.FailNow()
+	}
+
+	expected := "name=app-config\ntoken=c2VjcmV0\nregion=eu-west-1\nsum=b37e50ce"
+	if fResp.Value != expected {
+		t.Logf("rendered = %q", fResp.Value)
+		t.FailNow()
+	}
+
+	broken, _ := parseAnnotationData(`key=example.com template="{{ .Nope }}"`)
+	err = renderTemplate(broken, &FetchResponse{Key: "key"}, configMap)
+	if err == nil || !strings.Contains(err.Error(), "render") {
+		t.Logf("expected a render error, got %v", err)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+
+	"github.com/BurntSushi/toml"
+)
+
+// decodeTOML reads content as TOML. The document is passed through JSON like
+// decodeYAML so that it holds the same types as the other formats, which
+// leaves dates and times as RFC 3339 strings.
+func decodeTOML(content string) (map[string]interface{}, error) {
+	var table map[string]interface{}
+	if _, err := toml.Decode(content, &table); err != nil {
+		return nil, err
+	}
+	asJSON, err := json.Marshal(table)
+	if err != nil {
+		return nil, err
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(asJSON, &document); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+// encodeTOML writes table out as TOML.
+func encodeTOML(table map[string]interface{}) (string, error) {
+	var out bytes.Buffer
+	encoder := toml.NewEncoder(&out)
+	encoder.Indent = ""
+	if err := encoder.Encode(tomlValue(table)); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// tomlValue prepares a decoded value for the encoder. TOML has no null so
+// those keys are left out, and whole numbers are written as integers rather
+// than the floats they were decoded as.
+func tomlValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+			return int64(v)
+		}
+	case []interface{}:
+		elements := make([]interface{}, 0, len(v))
+		for _, element := range v {
+			if element != nil {
+				elements = append(elements, tomlValue(element))
+			}
+		}
+		return elements
+	case map[string]interface{}:
+		table := make(map[string]interface{}, len(v))
+		for key, element := range v {
+			if element != nil {
+				table[key] = tomlValue(element)
+			}
+		}
+		return table
+	}
+	return value
+}
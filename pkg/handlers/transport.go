@@ -0,0 +1,321 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpproxy"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/JonPulfer/gofiggy/pkg/config"
+	"github.com/JonPulfer/gofiggy/pkg/egress"
+)
+
+// fetchTimeout bounds how long a single fetch can take.
+const fetchTimeout = 30 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// transportCache builds an http.Client for each namespace and TLS profile the
+// first time it is used and keeps hold of it so that connections are reused.
+// Every client applies the egress policy for its namespace. Clients are
+// dropped when an object their profile reads material from changes.
+type transportCache struct {
+	mu         sync.Mutex
+	kubeClient kubernetes.Interface
+	profiles   map[string]config.TLSProfile
+	policy     *egress.Policy
+	clients    map[transportKey]*http.Client
+}
+
+type transportKey struct {
+	namespace string
+	profile   string
+}
+
+func newTransportCache(kubeClient kubernetes.Interface,
+	cfg config.Config) *transportCache {
+
+	return &transportCache{
+		kubeClient: kubeClient,
+		profiles:   cfg.TLSProfiles,
+		policy:     egress.NewPolicy(cfg.Egress),
+		clients:    make(map[transportKey]*http.Client),
+	}
+}
+
+// client returns the http.Client for fetches from namespace using the named
+// profile, an empty name gives the default transport.
+func (tc *transportCache) client(namespace string, name string) (*http.Client, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	key := transportKey{namespace: namespace, profile: name}
+	if cl, ok := tc.clients[key]; ok {
+		return cl, nil
+	}
+
+	profile, ok := tc.profiles[name]
+	if !ok && len(name) > 0 {
+		return nil, errors.New(fmt.Sprintf("unknown tls profile %s", name))
+	}
+
+	cl, err := tc.buildClient(namespace, profile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "tls profile %s", name)
+	}
+	tc.clients[key] = cl
+	return cl, nil
+}
+
+// forgetUsing drops the clients built from material held in ref.
+func (tc *transportCache) forgetUsing(ref objectReference) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	for key := range tc.clients {
+		profile := tc.profiles[key.profile]
+		for _, material := range []config.Material{profile.CA,
+			profile.ClientCert, profile.ClientKey} {
+			if materialReferences(material, ref) {
+				delete(tc.clients, key)
+			}
+		}
+	}
+}
+
+func materialReferences(material config.Material, ref objectReference) bool {
+	switch {
+	case material.ConfigMap != nil:
+		return ref.Kind == "configmap" &&
+			material.ConfigMap.Namespace == ref.Namespace &&
+			material.ConfigMap.Name == ref.Name
+	case material.Secret != nil:
+		return ref.Kind == "secret" &&
+			material.Secret.Namespace == ref.Namespace &&
+			material.Secret.Name == ref.Name
+	}
+	return false
+}
+
+// readMaterial returns the PEM content from wherever the material is held.
+func (tc *transportCache) readMaterial(material config.Material) ([]byte, error) {
+	switch {
+	case len(material.Inline) > 0:
+		return []byte(material.Inline), nil
+	case len(material.File) > 0:
+		return ioutil.ReadFile(material.File)
+	case material.ConfigMap != nil:
+		ref := material.ConfigMap
+		configMap, err := tc.kubeClient.CoreV1().ConfigMaps(ref.Namespace).
+			Get(ref.Name, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		value, ok := configMap.Data[ref.Key]
+		if !ok {
+			return nil, errors.New(
+				fmt.Sprintf("key %s not found in configMap %s/%s",
+					ref.Key, ref.Namespace, ref.Name))
+		}
+		return []byte(value), nil
+	case material.Secret != nil:
+		ref := material.Secret
+		secret, err := tc.kubeClient.CoreV1().Secrets(ref.Namespace).
+			Get(ref.Name, v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		value, ok := secret.Data[ref.Key]
+		if !ok {
+			return nil, errors.New(
+				fmt.Sprintf("key %s not found in secret %s/%s",
+					ref.Key, ref.Namespace, ref.Name))
+		}
+		return value, nil
+	}
+	return nil, nil
+}
+
+// buildClient turns a TLSProfile into an http.Client for namespace. The
+// egress policy is checked against the address each connection is made to,
+// and on every redirect. Only the proxy named by the profile is used, never
+// one from the environment. As a proxy does its own resolving, the hosts
+// sent through it are resolved and checked before they are handed to it.
+func (tc *transportCache) buildClient(namespace string,
+	profile config.TLSProfile) (*http.Client, error) {
+
+	tlsConfig, err := tc.buildTLSConfig(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	var proxy func(*http.Request) (*url.URL, error)
+	proxies := make(map[string]bool)
+	if len(profile.Proxy) > 0 {
+		proxyFunc := (&httpproxy.Config{
+			HTTPProxy:  profile.Proxy,
+			HTTPSProxy: profile.Proxy,
+			NoProxy:    profile.NoProxy,
+		}).ProxyFunc()
+		proxy = func(req *http.Request) (*url.URL, error) {
+			proxyURL, err := proxyFunc(req.URL)
+			if err != nil || proxyURL == nil {
+				return proxyURL, err
+			}
+			if err := tc.policy.CheckURL(namespace, req.URL); err != nil {
+				return nil, err
+			}
+			return proxyURL, nil
+		}
+		proxies[proxyAddress(profile.Proxy)] = true
+	}
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	checkedDial := tc.policy.DialContext(namespace, dialer)
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		if proxies[address] {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return checkedDial(ctx, network, address)
+	}
+
+	return &http.Client{
+		Timeout: fetchTimeout,
+		Transport: &http.Transport{
+			Proxy:               proxy,
+			DialContext:         dial,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+			MaxIdleConns:        10,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return tc.policy.CheckURL(namespace, req.URL)
+		},
+	}, nil
+}
+
+// proxyAddress is the host and port dialled to reach the proxy at raw.
+func proxyAddress(raw string) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	proxyURL, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+
+	port := proxyURL.Port()
+	if len(port) == 0 {
+		port = "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+func (tc *transportCache) buildTLSConfig(profile config.TLSProfile) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: profile.ServerName}
+
+	if len(profile.MinVersion) > 0 {
+		version, ok := tlsVersions[profile.MinVersion]
+		if !ok {
+			return nil, errors.New(
+				fmt.Sprintf("unknown minVersion %s", profile.MinVersion))
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if profile.CA.IsSet() {
+		ca, err := tc.readMaterial(profile.CA)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read ca")
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("ca does not contain any PEM certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if profile.ClientCert.IsSet() || profile.ClientKey.IsSet() {
+		cert, err := tc.readMaterial(profile.ClientCert)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read clientCert")
+		}
+		key, err := tc.readMaterial(profile.ClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read clientKey")
+		}
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+
+	if len(profile.Pins) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range profile.Pins {
+			pins[strings.TrimPrefix(pin, "sha256/")] = true
+		}
+		tlsConfig.VerifyPeerCertificate = verifyPins(pins)
+	}
+
+	return tlsConfig, nil
+}
+
+// verifyPins checks that at least one certificate presented by the server has
+// a public key matching a pin. This runs after the normal verification of the
+// chain so pinning only ever narrows what is trusted.
+func verifyPins(pins map[string]bool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				continue
+			}
+			if pins[publicKeyPin(cert)] {
+				return nil
+			}
+		}
+		return errors.New("no certificate presented matches a pinned public key")
+	}
+}
+
+// publicKeyPin is the base64 SHA-256 hash of the certificate's public key.
+func publicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
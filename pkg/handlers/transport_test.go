@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/JonPulfer/gofiggy/pkg/config"
+	"github.com/JonPulfer/gofiggy/pkg/egress"
+	"github.com/JonPulfer/gofiggy/pkg/events"
+)
+
+// newClientCertificate creates a self signed client certificate and key.
+func newClientCertificate(t *testing.T) (*x509.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Logf("error generating key: %s", err.Error())
+		t.FailNow()
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gofiggy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Logf("error creating certificate: %s", err.Error())
+		t.FailNow()
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.FailNow()
+	}
+
+	return cert,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// testConfig allows fetches from the local test servers, which the egress
+// policy denies by default.
+func testConfig() config.Config {
+	return config.Config{Egress: egress.Config{
+		Rules: egress.Rules{Allow: []string{"127.0.0.0/8", "::1"}},
+	}}
+}
+
+func certificatePEM(cert *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
+
+func TestFetchWithTLSProfile(t *testing.T) {
+	clientCert, certPEM, keyPEM := newClientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "hello %s", r.TLS.PeerCertificates[0].Subject.CommonName)
+		}))
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	kubeClient := newFakeClientset()
+	kubeClient.CoreV1().Secrets("gofiggy").Create(&api_v1.Secret{
+		ObjectMeta: v1.ObjectMeta{Namespace: "gofiggy", Name: "client-tls"},
+		Data: map[string][]byte{
+			"tls.crt": certPEM,
+			"tls.key": keyPEM,
+		},
+	})
+
+	ca := config.Material{Inline: certificatePEM(server.Certificate())}
+	clientMaterial := config.TLSProfile{
+		CA: ca,
+		ClientCert: config.Material{Secret: &config.KeyReference{
+			Namespace: "gofiggy", Name: "client-tls", Key: "tls.crt"}},
+		ClientKey: config.Material{Secret: &config.KeyReference{
+			Namespace: "gofiggy", Name: "client-tls", Key: "tls.key"}},
+	}
+	pinned := clientMaterial
+	pinned.Pins = []string{"sha256/" + publicKeyPin(server.Certificate())}
+	wrongPin := clientMaterial
+	wrongPin.Pins = []string{"sha256/" + publicKeyPin(clientCert)}
+
+	cfg := testConfig()
+	cfg.TLSProfiles = map[string]config.TLSProfile{
+		"ca-only":   {CA: ca},
+		"mtls":      clientMaterial,
+		"pinned":    pinned,
+		"wrong-pin": wrongPin,
+	}
+	wfh := newWebsiteFetchHandler(kubeClient, cfg)
+
+	entries := map[string]bool{
+		"greeting=" + server.URL:                    false,
+		"greeting=" + server.URL + " tls=ca-only":   false,
+		"greeting=" + server.URL + " tls=mtls":      true,
+		"greeting=" + server.URL + " tls=pinned":    true,
+		"greeting=" + server.URL + " tls=wrong-pin": false,
+		"greeting=" + server.URL + " tls=missing":   false,
+	}
+
+	for entry, succeeds := range entries {
+		fRequest, err := parseAnnotationData(entry)
+		if err != nil {
+			t.Logf("error parsing %s: %s", entry, err.Error())
+			t.FailNow()
+		}
+
+		fResp, err := wfh.fetchEntry("default", fRequest, &api_v1.ConfigMap{})
+		if succeeds {
+			if err != nil {
+				t.Logf("error fetching %s: %s", entry, err.Error())
+				t.FailNow()
+			}
+			if fResp.Value != "hello gofiggy" {
+				t.Logf("unexpected response %s", fResp.Value)
+				t.FailNow()
+			}
+		} else if err == nil {
+			t.Logf("expected %s to fail", entry)
+			t.FailNow()
+		}
+	}
+
+	// Replacing the secret holding the client certificate drops the client
+	// built from it.
+	kubeClient.CoreV1().Secrets("gofiggy").Update(&api_v1.Secret{
+		ObjectMeta: v1.ObjectMeta{Namespace: "gofiggy", Name: "client-tls"},
+		Data:       map[string][]byte{"tls.crt": certPEM},
+	})
+	syncCaches(t, wfh, kubeClient)
+	handleQueued(wfh)
+	wfh.ObjectUpdated(nil, events.Event{Kind: "secret", Name: "gofiggy/client-tls"})
+
+	fRequest, _ := parseAnnotationData("greeting=" + server.URL + " tls=mtls")
+	if _, err := wfh.fetchEntry("default", fRequest, &api_v1.ConfigMap{}); err == nil {
+		t.Log("expected the changed secret to be read again")
+		t.FailNow()
+	}
+}
+
+func TestFetchDeniedByEgressPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/redirect" {
+				http.Redirect(w, r, "http://169.254.169.254/latest/meta-data",
+					http.StatusFound)
+				return
+			}
+			fmt.Fprint(w, "settings")
+		}))
+	defer server.Close()
+
+	kubeClient := newFakeClientset()
+	wfh := newWebsiteFetchHandler(kubeClient, config.Config{
+		Egress: egress.Config{Namespaces: map[string]egress.Rules{
+			"trusted": {Allow: []string{"127.0.0.0/8", "::1"}},
+		}},
+	})
+
+	entries := []struct {
+		namespace string
+		entry     string
+		state     string
+		message   string
+	}{
+		{"default", "settings=" + server.URL, StateDenied, "private range"},
+		{"trusted", "settings=" + server.URL + "/redirect", StateDenied, "169.254.169.254"},
+		{"trusted", "settings=" + server.URL + "/ok", StateSynced, ""},
+	}
+
+	for _, tc := range entries {
+		kubeClient.CoreV1().ConfigMaps(tc.namespace).Create(&api_v1.ConfigMap{
+			ObjectMeta: v1.ObjectMeta{
+				Namespace:   tc.namespace,
+				Name:        "egress",
+				Annotations: map[string]string{CurlAnnotation: tc.entry},
+			},
+			Data: map[string]string{},
+		})
+
+		configMap, _ := fetchConfigMap(kubeClient, tc.namespace, "egress")
+		wfh.processConfigMap(tc.namespace, configMap)
+
+		configMap, _ = fetchConfigMap(kubeClient, tc.namespace, "egress")
+		status := readStatus(configMap).Entries["settings"]
+		if status.State != tc.state || !strings.Contains(status.Message, tc.message) {
+			t.Logf("unexpected status for %s in %s: %+v",
+				tc.entry, tc.namespace, status)
+			t.FailNow()
+		}
+		kubeClient.CoreV1().ConfigMaps(tc.namespace).Delete("egress", nil)
+	}
+}
+
+func TestProxiedFetchCheckedBeforeHandOff(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			proxied = append(proxied, r.URL.String())
+			fmt.Fprint(w, "proxied")
+		}))
+	defer proxy.Close()
+
+	kubeClient := newFakeClientset()
+	wfh := newWebsiteFetchHandler(kubeClient, config.Config{
+		TLSProfiles: map[string]config.TLSProfile{"proxied": {Proxy: proxy.URL}},
+	})
+
+	entries := []struct {
+		entry string
+		state string
+	}{
+		{"settings=http://169.254.169.254/latest/meta-data tls=proxied", StateDenied},
+		{"settings=http://93.184.216.34/app tls=proxied", StateSynced},
+	}
+	for _, tc := range entries {
+		kubeClient.CoreV1().ConfigMaps("default").Create(&api_v1.ConfigMap{
+			ObjectMeta: v1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "proxied",
+				Annotations: map[string]string{CurlAnnotation: tc.entry},
+			},
+			Data: map[string]string{},
+		})
+
+		configMap, _ := fetchConfigMap(kubeClient, "default", "proxied")
+		wfh.processConfigMap("default", configMap)
+
+		configMap, _ = fetchConfigMap(kubeClient, "default", "proxied")
+		if status := readStatus(configMap).Entries["settings"]; status.State != tc.state {
+			t.Logf("unexpected status for %s: %+v", tc.entry, status)
+			t.FailNow()
+		}
+		kubeClient.CoreV1().ConfigMaps("default").Delete("proxied", nil)
+	}
+	if len(proxied) != 1 || proxied[0] != "http://93.184.216.34/app" {
+		t.Logf("expected only the allowed fetch to reach the proxy: %v", proxied)
+		t.FailNow()
+	}
+}
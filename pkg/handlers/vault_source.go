@@ -0,0 +1,498 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/JonPulfer/gofiggy/pkg/config"
+)
+
+// defaultVaultAuthPath is where the kubernetes auth method is usually mounted.
+const defaultVaultAuthPath = "kubernetes"
+
+// vaultSource reads secrets from a Vault KV engine, version 1 or 2. Entries
+// give the path of the secret, with the mount first, like: -
+//
+//	app=vault://secret/app/config auth-secret=vault-token
+//	db=vault://secret/app/db?version=3&sensitive=password auth-secret=vault-login
+//	db-user=vault://secret/app/db?field=username auth-secret=vault-login
+//
+// Each field of the secret is written to a key of its own, and the archive
+// options select and rename them, unless `field` picks a single one for the
+// entry key. Fields listed in `sensitive`, or all of them with `*`, go to
+// the Secret alongside the configMap instead. The auth-secret holds either
+// a Vault token or the role and jwt to log in with the kubernetes auth
+// method. The address comes from the config, and `address` can only pick
+// one of the others it lists.
+//
+// The KV version is looked up from the mount, or given with `kv`. `version`
+// pins a version of a KV 2 secret. The version, or a hash of a KV 1 secret,
+// is the revision, and secrets with a lease are fetched again once two
+// thirds of it has gone.
+type vaultSource struct {
+	transports *transportCache
+	address    string
+	// otherAddresses are the addresses entries may give instead.
+	otherAddresses []string
+	now            func() time.Time
+
+	mu *sync.Mutex
+	// logins are the tokens from logging in with kubernetes auth.
+	logins map[string]vaultLogin
+	// renewals are when entries with a lease should be fetched again.
+	renewals map[string]time.Time
+}
+
+type vaultLogin struct {
+	token   string
+	renewAt time.Time
+}
+
+func newVaultSource(cfg config.VaultConfig, transports *transportCache) vaultSource {
+	return vaultSource{
+		transports:     transports,
+		address:        cfg.Address,
+		otherAddresses: cfg.OtherAddresses,
+		now:            time.Now,
+		mu:             &sync.Mutex{},
+		logins:         map[string]vaultLogin{},
+		renewals:       map[string]time.Time{},
+	}
+}
+
+// vaultLocation is what a vault URL points to.
+type vaultLocation struct {
+	address   *url.URL
+	path      string
+	field     string
+	version   string
+	kv        string
+	sensitive []string
+}
+
+func (vs vaultSource) location(u *url.URL) (vaultLocation, error) {
+	query := u.Query()
+	location := vaultLocation{
+		path:    strings.Trim(u.Host+u.Path, "/"),
+		field:   query.Get("field"),
+		version: query.Get("version"),
+		kv:      query.Get("kv"),
+	}
+	for _, field := range strings.Split(query.Get("sensitive"), ",") {
+		if field = strings.TrimSpace(field); len(field) > 0 {
+			location.sensitive = append(location.sensitive, field)
+		}
+	}
+
+	if !strings.Contains(location.path, "/") {
+		return location, errors.New(fmt.Sprintf(
+			"expected vault://<mount>/<path> but got %s", u.String()))
+	}
+	if len(location.version) > 0 {
+		if _, err := strconv.Atoi(location.version); err != nil {
+			return location, errors.New(
+				fmt.Sprintf("invalid version %s", location.version))
+		}
+	}
+	if len(location.kv) > 0 && location.kv != "1" && location.kv != "2" {
+		return location, errors.New(
+			fmt.Sprintf("kv must be 1 or 2 but got %s", location.kv))
+	}
+
+	address := vs.address
+	if given := query.Get("address"); len(given) > 0 && given != address {
+		if !vs.allowsAddress(given) {
+			return location, errors.New(fmt.Sprintf(
+				"vault address %s is not one of the otherAddresses in the config",
+				given))
+		}
+		address = given
+	}
+	parsed, err := url.Parse(address)
+	if err != nil || len(parsed.Host) == 0 {
+		return location, errors.New(fmt.Sprintf(
+			"vault needs an address in the config, got %q", address))
+	}
+	location.address = parsed
+	return location, nil
+}
+
+// allowsAddress reports whether address is one the config lets entries give.
+func (vs vaultSource) allowsAddress(address string) bool {
+	for _, other := range vs.otherAddresses {
+		if strings.TrimSuffix(other, "/") == strings.TrimSuffix(address, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isSensitive reports whether field is to be kept out of the configMap.
+func (loc vaultLocation) isSensitive(field string) bool {
+	for _, sensitive := range loc.sensitive {
+		if sensitive == "*" || sensitive == field {
+			return true
+		}
+	}
+	return false
+}
+
+// vaultSecret is what was read from a path.
+type vaultSecret struct {
+	fields   map[string]interface{}
+	revision string
+	lease    time.Duration
+}
+
+func (vs vaultSource) Fetch(namespace string, fRequest *FetchRequest) (*FetchResponse, error) {
+	location, err := vs.location(fRequest.FromSite)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := vs.read(namespace, fRequest, location)
+	if err != nil {
+		return nil, err
+	}
+
+	fResp := &FetchResponse{
+		Key:       fRequest.IntoKey,
+		Header:    http.Header{},
+		Revision:  secret.revision,
+		Sensitive: map[string][]byte{},
+	}
+
+	if len(location.field) > 0 {
+		value, ok := secret.fields[location.field]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("%s has no field %s",
+				location.path, location.field))
+		}
+		if location.isSensitive(location.field) {
+			fResp.Data = map[string]string{}
+			fResp.Sensitive[fRequest.IntoKey] = []byte(vaultValue(value))
+		} else {
+			fResp.Value = vaultValue(value)
+		}
+		return fResp, nil
+	}
+
+	var files []archiveFile
+	for _, name := range sortedFieldNames(secret.fields) {
+		content := []byte(vaultValue(secret.fields[name]))
+		if !location.isSensitive(name) {
+			files = append(files, archiveFile{name: name, content: content})
+			continue
+		}
+		key, selected := archiveKey(fRequest.Archive, name, fRequest.keySeparator())
+		if !selected {
+			continue
+		}
+		if err := validateKey(key); err != nil {
+			return nil, errors.Wrapf(err, "field %s", name)
+		}
+		fResp.Sensitive[key] = content
+	}
+
+	fResp.Data = map[string]string{}
+	if len(files) > 0 {
+		if err := writeFiles(fRequest, fResp, files, "field"); err != nil {
+			return nil, err
+		}
+	}
+	return fResp, nil
+}
+
+// Revision reads the secret again for its revision, or gives none once the
+// lease of the last read needs renewing so that the entry is fetched again.
+func (vs vaultSource) Revision(namespace string, fRequest *FetchRequest) (string, error) {
+	location, err := vs.location(fRequest.FromSite)
+	if err != nil {
+		return "", err
+	}
+
+	vs.mu.Lock()
+	renewAt, leased := vs.renewals[namespace+" "+fRequest.FromSite.String()]
+	vs.mu.Unlock()
+	if leased && !vs.now().Before(renewAt) {
+		return "", nil
+	}
+
+	secret, err := vs.read(namespace, fRequest, location)
+	if err != nil {
+		return "", err
+	}
+	return secret.revision, nil
+}
+
+// read logs in if need be and reads the secret at the location.
+func (vs vaultSource) read(namespace string, fRequest *FetchRequest,
+	location vaultLocation) (vaultSecret, error) {
+
+	cl, err := vs.transports.client(namespace, fRequest.TLSProfile)
+	if err != nil {
+		return vaultSecret{}, err
+	}
+	token, err := vs.token(cl, fRequest.credentials, location)
+	if err != nil {
+		return vaultSecret{}, err
+	}
+
+	mount, kv := location.path[:strings.Index(location.path, "/")], location.kv
+	if len(kv) == 0 {
+		if mount, kv, err = vs.mount(cl, token, location); err != nil {
+			return vaultSecret{}, err
+		}
+	}
+
+	var secret vaultSecret
+	if kv == "2" {
+		secret, err = vs.readKV2(cl, token, location, mount)
+	} else {
+		secret, err = vs.readKV1(cl, token, location)
+	}
+	if err != nil {
+		return secret, err
+	}
+
+	entry := namespace + " " + fRequest.FromSite.String()
+	vs.mu.Lock()
+	if secret.lease > 0 {
+		vs.renewals[entry] = vs.now().Add(secret.lease * 2 / 3)
+	} else {
+		delete(vs.renewals, entry)
+	}
+	vs.mu.Unlock()
+	return secret, nil
+}
+
+// mount looks up which mount the path is under and the KV version it runs,
+// the same way the vault command line does.
+func (vs vaultSource) mount(cl *http.Client, token string,
+	location vaultLocation) (string, string, error) {
+
+	var resp struct {
+		Data struct {
+			Path    string            `json:"path"`
+			Type    string            `json:"type"`
+			Options map[string]string `json:"options"`
+		} `json:"data"`
+	}
+	if err := vs.do(cl, http.MethodGet, location,
+		"sys/internal/ui/mounts/"+location.path, token, nil, &resp); err != nil {
+		return "", "", errors.Wrap(err, "unable to look up the kv version, give it with kv=")
+	}
+	if resp.Data.Type != "kv" && resp.Data.Type != "generic" {
+		return "", "", errors.New(fmt.Sprintf(
+			"%s is a %s mount, not kv", location.path, resp.Data.Type))
+	}
+
+	kv := resp.Data.Options["version"]
+	if kv != "2" {
+		kv = "1"
+	}
+	return strings.Trim(resp.Data.Path, "/"), kv, nil
+}
+
+func (vs vaultSource) readKV1(cl *http.Client, token string,
+	location vaultLocation) (vaultSecret, error) {
+
+	if len(location.version) > 0 {
+		return vaultSecret{}, errors.New("version needs a kv 2 secret")
+	}
+
+	var resp struct {
+		LeaseDuration int                    `json:"lease_duration"`
+		Data          map[string]interface{} `json:"data"`
+	}
+	if err := vs.do(cl, http.MethodGet, location, location.path, token,
+		nil, &resp); err != nil {
+		return vaultSecret{}, err
+	}
+
+	encoded, _ := json.Marshal(resp.Data)
+	sum := sha256.Sum256(encoded)
+	return vaultSecret{
+		fields:   resp.Data,
+		revision: "sha256:" + hex.EncodeToString(sum[:])[:16],
+		lease:    time.Duration(resp.LeaseDuration) * time.Second,
+	}, nil
+}
+
+func (vs vaultSource) readKV2(cl *http.Client, token string,
+	location vaultLocation, mount string) (vaultSecret, error) {
+
+	apiPath := mount + "/data/" + strings.TrimPrefix(
+		strings.TrimPrefix(location.path, mount), "/")
+	if len(location.version) > 0 {
+		apiPath += "?version=" + location.version
+	}
+
+	var resp struct {
+		LeaseDuration int `json:"lease_duration"`
+		Data          struct {
+			Data     map[string]interface{} `json:"data"`
+			Metadata struct {
+				Version      int    `json:"version"`
+				DeletionTime string `json:"deletion_time"`
+				Destroyed    bool   `json:"destroyed"`
+			} `json:"metadata"`
+		} `json:"data"`
+	}
+	if err := vs.do(cl, http.MethodGet, location, apiPath, token,
+		nil, &resp); err != nil {
+		return vaultSecret{}, err
+	}
+
+	metadata := resp.Data.Metadata
+	if metadata.Destroyed || len(metadata.DeletionTime) > 0 || resp.Data.Data == nil {
+		return vaultSecret{}, errors.New(fmt.Sprintf(
+			"version %d of %s has been deleted", metadata.Version, location.path))
+	}
+	return vaultSecret{
+		fields:   resp.Data.Data,
+		revision: strconv.Itoa(metadata.Version),
+		lease:    time.Duration(resp.LeaseDuration) * time.Second,
+	}, nil
+}
+
+// token returns the Vault token from the credentials, logging in with the
+// kubernetes auth method when they give a role.
+func (vs vaultSource) token(cl *http.Client, creds *Credentials,
+	location vaultLocation) (string, error) {
+
+	if creds == nil {
+		return "", errors.New("vault needs an auth-secret with a token or role")
+	}
+	switch creds.Scheme {
+	case AuthBearer:
+		return creds.Token, nil
+	case AuthKubernetes:
+	default:
+		return "", errors.New("vault needs a token or role in the auth secret")
+	}
+
+	authPath := creds.AuthPath
+	if len(authPath) == 0 {
+		authPath = defaultVaultAuthPath
+	}
+	jwt := creds.JWT
+	sum := sha256.Sum256([]byte(jwt))
+	key := strings.Join([]string{location.address.String(), authPath, creds.Role,
+		hex.EncodeToString(sum[:])}, " ")
+	vs.mu.Lock()
+	login, ok := vs.logins[key]
+	vs.mu.Unlock()
+	if ok && vs.now().Before(login.renewAt) {
+		return login.token, nil
+	}
+
+	var resp struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	body := map[string]string{"role": creds.Role, "jwt": jwt}
+	if err := vs.do(cl, http.MethodPost, location,
+		"auth/"+strings.Trim(authPath, "/")+"/login", "", body, &resp); err != nil {
+		return "", errors.Wrapf(err, "unable to log in to vault as role %s", creds.Role)
+	}
+	if len(resp.Auth.ClientToken) == 0 {
+		return "", errors.New("vault login gave no token")
+	}
+
+	lease := time.Duration(resp.Auth.LeaseDuration) * time.Second
+	vs.mu.Lock()
+	vs.logins[key] = vaultLogin{
+		token:   resp.Auth.ClientToken,
+		renewAt: vs.now().Add(lease * 2 / 3),
+	}
+	vs.mu.Unlock()
+	return resp.Auth.ClientToken, nil
+}
+
+// do calls the Vault API at apiPath, decoding the response into out and
+// turning the errors Vault gives into ours.
+func (vs vaultSource) do(cl *http.Client, method string, location vaultLocation,
+	apiPath string, token string, body interface{}, out interface{}) error {
+
+	u, err := location.address.Parse(
+		strings.TrimSuffix(location.address.Path, "/") + "/v1/" + apiPath)
+	if err != nil {
+		return err
+	}
+
+	var reader *bytes.Reader
+	if body != nil {
+		encoded, _ := json.Marshal(body)
+		reader = bytes.NewReader(encoded)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, u.String(), reader)
+	if err != nil {
+		return err
+	}
+	if len(token) > 0 {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	resp, err := cl.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, err := readLimited(u.Path, resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(content, &vaultErr)
+		message := fmt.Sprintf("vault %s %s: %d %s", method, u.Path,
+			resp.StatusCode, http.StatusText(resp.StatusCode))
+		if len(vaultErr.Errors) > 0 {
+			message += ": " + strings.Join(vaultErr.Errors, ", ")
+		}
+		return errors.New(message)
+	}
+
+	if err := json.Unmarshal(content, out); err != nil {
+		return errors.Wrap(err, "unable to read the vault response")
+	}
+	return nil
+}
+
+// vaultValue is how a field is written into a key, strings as they are and
+// anything else as JSON.
+func vaultValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+func sortedFieldNames(fields map[string]interface{}) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
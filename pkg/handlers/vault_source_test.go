@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/JonPulfer/gofiggy/pkg/config"
+)
+
+// fakeVault serves a KV 2 engine at secret/ and a KV 1 engine at kv/ the way
+// a dev server would, logging in the service account jwt with kubernetes
+// auth.
+type fakeVault struct {
+	token    string
+	jwt      string
+	versions []map[string]interface{}
+	legacy   map[string]interface{}
+	logins   int
+}
+
+func (fv *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reply := func(status int, body interface{}) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+
+	if r.URL.Path == "/v1/auth/kubernetes/login" {
+		var login map[string]string
+		json.NewDecoder(r.Body).Decode(&login)
+		if login["jwt"] != fv.jwt || login["role"] != "gofiggy" {
+			reply(http.StatusForbidden, map[string]interface{}{
+				"errors": []string{"permission denied"}})
+			return
+		}
+		fv.logins++
+		reply(http.StatusOK, map[string]interface{}{"auth": map[string]interface{}{
+			"client_token": fv.token, "lease_duration": 3600}})
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != fv.token {
+		reply(http.StatusForbidden, map[string]interface{}{
+			"errors": []string{"permission denied"}})
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/sys/internal/ui/mounts/secret/"):
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"path": "secret/", "type": "kv",
+			"options": map[string]string{"version": "2"}}})
+	case strings.HasPrefix(r.URL.Path, "/v1/sys/internal/ui/mounts/kv/"):
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"path": "kv/", "type": "kv", "options": nil}})
+	case r.URL.Path == "/v1/secret/data/app/db":
+		version := len(fv.versions)
+		fmt.Sscanf(r.URL.Query().Get("version"), "%d", &version)
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"data":     fv.versions[version-1],
+			"metadata": map[string]interface{}{"version": version}}})
+	case r.URL.Path == "/v1/kv/legacy":
+		reply(http.StatusOK, map[string]interface{}{
+			"lease_duration": 60, "data": fv.legacy})
+	default:
+		reply(http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+	}
+}
+
+func TestProcessConfigMapFromVault(t *testing.T) {
+	vault := &fakeVault{
+		token: "s.gofiggy",
+		jwt:   "service-account-jwt",
+		versions: []map[string]interface{}{
+			{"username": "app", "password": "first", "port": 5432},
+		},
+		legacy: map[string]interface{}{"endpoint": "https://legacy.internal"},
+	}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	kubeClient := newFakeClientset()
+	kubeClient.CoreV1().Secrets("default").Create(&api_v1.Secret{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "vault-login"},
+		Data: map[string][]byte{
+			"role": []byte("gofiggy"),
+			"jwt":  []byte("service-account-jwt"),
+		},
+	})
+	kubeClient.CoreV1().Secrets("default").Create(&api_v1.Secret{
+		ObjectMeta: v1.ObjectMeta{Namespace: "default", Name: "vault-token"},
+		Data:       map[string][]byte{"token": []byte("s.gofiggy")},
+	})
+	kubeClient.CoreV1().ConfigMaps("default").Create(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: "default",
+			Name:      "from-vault",
+			Annotations: map[string]string{
+				CurlAnnotation: "db=vault://secret/app/db?sensitive=password auth-secret=vault-login\n" +
+					"first-user=vault://secret/app/db?version=1&field=username auth-secret=vault-token\n" +
+					"legacy=vault://kv/legacy?field=endpoint&kv=1 auth-secret=vault-token",
+			},
+		},
+		Data: map[string]string{},
+	})
+
+	cfg := testConfig()
+	cfg.Vault.Address = server.URL
+	wfh := newWebsiteFetchHandler(kubeClient, cfg)
+	now := time.Now()
+	source := wfh.sources["vault"].(vaultSource)
+	source.now = func() time.Time { return now }
+	wfh.sources["vault"] = source
+
+	configMap, _ := fetchConfigMap(kubeClient, "default", "from-vault")
+	if err := wfh.processConfigMap("default", configMap); err != nil {
+		t.Logf("error processConfigMap: %s", err.Error())
+		t.FailNow()
+	}
+
+	configMap, _ = fetchConfigMap(kubeClient, "default", "from-vault")
+	expected := map[string]string{
+		"username":   "app",
+		"port":       "5432",
+		"first-user": "app",
+		"legacy":     "https://legacy.internal",
+	}
+	for key, value := range expected {
+		if configMap.Data[key] != value {
+			t.Logf("expected %s=%q but got %q", key, value, configMap.Data[key])
+			t.FailNow()
+		}
+	}
+	if _, ok := configMap.Data["password"]; ok {
+		t.Log("expected the password to be kept out of the configMap")
+		t.FailNow()
+	}
+	secret, err := kubeClient.CoreV1().Secrets("default").
+		Get(configMap.Annotations[SensitiveSecretAnnotation], v1.GetOptions{})
+	if err != nil || string(secret.Data["password"]) != "first" ||
+		!ownedBy(secret.ObjectMeta, configMap) {
+		t.Logf("expected the password in the owned secret: %v %v", secret, err)
+		t.FailNow()
+	}
+	if readStatus(configMap).Entries["db"].Revision != "1" {
+		t.Logf("expected the version as the revision: %+v", readStatus(configMap))
+		t.FailNow()
+	}
+
+	// A new version is picked up when polling, the pinned entry stays put and
+	// the login is reused.
+	if wfh.revisionChanged(configMap) {
+		t.Log("expected no change before a new version")
+		t.FailNow()
+	}
+	vault.versions = append(vault.versions,
+		map[string]interface{}{"username": "app2", "password": "second", "port": 5432})
+	syncCaches(t, wfh, kubeClient)
+	handleQueued(wfh)
+	wfh.pollConfigMaps()
+	configMap, _ = fetchConfigMap(kubeClient, "default", "from-vault")
+	secret, _ = kubeClient.CoreV1().Secrets("default").
+		Get(sensitiveSecretName(configMap), v1.GetOptions{})
+	if configMap.Data["username"] != "app2" || configMap.Data["first-user"] != "app" ||
+		string(secret.Data["password"]) != "second" || vault.logins != 1 {
+		t.Logf("unexpected result after polling: %v %d logins", configMap.Data,
+			vault.logins)
+		t.FailNow()
+	}
+
+	// The KV 1 secret is fetched again once its lease is running out.
+	if wfh.revisionChanged(configMap) {
+		t.Log("expected no change within the lease")
+		t.FailNow()
+	}
+	now = now.Add(45 * time.Second)
+	if !wfh.revisionChanged(configMap) {
+		t.Log("expected a change once the lease needs renewing")
+		t.FailNow()
+	}
+}
+
+func TestVaultAddressMustBeConfigured(t *testing.T) {
+	source := newVaultSource(config.VaultConfig{
+		Address:        "https://vault.vault:8200",
+		OtherAddresses: []string{"https://vault.team-b:8200/"},
+	}, nil)
+
+	for site, expected := range map[string]string{
+		"vault://secret/app": "https://vault.vault:8200",
+		"vault://secret/app?address=https://vault.team-b:8200":       "https://vault.team-b:8200",
+		"vault://secret/app?address=https://attacker.example.com:80": "",
+	} {
+		u, _ := url.Parse(site)
+		location, err := source.location(u)
+		if len(expected) == 0 {
+			if err == nil {
+				t.Logf("expected %s to be refused", site)
+				t.FailNow()
+			}
+			continue
+		}
+		if err != nil || location.address.String() != expected {
+			t.Logf("expected %s for %s but got %v %v", expected, site,
+				location.address, err)
+			t.FailNow()
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	api_v1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VersionsAnnotation writes each change of content to a new configMap named
+// after the annotated one and a hash of the content, keeping the given
+// number of generations, like: -
+//
+//	x-k8s.io/curl-me-that-versions: "5"
+//
+// gives app-5f2b9c1d7e. Versions are never written to once created, so a
+// workload can pin one and be rolled back to an older one, as with the
+// kustomize configMapGenerator. The client-go version we build against
+// predates the configMap immutable field, so that is by convention only.
+const VersionsAnnotation = "x-k8s.io/curl-me-that-versions"
+
+// CurrentVersionAnnotation names the latest version on the annotated
+// configMap.
+const CurrentVersionAnnotation = "x-k8s.io/curl-me-that-current-version"
+
+// VersionOfLabel holds the UID of the configMap a version was written for.
+const VersionOfLabel = "x-k8s.io/curl-me-that-version-of"
+
+// GenerationAnnotation numbers the versions of a configMap from 1.
+const GenerationAnnotation = "x-k8s.io/curl-me-that-generation"
+
+// parseVersions returns the generations to keep, 0 when configMap isn't
+// versioned.
+func parseVersions(configMap *api_v1.ConfigMap) (int, error) {
+	raw := strings.TrimSpace(configMap.Annotations[VersionsAnnotation])
+	if len(raw) == 0 {
+		return 0, nil
+	}
+	keep, err := strconv.Atoi(raw)
+	if err != nil || keep < 1 {
+		return 0, errors.New(fmt.Sprintf(
+			"versions must be the number of generations to keep but got %s", raw))
+	}
+	return keep, nil
+}
+
+// versionName is the name of the version of configMap holding data.
+func versionName(configMap *api_v1.ConfigMap, data map[string]string) string {
+	hash := strings.TrimPrefix(contentChecksum(data), "sha256:")[:10]
+	base := configMap.Name
+	if len(base) > 253-len(hash)-1 {
+		base = base[:253-len(hash)-1]
+	}
+	return base + "-" + hash
+}
+
+// generation returns the GenerationAnnotation of a version.
+func generation(version api_v1.ConfigMap) int {
+	number, _ := strconv.Atoi(version.Annotations[GenerationAnnotation])
+	return number
+}
+
+// listVersions returns the versions of configMap, newest first.
+func (wfh WebsiteFetchHandler) listVersions(configMap *api_v1.ConfigMap) ([]api_v1.ConfigMap, error) {
+	if len(configMap.UID) == 0 {
+		return nil, nil
+	}
+	list, err := wfh.clientset.CoreV1().ConfigMaps(configMap.Namespace).List(
+		v1.ListOptions{LabelSelector: VersionOfLabel + "=" + string(configMap.UID)})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list versions")
+	}
+
+	var versions []api_v1.ConfigMap
+	for _, version := range list.Items {
+		if ownedBy(version.ObjectMeta, configMap) {
+			versions = append(versions, version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return generation(versions[i]) > generation(versions[j])
+	})
+	return versions, nil
+}
+
+// writeVersion writes the results to a new version of configMap, unless the
+// current one already holds them, and points the configMap at it. Nothing is
+// written when an entry failed, so that every version is complete. Versions
+// beyond the keep newest are removed.
+func (wfh WebsiteFetchHandler) writeVersion(configMap *api_v1.ConfigMap,
+	results fetchResults, status ConfigMapStatus, keep int) error {
+
+	original := configMap.DeepCopy()
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	if configMap.Annotations == nil {
+		configMap.Annotations = make(map[string]string)
+	}
+
+	// Keys written in place before the configMap was versioned are removed,
+	// only the sensitive keys in the Secret alongside are still managed.
+	previous := readManagedKeys(configMap.Annotations)
+	change := results.reconcileManaged(previous)
+	inPlace, _ := previous.keys()
+	previous.release(configMap.Data, missingKeys(inPlace, nil))
+	for entry, managed := range change.managed {
+		managed.Keys, managed.Hashes, managed.Bases = nil, nil, nil
+		if len(managed.Sensitive) == 0 {
+			delete(change.managed, entry)
+			continue
+		}
+		change.managed[entry] = managed
+	}
+	if err := wfh.syncSensitive(configMap, configMap, results,
+		change.sensitiveOrphans); err != nil {
+		return err
+	}
+
+	if len(results.failed) == 0 {
+		name, err := wfh.createVersion(configMap, results)
+		if err != nil {
+			return err
+		}
+		configMap.Annotations[CurrentVersionAnnotation] = name
+	}
+
+	status.Drift = readStatus(configMap).Drift
+	writeStatus(configMap, status)
+	setBinaryKeys(configMap, nil)
+	writeManagedKeys(configMap.Annotations, change.managed)
+	if _, err := patchConfigMap(wfh.clientset, original, configMap); err != nil {
+		return err
+	}
+	wfh.configMapWritten(original, configMap)
+	return wfh.pruneVersions(configMap, keep)
+}
+
+// createVersion creates the version of configMap holding the results,
+// returning its name. A version with the same content is used as it is.
+func (wfh WebsiteFetchHandler) createVersion(configMap *api_v1.ConfigMap,
+	results fetchResults) (string, error) {
+
+	data := make(map[string]string)
+	var binaryKeys []string
+	for key, value := range results.data {
+		data[key] = value
+	}
+	for key, value := range results.binary {
+		data[key] = base64.StdEncoding.EncodeToString(value)
+		binaryKeys = append(binaryKeys, key)
+	}
+	name := versionName(configMap, data)
+
+	configMaps := wfh.clientset.CoreV1().ConfigMaps(configMap.Namespace)
+	existing, err := configMaps.Get(name, v1.GetOptions{})
+	switch {
+	case err == nil && ownedBy(existing.ObjectMeta, configMap):
+		return name, nil
+	case err == nil:
+		return "", errors.New(fmt.Sprintf(
+			"version %s already exists and is not owned by %s", name, configMap.Name))
+	case !k8s_errors.IsNotFound(err):
+		return "", errors.Wrapf(err, "unable to read version %s", name)
+	}
+
+	versions, err := wfh.listVersions(configMap)
+	if err != nil {
+		return "", err
+	}
+	next := 1
+	if len(versions) > 0 {
+		next = generation(versions[0]) + 1
+	}
+
+	version := &api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace:       configMap.Namespace,
+			Name:            name,
+			Labels:          map[string]string{VersionOfLabel: string(configMap.UID)},
+			Annotations:     map[string]string{GenerationAnnotation: strconv.Itoa(next)},
+			OwnerReferences: []v1.OwnerReference{ownerReference(configMap)},
+		},
+		Data: data,
+	}
+	setBinaryKeys(version, binaryKeys)
+	if _, err := configMaps.Create(version); err != nil {
+		return "", errors.Wrapf(err, "unable to create version %s", name)
+	}
+	wfh.recorder.Normal(configMap, "VersionCreated", fmt.Sprintf(
+		"created version %s, generation %d", name, next))
+	return name, nil
+}
+
+// pruneVersions removes the versions of configMap beyond the keep newest,
+// never removing the current one.
+func (wfh WebsiteFetchHandler) pruneVersions(configMap *api_v1.ConfigMap, keep int) error {
+	versions, err := wfh.listVersions(configMap)
+	if err != nil || len(versions) <= keep {
+		return err
+	}
+
+	for _, version := range versions[keep:] {
+		if version.Name == configMap.Annotations[CurrentVersionAnnotation] {
+			continue
+		}
+		if err := wfh.clientset.CoreV1().ConfigMaps(configMap.Namespace).
+			Delete(version.Name, nil); err != nil && !k8s_errors.IsNotFound(err) {
+			return errors.Wrapf(err, "unable to delete version %s", version.Name)
+		}
+	}
+	return nil
+}
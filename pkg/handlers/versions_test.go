@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	api_v1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProcessConfigMapWithVersions(t *testing.T) {
+	replicas := "replicas: 1\n"
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if len(replicas) == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprint(w, replicas)
+		}))
+	defer server.Close()
+
+	kubeClient := newFakeClientset(&api_v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Namespace: "default",
+			Name:      "app",
+			UID:       "app-uid",
+			Annotations: map[string]string{
+				CurlAnnotation:     "app.yaml=" + server.URL,
+				VersionsAnnotation: "2",
+			},
+		},
+		Data: map[string]string{"by-hand": "keep me"},
+	})
+
+	wfh := newWebsiteFetchHandler(kubeClient, testConfig())
+	process := func(content string) (*api_v1.ConfigMap, error) {
+		replicas = content
+		configMap, _ := fetchConfigMap(kubeClient, "default", "app")
+		err := wfh.processConfigMap("default", configMap)
+		configMap, _ = fetchConfigMap(kubeClient, "default", "app")
+		return configMap, err
+	}
+	versions := func() []api_v1.ConfigMap {
+		source, _ := fetchConfigMap(kubeClient, "default", "app")
+		versions, _ := wfh.listVersions(source)
+		return versions
+	}
+
+	configMap, err := process("replicas: 1\n")
+	current := configMap.Annotations[CurrentVersionAnnotation]
+	version, _ := fetchConfigMap(kubeClient, "default", current)
+	if err != nil || version == nil || version.Data["app.yaml"] != "replicas: 1\n" ||
+		generation(*version) != 1 || len(configMap.Data) != 1 {
+		t.Logf("unexpected version %+v of %+v: %v", version, configMap, err)
+		t.FailNow()
+	}
+
+	// The same content is the same version.
+	configMap, _ = process("replicas: 1\n")
+	if configMap.Annotations[CurrentVersionAnnotation] != current || len(versions()) != 1 {
+		t.Logf("expected the version to be kept: %+v", versions())
+		t.FailNow()
+	}
+
+	// New content is a new version, and the oldest are pruned.
+	process("replicas: 2\n")
+	configMap, _ = process("replicas: 3\n")
+	kept := versions()
+	if len(kept) != 2 || generation(kept[0]) != 3 ||
+		configMap.Annotations[CurrentVersionAnnotation] != kept[0].Name {
+		t.Logf("expected generations 3 and 2 to be kept: %+v", kept)
+		t.FailNow()
+	}
+	if _, err := fetchConfigMap(kubeClient, "default", current); err == nil {
+		t.Log("expected the first version to be pruned")
+		t.FailNow()
+	}
+
+	// A failed fetch leaves the current version alone.
+	current = configMap.Annotations[CurrentVersionAnnotation]
+	configMap, err = process("")
+	if err == nil || configMap.Annotations[CurrentVersionAnnotation] != current {
+		t.Logf("expected the current version to be kept: %+v", configMap)
+		t.FailNow()
+	}
+
+	configMap.Annotations[TargetAnnotation] = "app-config"
+	if err := wfh.processConfigMap("default", configMap); err == nil {
+		t.Log("expected versions and a target to be rejected")
+		t.FailNow()
+	}
+}
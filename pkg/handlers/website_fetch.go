@@ -2,12 +2,15 @@ package handlers
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
@@ -15,26 +18,56 @@ import (
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 
+	"github.com/JonPulfer/gofiggy/pkg/config"
+	"github.com/JonPulfer/gofiggy/pkg/egress"
 	"github.com/JonPulfer/gofiggy/pkg/events"
 	"github.com/JonPulfer/gofiggy/pkg/utils"
 )
 
 const CurlAnnotation = "x-k8s.io/curl-me-that"
 
+// BinaryKeysAnnotation lists the keys holding base64 encoded binary files. The
+// client-go version we build against predates the configMap binaryData field
+// so binaries are stored in Data and consumers decode the keys listed here.
+const BinaryKeysAnnotation = "x-k8s.io/curl-me-that-binary-keys"
+
 type WebsiteFetchHandler struct {
-	logger    zerolog.Logger
-	clientset kubernetes.Interface
+	logger      zerolog.Logger
+	clientset   kubernetes.Interface
+	recorder    events.Recorder
+	credentials *credentialCache
+	transports  *transportCache
+	sources     map[string]Source
+	rollouts    *rollouts
+	expiries    *expiries
+	caches      *caches
 }
 
 // WebsiteFetchHandler watches for creation and updates to configmaps to see
 // whether the annotation `x-k8s.io/curl-me-that:` has appeared. We parse the
 // data from the annotation using `parseAnnotationData()` to extract the site
 // and key. We then fetch the content from the site and update the config map
-// setting the key and adding the site content as the data.
-func NewWebsiteFetchHandler() WebsiteFetchHandler {
+// setting the key and adding the site content as the data. Changes to secrets
+// are watched too so that entries using them for credentials are refetched.
+// The TLS profiles in cfg can be chosen by entries with the `tls` option.
+func NewWebsiteFetchHandler(cfg config.Config) WebsiteFetchHandler {
+	return newWebsiteFetchHandler(utils.GetClient(), cfg)
+}
+
+func newWebsiteFetchHandler(clientset kubernetes.Interface,
+	cfg config.Config) WebsiteFetchHandler {
+
+	transports := newTransportCache(clientset, cfg)
 	return WebsiteFetchHandler{
-		logger:    zerolog.New(os.Stderr).With().Timestamp().Logger(),
-		clientset: utils.GetClient(),
+		logger:      zerolog.New(os.Stderr).With().Timestamp().Logger(),
+		clientset:   clientset,
+		recorder:    events.NewRecorder(clientset),
+		credentials: newCredentialCache(clientset),
+		transports:  transports,
+		sources:     newSources(clientset, cfg, transports),
+		rollouts:    newRollouts(cfg.Rollouts),
+		expiries:    newExpiries(),
+		caches:      newCaches(),
 	}
 }
 
@@ -43,27 +76,41 @@ func (wfh WebsiteFetchHandler) ObjectCreated(obj interface{}) {
 	wfh.logger.Log().Fields(map[string]interface{}{"event": ev}).
 		Msg("received created event")
 
+	if ev.Kind == "secret" {
+		wfh.secretChanged(ev)
+		return
+	}
+
 	wfh.logger.Log().Fields(map[string]interface{}{"event": ev}).
 		Msg("fetching config map")
 
-	configMap, err := fetchConfigMap(wfh.clientset, "default",
+	namespace := namespaceFromName(ev.Name)
+	configMap, err := fetchConfigMap(wfh.clientset, namespace,
 		stripNamespaceFromName(ev.Name))
 	if err != nil {
 		wfh.logger.Log().Msg(err.Error())
 	}
-	wfh.logger.Log().Fields(map[string]interface{}{"configMaps": configMap}).
+	wfh.logger.Log().Fields(map[string]interface{}{"configMaps": logSafe(configMap)}).
 		Msg("response from fetchConfigMap")
 
-	if err := processConfigMap(wfh.clientset, "default", configMap); err != nil {
+	if err := wfh.processConfigMap(namespace, configMap); err != nil {
 		wfh.logger.Log().Err(err).
 			Msg("failed to process the created configMap")
 	}
+	wfh.configMapChanged(ev)
 }
 
 func (wfh WebsiteFetchHandler) ObjectDeleted(obj interface{}) {
 	ev := events.New(obj, "deleted")
 	wfh.logger.Log().Fields(map[string]interface{}{"event": ev}).
 		Msg("received deleted event")
+
+	if ev.Kind == "secret" {
+		wfh.secretChanged(ev)
+		return
+	}
+	forgetStaleness(namespaceFromName(ev.Name), stripNamespaceFromName(ev.Name))
+	wfh.configMapChanged(ev)
 }
 
 func (wfh WebsiteFetchHandler) ObjectUpdated(oldObj interface{}, newObj interface{}) {
@@ -71,28 +118,134 @@ func (wfh WebsiteFetchHandler) ObjectUpdated(oldObj interface{}, newObj interfac
 	wfh.logger.Log().Fields(map[string]interface{}{"event": ev}).
 		Msg("received updated event")
 
+	if ev.Kind == "secret" {
+		wfh.secretChanged(ev)
+		return
+	}
+
 	wfh.logger.Log().Fields(map[string]interface{}{"event": ev}).
 		Msg("fetching config map")
 
-	configMap, err := fetchConfigMap(wfh.clientset, "default",
+	namespace := namespaceFromName(ev.Name)
+	configMap, err := fetchConfigMap(wfh.clientset, namespace,
 		stripNamespaceFromName(ev.Name))
 	if err != nil {
 		wfh.logger.Log().Msg(err.Error())
 	}
-	wfh.logger.Log().Fields(map[string]interface{}{"configMaps": configMap}).
+	wfh.logger.Log().Fields(map[string]interface{}{"configMaps": logSafe(configMap)}).
 		Msg("response from fetchConfigMap")
 
-	if err := processConfigMap(wfh.clientset, "default", configMap); err != nil {
+	if configMap != nil {
+		configMap, err = wfh.handleDrift(configMap)
+		if err != nil {
+			wfh.logger.Log().Err(err).Msg("failed to handle drift")
+		}
+	}
+	// Only a refresh queued by the controller fetches over a kept edit.
+	if configMap != nil && !events.IsQueued(newObj) && wfh.keepingEdit(configMap) {
+		wfh.logger.Log().Str("configMap", configMap.Name).
+			Msg("keeping an edit until the next refresh")
+		configMap = nil
+	}
+	if err := wfh.processConfigMap(namespace, configMap); err != nil {
 		wfh.logger.Log().Err(err).
 			Msg("failed to process the updated configMap")
 	}
+	// A configMap queued to be processed again hasn't itself changed, and
+	// its dependents are queued by the update writing it would raise.
+	if !events.IsQueued(newObj) {
+		wfh.configMapChanged(ev)
+	}
+}
+
+// configMapChanged forgets any TLS material read from the configMap and
+// processes the configMaps copying keys from it again.
+func (wfh WebsiteFetchHandler) configMapChanged(ev events.Event) {
+	ref := objectReference{
+		Kind:      "configmap",
+		Namespace: namespaceFromName(ev.Name),
+		Name:      stripNamespaceFromName(ev.Name),
+	}
+	wfh.transports.forgetUsing(ref)
+	wfh.processDependents(ref)
+}
+
+// secretChanged forgets any credentials and TLS material we have cached from
+// the secret and processes the configMaps using it again so that they pick up
+// the change.
+func (wfh WebsiteFetchHandler) secretChanged(ev events.Event) {
+	ref := objectReference{
+		Kind:      "secret",
+		Namespace: namespaceFromName(ev.Name),
+		Name:      stripNamespaceFromName(ev.Name),
+	}
+	wfh.credentials.forget(ref.Namespace, ref.Name)
+	wfh.transports.forgetUsing(ref)
+	wfh.processDependents(ref)
 }
 
 // FetchRequest holds the URL of the site we want to fetch the content from and
-// the key name to add the content to the config map with.
+// the key name to add the content to the config map with. Any options given
+// after the site in the annotation entry are recorded alongside.
 type FetchRequest struct {
-	IntoKey  string
-	FromSite *url.URL
+	IntoKey     string
+	FromSite    *url.URL
+	Extract     []Extraction
+	Template    string
+	TemplateKey string
+	Format      string
+	InputFormat string
+	Flatten     bool
+	Separator   string
+	Archive     ArchiveOptions
+	AuthSecret  string
+	TLSProfile  string
+
+	Method       string
+	Header       http.Header
+	Body         string
+	BodyKey      string
+	BodyTemplate string
+	Retries      int
+	Idempotent   bool
+
+	// Sensitive entries are written to the Secret alongside the configMap,
+	// of SecretType when given, and their values are never logged.
+	Sensitive  bool
+	SecretType string
+
+	// Write is how fetched values are written into keys that already have
+	// one, with Join between appended and prepended values.
+	Write string
+	Join  *string
+
+	// Staged entries are checked before they go live, against the JSON
+	// Schema in SchemaKey and changing no more than MaxChange of the lines
+	// of the current value when those are given, see validateStaged.
+	Stage     bool
+	SchemaKey string
+	MaxChange float64
+
+	// MaxStaleness is how long the last good value is kept while the entry
+	// is failing, before it is cleared or Fallback written in its place.
+	MaxStaleness time.Duration
+	Fallback     *string
+
+	// credentials are read from the AuthSecret before the fetch is made.
+	credentials *Credentials
+	// body is the request body once it has been resolved.
+	body string
+	// client makes the fetch with the TLSProfile and egress policy that
+	// apply to the entry.
+	client *http.Client
+}
+
+// keySeparator joins the parts of a path into a configMap key.
+func (fr FetchRequest) keySeparator() string {
+	if len(fr.Separator) == 0 {
+		return defaultSeparator
+	}
+	return fr.Separator
 }
 
 // parseAnnotationData into a FetchRequest. We parse the content of the
@@ -102,17 +255,36 @@ type FetchRequest struct {
 //
 // From this we would convert `curl-a-joke.herokuapp.com` into a url.URL and
 // set it as the FromSite. We would take `joke` and set that as the IntoKey.
+// Sites without a scheme are fetched over http, other schemes are fetched by
+// the Source registered for them, see newSources. The site can be followed by
+// whitespace separated `name=value` options, see entryOptions for those we
+// understand.
 func parseAnnotationData(annotationData string) (*FetchRequest, error) {
-	parts := strings.Split(annotationData, "=")
-	if len(parts) != 2 {
+	fields, err := splitEntryFields(annotationData)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
 		return nil, errors.New(
 			fmt.Sprintf(
 				"unexpected value provided for annotationData: %s",
 				annotationData))
 	}
 
+	parts := strings.SplitN(fields[0], "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return nil, errors.New(
+			fmt.Sprintf(
+				"unexpected value provided for annotationData: %s",
+				annotationData))
+	}
+
+	if err := validateKey(parts[0]); err != nil {
+		return nil, err
+	}
+
 	withScheme := parts[1]
-	if !strings.Contains(withScheme, "http") {
+	if !strings.Contains(withScheme, "://") {
 		withScheme = "http://" + withScheme
 	}
 
@@ -121,26 +293,64 @@ func parseAnnotationData(annotationData string) (*FetchRequest, error) {
 		return nil, err
 	}
 
-	return &FetchRequest{IntoKey: parts[0], FromSite: websiteURL}, nil
+	fReq := &FetchRequest{IntoKey: parts[0], FromSite: websiteURL}
+	for _, option := range fields[1:] {
+		if err := applyEntryOption(fReq, option); err != nil {
+			return nil, errors.Wrapf(err, "entry %s", fReq.IntoKey)
+		}
+	}
+	if err := validateRequestOptions(fReq); err != nil {
+		return nil, errors.Wrapf(err, "entry %s", fReq.IntoKey)
+	}
+
+	return fReq, nil
 }
 
 // FetchResponse provides the content that will be placed in the config map that
 // requested it via the annotation.
 type FetchResponse struct {
-	Key   string
-	Value string
+	Key        string
+	Value      string
+	Data       map[string]string
+	BinaryData map[string][]byte
+	Header     http.Header
+	// Revision identifies the version of the content for sources that have
+	// one, such as the commit for a git repository.
+	Revision string
+	// Sensitive values are written to the Secret alongside the configMap
+	// rather than into it.
+	Sensitive map[string][]byte
+}
+
+// Entries returns the keys and values to write into the config map. When
+// fields have been extracted into Data those are written in place of the
+// whole response.
+func (fr FetchResponse) Entries() map[string]string {
+	if fr.Data != nil {
+		return fr.Data
+	}
+	return map[string]string{fr.Key: fr.Value}
 }
 
 func (fr FetchResponse) String() string {
+	if len(fr.Sensitive) > 0 {
+		return fmt.Sprintf("%s=<redacted>", fr.Key)
+	}
 	return fmt.Sprintf("%s=%s", fr.Key, fr.Value)
 }
 
-// fetchSiteData makes a simple http GET request to fetch data from the site in
-// the provided FetchRequest. The result holds the Key and site data as the
-// value.
+// fetchSiteData makes an http request, a GET unless the entry asks for
+// another method, to fetch data from the site in the provided FetchRequest.
+// The result holds the Key and site data as the value.
 func fetchSiteData(fRequest *FetchRequest) (*FetchResponse, error) {
-	cl := http.Client{}
-	resp, err := cl.Get(fRequest.FromSite.String())
+	cl := fRequest.client
+	if cl == nil {
+		cl = &http.Client{}
+	}
+	if fRequest.credentials != nil {
+		cl = fRequest.credentials.guardRedirects(cl)
+	}
+	resp, err := doRequest(cl, fRequest)
 	if err != nil {
 		return nil, err
 	}
@@ -155,10 +365,13 @@ func fetchSiteData(fRequest *FetchRequest) (*FetchResponse, error) {
 	var buf bytes.Buffer
 	io.Copy(&buf, resp.Body)
 
-	return &FetchResponse{
-		Key:   fRequest.IntoKey,
-		Value: buf.String(),
-	}, nil
+	fResp := &FetchResponse{
+		Key:    fRequest.IntoKey,
+		Value:  buf.String(),
+		Header: resp.Header,
+	}
+
+	return fResp, nil
 }
 
 // fetchConfigMap using a kubernetes client.
@@ -174,39 +387,327 @@ func fetchConfigMap(kubeClient kubernetes.Interface, namespace string,
 	return configMap, nil
 }
 
+// prepareRequest resolves anything the entry refers to that is needed before
+// the fetch can be made, such as the credentials in its AuthSecret and the
+// request body.
+func (wfh WebsiteFetchHandler) prepareRequest(namespace string,
+	fRequest *FetchRequest, configMap *api_v1.ConfigMap) error {
+
+	if err := resolveRequestBody(fRequest, configMap); err != nil {
+		return err
+	}
+
+	if len(fRequest.AuthSecret) > 0 {
+		creds, err := wfh.credentials.get(namespace, fRequest.AuthSecret)
+		if err != nil {
+			return err
+		}
+		fRequest.credentials = &creds
+	}
+
+	return nil
+}
+
+// fetchEntry fetches the content for a single annotation entry and applies any
+// of the transformations requested by its options.
+func (wfh WebsiteFetchHandler) fetchEntry(namespace string,
+	fRequest *FetchRequest, configMap *api_v1.ConfigMap) (*FetchResponse, error) {
+
+	if err := wfh.prepareRequest(namespace, fRequest, configMap); err != nil {
+		return nil, err
+	}
+
+	source, err := wfh.source(fRequest.FromSite)
+	if err != nil {
+		return nil, err
+	}
+
+	fResp, err := source.Fetch(namespace, fRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fRequest.Archive.Format) > 0 {
+		if err := expandArchive(fRequest, fResp); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := extractFields(fRequest, fResp); err != nil {
+		return nil, err
+	}
+
+	if err := convertFormat(fRequest, fResp); err != nil {
+		return nil, err
+	}
+
+	if err := renderTemplate(fRequest, fResp, configMap); err != nil {
+		return nil, err
+	}
+
+	if fRequest.Sensitive {
+		markSensitive(fResp)
+	}
+
+	return fResp, nil
+}
+
 // processConfigMap to see whether it has the appropriate annotation. Extract
-// the site data request from the annotation and then add the data field with
-// the request key.
-func processConfigMap(
-	kubeClient kubernetes.Interface,
+// the site data requests from the annotation and then add the data fields
+// with the request keys. The outcome of each entry is recorded in the
+// StatusAnnotation and failures are raised as Warning events. When the
+// TargetAnnotation names another object everything is written there instead
+// and the configMap itself is left alone. With the VersionsAnnotation it is
+// written to a new configMap each time it changes. Staged entries only go
+// live once they pass validation, and failing entries keep their last good
+// value, see keepLastGood. What we write is kept in a history that
+// the RollbackAnnotation restores from.
+func (wfh WebsiteFetchHandler) processConfigMap(
 	namespace string,
 	configMap *api_v1.ConfigMap) error {
-	if configMap != nil {
-		if configMapHasAnnotation(configMap) {
-			fReq, err := parseAnnotationData(configMap.Annotations[CurlAnnotation])
-			if err != nil {
+	if configMap == nil {
+		return nil
+	}
+
+	target, targetErr := parseTarget(configMap)
+	versions, versionsErr := parseVersions(configMap)
+	// A target annotation that doesn't parse is reported below and leaves
+	// the current target alone.
+	if targetErr == nil && (!configMapHasAnnotation(configMap) || target == nil) {
+		if err := wfh.pruneTargets(configMap, nil); err != nil {
+			return err
+		}
+	}
+	if !configMapHasAnnotation(configMap) {
+		forgetStaleness(configMap.Namespace, configMap.Name)
+		_, err := wfh.releaseConfigMap(configMap)
+		return err
+	}
+
+	if len(configMap.Annotations[RollbackAnnotation]) > 0 && targetErr == nil {
+		return wfh.rollback(configMap, target, versions)
+	}
+
+	if wfh.paused(configMap, target) {
+		wfh.logger.Log().Str("configMap", configMap.Name).
+			Msg("skipping paused configMap")
+		return nil
+	}
+
+	kubeClient, recorder := wfh.clientset, wfh.recorder
+
+	fReqs, err := parseAnnotationEntries(configMap.Annotations[CurlAnnotation])
+	if err == nil {
+		err = targetErr
+	}
+	if err == nil {
+		err = versionsErr
+	}
+	if _, historyErr := parseHistory(configMap); err == nil {
+		err = historyErr
+	}
+	if err == nil && versions > 0 && target != nil {
+		err = errors.New("versions cannot be combined with a target")
+	}
+	if err != nil {
+		recorder.Warning(configMap, "InvalidAnnotation", err.Error())
+		original := configMap.DeepCopy()
+		if target == nil && targetErr == nil &&
+			writeStatus(configMap, ConfigMapStatus{
+				Error: err.Error(),
+				Drift: readStatus(configMap).Drift,
+			}) {
+			if _, err := patchConfigMap(kubeClient, original, configMap); err != nil {
 				return err
 			}
-			fResp, err := fetchSiteData(fReq)
-			if err != nil {
-				return err
+		}
+		return err
+	}
+
+	status := ConfigMapStatus{Entries: make(map[string]EntryStatus)}
+	previous := wfh.currentStatus(configMap)
+	results := newFetchResults()
+	stage := newStaging()
+	var live map[string]string
+	var failed []string
+	for _, fReq := range fReqs {
+		results.hasSensitive = results.hasSensitive || fReq.mayBeSensitive()
+		fResp, err := wfh.fetchEntry(namespace, fReq, configMap)
+		if err != nil {
+			state, reason := StateFailed, "FetchFailed"
+			if _, denied := egress.AsDenied(err); denied {
+				state, reason = StateDenied, "EgressDenied"
+			} else if fReq.mayBeSensitive() {
+				err = errSensitiveFailure
 			}
-			configMap.Data[fResp.Key] = fResp.Value
-			if err := updateConfigMap(kubeClient, namespace, configMap); err != nil {
-				return err
+			status.Entries[fReq.IntoKey] = EntryStatus{
+				State:   state,
+				Message: err.Error(),
+			}
+			if fReq.staged() {
+				stage.status[fReq.IntoKey] = status.Entries[fReq.IntoKey]
+			}
+			recorder.Warning(configMap, reason,
+				fmt.Sprintf("%s: %s", fReq.IntoKey, err.Error()))
+			failed = append(failed, fReq.IntoKey)
+			if wfh.keepLastGood(configMap, fReq, status, previous, results) {
+				results.failed = append(results.failed, fReq.IntoKey)
 			}
+			continue
+		}
+
+		if fReq.staged() {
+			if live == nil {
+				if live, err = wfh.liveData(configMap, target); err != nil {
+					return err
+				}
+			}
+			if err := stage.add(fReq, fResp, configMap, live); err != nil {
+				status.Entries[fReq.IntoKey] = EntryStatus{
+					State:   StateRejected,
+					Message: err.Error(),
+				}
+				recorder.Warning(configMap, "ValidationFailed",
+					fmt.Sprintf("%s: %s", fReq.IntoKey, err.Error()))
+				failed = append(failed, fReq.IntoKey)
+				if wfh.keepLastGood(configMap, fReq, status, previous, results) {
+					results.failed = append(results.failed, fReq.IntoKey)
+				}
+				continue
+			}
+		}
+
+		results.add(fReq, fResp)
+		if err := results.setSecretType(fReq); err != nil {
+			return err
 		}
+		status.Entries[fReq.IntoKey] = EntryStatus{
+			State:    StateSynced,
+			Revision: fResp.Revision,
+		}
+	}
+
+	recordStaleness(configMap, status)
+	if err := wfh.writeStaging(configMap, stage); err != nil {
+		return err
+	}
+	if target != nil {
+		err = wfh.writeTarget(configMap, *target, results, status)
+	} else if versions > 0 {
+		err = wfh.writeVersion(configMap, results, status, versions)
+	} else {
+		err = wfh.writeInPlace(configMap, results, status)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(failed) > 0 {
+		return errors.New(
+			fmt.Sprintf("failed to process entries: %s",
+				strings.Join(failed, ", ")))
 	}
 
 	return nil
 }
 
-// updateConfigMap applies the changed configMap to the namespace.
-func updateConfigMap(kubeClient kubernetes.Interface, namespace string,
-	configMap *api_v1.ConfigMap) error {
+// fetchResults gathers what the entries of a configMap fetched.
+type fetchResults struct {
+	data      map[string]string
+	binary    map[string][]byte
+	sensitive map[string][]byte
+	// secretType is the type of the Secret sensitive values are written to.
+	secretType string
+	// hasSensitive is set when any entry writes sensitive values, even if
+	// it failed this time, so that their Secret is kept.
+	hasSensitive bool
+	// managed are the keys written by each entry, and failed the entries
+	// that wrote nothing this time.
+	managed managedKeys
+	failed  []string
+	// requests are the entries that wrote each key of data.
+	requests map[string]*FetchRequest
+}
+
+func newFetchResults() fetchResults {
+	return fetchResults{
+		data:      make(map[string]string),
+		binary:    make(map[string][]byte),
+		sensitive: make(map[string][]byte),
+		managed:   make(managedKeys),
+		requests:  make(map[string]*FetchRequest),
+	}
+}
+
+func (fr fetchResults) add(fReq *FetchRequest, fResp *FetchResponse) {
+	fr.managed[fReq.IntoKey] = managedEntryFor(fResp)
+	for key, value := range fResp.Entries() {
+		fr.data[key] = value
+		fr.requests[key] = fReq
+	}
+	for key, value := range fResp.BinaryData {
+		fr.binary[key] = value
+	}
+	for key, value := range fResp.Sensitive {
+		fr.sensitive[key] = value
+	}
+}
+
+// writeInPlace writes the results into the configMap they were fetched for,
+// with sensitive values in the Secret alongside it.
+func (wfh WebsiteFetchHandler) writeInPlace(configMap *api_v1.ConfigMap,
+	results fetchResults, status ConfigMapStatus) error {
 
-	_, err := kubeClient.CoreV1().ConfigMaps(namespace).Update(configMap)
-	return err
+	original := configMap.DeepCopy()
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	previous := readManagedKeys(configMap.Annotations)
+	change := results.reconcileManaged(previous)
+	previous.release(configMap.Data, change.orphans)
+
+	values, err := results.layer(configMap.Data, previous, change)
+	if err != nil {
+		return err
+	}
+	binaryKeys := keptBinaryKeys(configMap.Annotations, change.kept)
+	for key, value := range values {
+		configMap.Data[key] = value
+	}
+	for key, value := range results.binary {
+		configMap.Data[key] = base64.StdEncoding.EncodeToString(value)
+		binaryKeys = append(binaryKeys, key)
+	}
+
+	if err := wfh.syncSensitive(configMap, configMap, results,
+		change.sensitiveOrphans); err != nil {
+		return err
+	}
+
+	status.Drift = readStatus(configMap).Drift
+	writeStatus(configMap, status)
+	setBinaryKeys(configMap, binaryKeys)
+	delete(configMap.Annotations, CurrentVersionAnnotation)
+	delete(configMap.Annotations, KeptEditAnnotation)
+	change.managed.hash(configMap.Data)
+	writeManagedKeys(configMap.Annotations, change.managed)
+	if _, err := patchConfigMap(wfh.clientset, original, configMap); err != nil {
+		return err
+	}
+	wfh.configMapWritten(original, configMap)
+	return wfh.recordHistory(configMap, configMap, results.entrySources(), 0)
+}
+
+// setBinaryKeys records which keys hold base64 encoded binaries in the
+// BinaryKeysAnnotation, removing it when there are none.
+func setBinaryKeys(configMap *api_v1.ConfigMap, binaryKeys []string) {
+	if len(binaryKeys) == 0 {
+		delete(configMap.Annotations, BinaryKeysAnnotation)
+		return
+	}
+
+	sort.Strings(binaryKeys)
+	configMap.Annotations[BinaryKeysAnnotation] = strings.Join(binaryKeys, ",")
 }
 
 // configMapHasAnnotation indicates whether this configMap has the annotation
@@ -218,6 +719,16 @@ func configMapHasAnnotation(configMap *api_v1.ConfigMap) bool {
 	return false
 }
 
+// namespaceFromName returns the namespace part of a name received from an
+// event, falling back to the default namespace when there isn't one.
+func namespaceFromName(raw string) string {
+	parts := strings.Split(raw, "/")
+	if len(parts) != 2 {
+		return "default"
+	}
+	return parts[0]
+}
+
 // stripNamespaceFromName when received from an event the resource name includes
 // the namespace with a forward slash separator.
 func stripNamespaceFromName(raw string) string {
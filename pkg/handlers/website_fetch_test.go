@@ -5,7 +5,8 @@ import (
 
 	api_v1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/JonPulfer/gofiggy/pkg/config"
 )
 
 func TestParseAnnotationData(t *testing.T) {
@@ -69,7 +70,7 @@ func TestFetchConfigMap(t *testing.T) {
 		Data: map[string]string{},
 	}
 
-	kubeClient := fake.NewSimpleClientset()
+	kubeClient := newFakeClientset()
 	kubeClient.CoreV1().ConfigMaps("default").Create(configMapToCreate)
 	configMap, err := fetchConfigMap(kubeClient, "default", "simple-config")
 	if err != nil {
@@ -95,10 +96,11 @@ func TestProcessConfigMap(t *testing.T) {
 		Data: map[string]string{},
 	}
 
-	kubeClient := fake.NewSimpleClientset()
+	kubeClient := newFakeClientset()
 	kubeClient.CoreV1().ConfigMaps("default").Create(configMapToCreate)
 
-	err := processConfigMap(kubeClient, "default", configMapToCreate)
+	wfh := newWebsiteFetchHandler(kubeClient, config.Config{})
+	err := wfh.processConfigMap("default", configMapToCreate)
 	if err != nil {
 		t.Logf("error processConfigMap: %s", err.Error())
 		t.FailNow()
@@ -129,7 +131,7 @@ func TestProcessConfigMap(t *testing.T) {
 	kubeClient.CoreV1().ConfigMaps("default").
 		Create(plainConfigMapToCreate)
 
-	err = processConfigMap(kubeClient, "default", plainConfigMapToCreate)
+	err = wfh.processConfigMap("default", plainConfigMapToCreate)
 	if err != nil {
 		t.Logf("error processConfigMap: %s", err.Error())
 		t.FailNow()
@@ -149,3 +151,42 @@ func TestProcessConfigMap(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestParseAnnotationEntries(t *testing.T) {
+	annotation := `joke=curl-a-joke.herokuapp.com
+release=api.example.com/latest extract.version=.release.tag extract.url="{.assets[0].href}"
+`
+	fetchReqs, err := parseAnnotationEntries(annotation)
+	if err != nil {
+		t.Logf("failed to parse the annotation entries: %s\n", err.Error())
+		t.FailNow()
+	}
+
+	if len(fetchReqs) != 2 {
+		t.FailNow()
+	}
+
+	release := fetchReqs[1]
+	if release.IntoKey != "release" || release.FromSite.Host != "api.example.com" {
+		t.FailNow()
+	}
+
+	if len(release.Extract) != 2 {
+		t.FailNow()
+	}
+
+	if release.Extract[1].IntoKey != "url" ||
+		release.Extract[1].Expression != "{.assets[0].href}" {
+		t.FailNow()
+	}
+
+	if _, err := parseAnnotationEntries("joke=a.com\njoke=b.com"); err == nil {
+		t.Log("expected duplicate keys to be rejected")
+		t.FailNow()
+	}
+
+	if _, err := parseAnnotationEntries("joke=a.com nonsense"); err == nil {
+		t.Log("expected an option without a value to be rejected")
+		t.FailNow()
+	}
+}
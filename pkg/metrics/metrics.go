@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is anything that can be written out in the Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// Counter is a count that only goes up, like the number of patches sent.
+type Counter struct {
+	name  string
+	help  string
+	value uint64
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Value is the current count.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n",
+		c.name, c.help, c.name, c.name, c.Value())
+}
+
+// Gauge is a value that goes up and down, kept for each set of values of its
+// labels, like whether each entry of a configMap is stale.
+type Gauge struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]gaugeValue
+}
+
+type gaugeValue struct {
+	labelValues []string
+	value       float64
+}
+
+// Set the value for labelValues, given in the order the labels were
+// registered in.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	if len(labelValues) != len(g.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels but got %d values",
+			g.name, len(g.labels), len(labelValues)))
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[seriesKey(labelValues)] = gaugeValue{labelValues: labelValues, value: value}
+}
+
+// Value returns the value for labelValues and whether there is one.
+func (g *Gauge) Value(labelValues ...string) (float64, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	value, ok := g.values[seriesKey(labelValues)]
+	return value.value, ok
+}
+
+// DeleteMatching removes the values whose leading label values are prefix,
+// so that DeleteMatching("default", "app") forgets every entry of app.
+func (g *Gauge) DeleteMatching(prefix ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for key, value := range g.values {
+		if len(value.labelValues) >= len(prefix) &&
+			seriesKey(value.labelValues[:len(prefix)]) == seriesKey(prefix) {
+			delete(g.values, key)
+		}
+	}
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	keys := make([]string, 0, len(g.values))
+	for key := range g.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := g.values[key]
+		pairs := make([]string, len(g.labels))
+		for i, label := range g.labels {
+			pairs[i] = label + `="` + labelEscaper.Replace(value.labelValues[i]) + `"`
+		}
+		fmt.Fprintf(w, "%s{%s} %s\n", g.name, strings.Join(pairs, ","),
+			strconv.FormatFloat(value.value, 'g', -1, 64))
+	}
+}
+
+// labelEscaper escapes label values as the text format expects.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// seriesKey joins label values into a key that can't be confused with
+// another set of them.
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\x00")
+}
+
+// registry holds every metric by name so that they can all be served.
+var registry = struct {
+	sync.Mutex
+	metrics map[string]metric
+}{metrics: make(map[string]metric)}
+
+// register adds m under name, which must not already be taken.
+func register(name string, m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, ok := registry.metrics[name]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	registry.metrics[name] = m
+}
+
+// NewCounter registers a counter under name, which should follow the
+// Prometheus naming conventions and end in _total.
+func NewCounter(name string, help string) *Counter {
+	counter := &Counter{name: name, help: help}
+	register(name, counter)
+	return counter
+}
+
+// NewGauge registers a gauge under name with the given labels.
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	gauge := &Gauge{name: name, help: help, labels: labels,
+		values: make(map[string]gaugeValue)}
+	register(name, gauge)
+	return gauge
+}
+
+// Handler serves every metric in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registry.Lock()
+		defer registry.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		names := make([]string, 0, len(registry.metrics))
+		for name := range registry.metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			registry.metrics[name].write(w)
+		}
+	})
+}
+
+// Serve the metrics at /metrics on address, like :9090. It only returns when
+// the server fails.
+func Serve(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	return http.ListenAndServe(address, mux)
+}
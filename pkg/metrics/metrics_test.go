@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	counter := NewCounter("gofiggy_test_total", "Counts tests.")
+	counter.Inc()
+	counter.Inc()
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := "# HELP gofiggy_test_total Counts tests.\n" +
+		"# TYPE gofiggy_test_total counter\n" +
+		"gofiggy_test_total 2\n"
+	if !strings.Contains(recorder.Body.String(), expected) {
+		t.Logf("expected %q in %q", expected, recorder.Body.String())
+		t.FailNow()
+	}
+}
+
+func TestGauge(t *testing.T) {
+	gauge := NewGauge("gofiggy_test_stale", "Marks stale tests.", "configmap", "entry")
+	gauge.Set(1, "app", "flags")
+	gauge.Set(0, "app", "hosts")
+	gauge.Set(1, "other", "flags")
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := "# HELP gofiggy_test_stale Marks stale tests.\n" +
+		"# TYPE gofiggy_test_stale gauge\n" +
+		"gofiggy_test_stale{configmap=\"app\",entry=\"flags\"} 1\n" +
+		"gofiggy_test_stale{configmap=\"app\",entry=\"hosts\"} 0\n" +
+		"gofiggy_test_stale{configmap=\"other\",entry=\"flags\"} 1\n"
+	if !strings.Contains(recorder.Body.String(), expected) {
+		t.Logf("expected %q in %q", expected, recorder.Body.String())
+		t.FailNow()
+	}
+
+	gauge.DeleteMatching("app")
+	if _, ok := gauge.Value("app", "flags"); ok {
+		t.Log("expected the values for app to be removed")
+		t.FailNow()
+	}
+	if value, ok := gauge.Value("other", "flags"); !ok || value != 1 {
+		t.Logf("expected the values for other to be kept: %v", value)
+		t.FailNow()
+	}
+}
@@ -71,6 +71,8 @@ func GetObjectMetaData(obj interface{}) meta_v1.ObjectMeta {
 		objectMeta = object.ObjectMeta
 	case *apps_v1.DaemonSet:
 		objectMeta = object.ObjectMeta
+	case *apps_v1.StatefulSet:
+		objectMeta = object.ObjectMeta
 	case *api_v1.Service:
 		objectMeta = object.ObjectMeta
 	case *api_v1.Pod: